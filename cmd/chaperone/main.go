@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"time"
 
 	"github.com/KillianMeersman/chaperone/internal/chaperone"
 	"github.com/KillianMeersman/chaperone/pkg/log"
+	"github.com/KillianMeersman/chaperone/pkg/mitm"
 	"github.com/spf13/cobra"
 )
 
@@ -32,10 +34,45 @@ var (
 			}
 		},
 	}
+
+	caCmd = &cobra.Command{
+		Use:   "ca",
+		Short: "Manage the certificate authority used in MITM mode",
+	}
+
+	caGenerateCmd = &cobra.Command{
+		Use:   "generate",
+		Short: "Generate a new certificate authority",
+		Long: `
+		Generates a self-signed certificate authority and writes it to $CA_CERT_FILE (default ./ca.crt)
+		and $CA_KEY_FILE (default ./ca.key). Clients must trust the certificate to use MITM mode.
+		`,
+		Run: func(cmd *cobra.Command, args []string) {
+			commonName, _ := cmd.Flags().GetString("common-name")
+			validity, _ := cmd.Flags().GetDuration("validity")
+
+			ca, err := mitm.GenerateCA(commonName, validity)
+			if err != nil {
+				log.DefaultLogger.Fatal(err.Error())
+			}
+
+			err = ca.WriteFiles(chaperone.CACertFile, chaperone.CAKeyFile)
+			if err != nil {
+				log.DefaultLogger.Fatal(err.Error())
+			}
+
+			log.DefaultLogger.Info("Generated certificate authority", "cert", chaperone.CACertFile, "key", chaperone.CAKeyFile)
+		},
+	}
 )
 
 func main() {
+	caGenerateCmd.Flags().String("common-name", "Chaperone CA", "Common name of the certificate authority")
+	caGenerateCmd.Flags().Duration("validity", 5*365*24*time.Hour, "How long the certificate authority is valid")
+	caCmd.AddCommand(caGenerateCmd)
+
 	rootCmd.AddCommand(proxyCmd)
+	rootCmd.AddCommand(caCmd)
 	err := rootCmd.ExecuteContext(context.Background())
 	if err != nil {
 		log.Fatal(err.Error())
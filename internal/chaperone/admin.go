@@ -0,0 +1,190 @@
+package chaperone
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/log"
+	"github.com/KillianMeersman/chaperone/pkg/proxy"
+)
+
+// A throttle as listed by the admin API, durations are formatted like "1.5s".
+type adminThrottle struct {
+	URL           string   `json:"url"`
+	Method        string   `json:"method"`
+	Interval      string   `json:"interval"`
+	Burst         int      `json:"burst"`
+	Quotas        []string `json:"quotas"`
+	MaxConcurrent int      `json:"max_concurrent"`
+	MaxQueue      int      `json:"max_queue"`
+	MaxWait       string   `json:"max_wait"`
+	// Current rate, which changes over time for adaptive throttles.
+	Rate     string `json:"rate,omitempty"`
+	Adaptive bool   `json:"adaptive"`
+	MinRate  string `json:"min_rate,omitempty"`
+	MaxRate  string `json:"max_rate,omitempty"`
+}
+
+func newAdminThrottle(method string, url string, limit proxy.Limit) adminThrottle {
+	throttle := adminThrottle{
+		URL:           url,
+		Method:        method,
+		Interval:      limit.Interval.String(),
+		Burst:         limit.Burst,
+		Quotas:        make([]string, 0, len(limit.Quotas)),
+		MaxConcurrent: limit.MaxConcurrent,
+		MaxQueue:      limit.MaxQueue,
+		MaxWait:       limit.MaxWait.String(),
+	}
+	for _, quota := range limit.Quotas {
+		throttle.Quotas = append(throttle.Quotas, quota.String())
+	}
+	if limit.Adaptive != nil {
+		throttle.Adaptive = true
+		throttle.MinRate = limit.Adaptive.MinRate.String()
+		throttle.MaxRate = limit.Adaptive.MaxRate.String()
+	}
+	throttle.Rate = proxy.FormatRate(limit.Interval)
+	return throttle
+}
+
+// A throttle as set through the admin API, like a rate limit in the config file.
+type adminSetThrottle struct {
+	RateLimit
+	WaitDuration string `json:"wait_duration"`
+	MaxWait      string `json:"max_wait"`
+}
+
+// A cache purge request, for either an exact url or all urls with a prefix.
+type adminPurge struct {
+	URL    string `json:"url"`
+	Prefix string `json:"prefix"`
+}
+
+// Create the handler of the admin API.
+func (p *ChaperoneProxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /throttles", p.handleListThrottles)
+	mux.HandleFunc("PUT /throttles", p.handleSetThrottle)
+	mux.HandleFunc("GET /cache/stats", p.handleCacheStats)
+	mux.HandleFunc("POST /cache/purge", p.handleCachePurge)
+	mux.HandleFunc("GET /circuit-breakers", p.handleListCircuitBreakers)
+	mux.Handle("GET /metrics", p.metrics)
+	return mux
+}
+
+// Serve the admin API on $ADMIN_ADDR until it fails.
+func (p *ChaperoneProxy) startAdminServer() {
+	log.DefaultLogger.Info("Serving admin API", "addr", AdminAddr)
+	go func() {
+		err := http.ListenAndServe(AdminAddr, p.adminHandler())
+		if err != nil {
+			log.DefaultLogger.Error(err.Error(), "addr", AdminAddr)
+		}
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.DefaultLogger.Error(err.Error())
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (p *ChaperoneProxy) handleListThrottles(w http.ResponseWriter, req *http.Request) {
+	throttles := make([]adminThrottle, 0)
+	for _, setting := range p.throttle.Throttles() {
+		throttles = append(throttles, newAdminThrottle(setting.Method, setting.URL, setting.Limit))
+	}
+
+	writeJSON(w, http.StatusOK, throttles)
+}
+
+func (p *ChaperoneProxy) handleSetThrottle(w http.ResponseWriter, req *http.Request) {
+	throttle := adminSetThrottle{}
+	err := json.NewDecoder(req.Body).Decode(&throttle)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	rateLimit := throttle.RateLimit
+	if rateLimit.Method == "" {
+		rateLimit.Method = http.MethodGet
+	}
+	if throttle.WaitDuration != "" {
+		rateLimit.WaitDuration, err = time.ParseDuration(throttle.WaitDuration)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if throttle.MaxWait != "" {
+		rateLimit.MaxWait, err = time.ParseDuration(throttle.MaxWait)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	// Validate the throttle like a rate limit in the config file.
+	err = (&ConfigFile{RateLimits: []RateLimit{rateLimit}}).Validate()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	throttleURL, _ := url.Parse(rateLimit.URL)
+	limit, _ := rateLimit.Limit()
+	log.DefaultLogger.Info("Setting throttle for url", "url", rateLimit.URL, "method", rateLimit.Method, "limit", limit.String())
+	p.throttle.SetThrottle(&http.Request{
+		Method: rateLimit.Method,
+		URL:    throttleURL,
+	}, limit)
+
+	writeJSON(w, http.StatusOK, newAdminThrottle(rateLimit.Method, rateLimit.URL, limit))
+}
+
+func (p *ChaperoneProxy) handleCacheStats(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, p.cache.Stats())
+}
+
+func (p *ChaperoneProxy) handleCachePurge(w http.ResponseWriter, req *http.Request) {
+	purge := adminPurge{}
+	err := json.NewDecoder(req.Body).Decode(&purge)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if (purge.URL == "") == (purge.Prefix == "") {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("either url or prefix must be set"))
+		return
+	}
+
+	var purged int
+	if purge.URL != "" {
+		purged, err = p.cache.Purge(req.Context(), purge.URL, false)
+	} else {
+		purged, err = p.cache.Purge(req.Context(), purge.Prefix, true)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.DefaultLogger.Info("Purged cached responses", "url", purge.URL, "prefix", purge.Prefix, "purged", fmt.Sprint(purged))
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
+
+func (p *ChaperoneProxy) handleListCircuitBreakers(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, p.client.Breakers.States())
+}
@@ -0,0 +1,148 @@
+package chaperone
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// The request has no Proxy-Authorization header while authentication is required.
+	errMissingCredentials = errors.New("proxy authentication required")
+	// The Proxy-Authorization header doesn't match any credentials.
+	errInvalidCredentials = errors.New("invalid proxy credentials")
+)
+
+// Credentials a client authenticates with in the Proxy-Authorization header:
+// a username and password for Basic authentication, or a static token for Bearer authentication.
+type CredentialConfig struct {
+	// Name of the client the credentials belong to, which picks its entry in clients if there is one.
+	Client   string `yaml:"client"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"`
+}
+
+// Proxy authentication settings.
+type AuthConfig struct {
+	// Reject requests without credentials. Requests with invalid credentials are always rejected.
+	Required bool `yaml:"required"`
+	// YAML file with more credentials under a `credentials` key, so that they can be kept out of the config file.
+	SecretsFile string             `yaml:"secrets_file"`
+	Credentials []CredentialConfig `yaml:"credentials"`
+}
+
+// Read the credentials of the secrets file, if any.
+func (a *AuthConfig) loadSecretsFile() error {
+	if a.SecretsFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.SecretsFile)
+	if err != nil {
+		return fmt.Errorf("auth.secrets_file: %w", err)
+	}
+	secrets := struct {
+		Credentials []CredentialConfig `yaml:"credentials"`
+	}{}
+	if err := yaml.Unmarshal(data, &secrets); err != nil {
+		return fmt.Errorf("auth.secrets_file: %w", err)
+	}
+	a.Credentials = append(a.Credentials, secrets.Credentials...)
+	return nil
+}
+
+// Check that every credential belongs to a client and is either a username and password or a token, and that no
+// username or token is used twice.
+func (a AuthConfig) Validate() error {
+	usernames := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for i, credential := range a.Credentials {
+		if credential.Client == "" {
+			return fmt.Errorf("auth.credentials[%d]: client is required", i)
+		}
+		basic := credential.Username != "" || credential.Password != ""
+		switch {
+		case basic && credential.Token != "":
+			return fmt.Errorf("auth.credentials[%d]: username and token can't both be set", i)
+		case basic && (credential.Username == "" || credential.Password == ""):
+			return fmt.Errorf("auth.credentials[%d]: username and password are both required", i)
+		case !basic && credential.Token == "":
+			return fmt.Errorf("auth.credentials[%d]: either a username and password or a token is required", i)
+		case usernames[credential.Username] || tokens[credential.Token]:
+			return fmt.Errorf("auth.credentials[%d]: the username or token of client '%s' is used twice", i, credential.Client)
+		}
+		if basic {
+			usernames[credential.Username] = true
+		} else {
+			tokens[credential.Token] = true
+		}
+	}
+	if a.Required && len(a.Credentials) == 0 {
+		return fmt.Errorf("auth: credentials are required when authentication is required")
+	}
+	return nil
+}
+
+// Return true if the client has credentials, so that it can only be identified by authenticating.
+func (a AuthConfig) hasCredentials(client string) bool {
+	for _, credential := range a.Credentials {
+		if credential.Client == client {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the secrets are equal, in constant time.
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Authenticate the Proxy-Authorization header of the request.
+// Returns the name of the client the credentials belong to, empty if the request has none and they aren't required.
+func (a AuthConfig) authenticate(req *http.Request) (string, error) {
+	authorization := req.Header.Get("Proxy-Authorization")
+	if authorization == "" {
+		if a.Required {
+			return "", errMissingCredentials
+		}
+		return "", nil
+	}
+
+	scheme, value, _ := strings.Cut(authorization, " ")
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", errInvalidCredentials
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		for _, credential := range a.Credentials {
+			if credential.Username != "" && secretEqual(credential.Username, username) && secretEqual(credential.Password, password) {
+				return credential.Client, nil
+			}
+		}
+	case "bearer":
+		for _, credential := range a.Credentials {
+			if credential.Token != "" && secretEqual(credential.Token, value) {
+				return credential.Client, nil
+			}
+		}
+	}
+	return "", errInvalidCredentials
+}
+
+// Reject a request that failed to authenticate, asking the client for credentials.
+func proxyAuthRequired(w http.ResponseWriter, err error) {
+	w.Header().Add("Proxy-Authenticate", `Basic realm="chaperone"`)
+	w.Header().Add("Proxy-Authenticate", `Bearer realm="chaperone"`)
+	http.Error(w, err.Error(), http.StatusProxyAuthRequired)
+}
@@ -0,0 +1,278 @@
+package chaperone
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/metrics"
+	"github.com/KillianMeersman/chaperone/pkg/proxy"
+)
+
+func basicAuthorization(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+var testAuth = AuthConfig{
+	Credentials: []CredentialConfig{
+		{Client: "webapp", Username: "webapp", Password: "secret"},
+		{Client: "reporting", Token: "token"},
+	},
+}
+
+func TestAuthenticate(t *testing.T) {
+	required := testAuth
+	required.Required = true
+
+	tests := []struct {
+		name          string
+		auth          AuthConfig
+		authorization string
+		client        string
+		err           error
+	}{
+		{"basic", testAuth, basicAuthorization("webapp", "secret"), "webapp", nil},
+		{"basic scheme is case insensitive", testAuth, "basic " + strings.TrimPrefix(basicAuthorization("webapp", "secret"), "Basic "), "webapp", nil},
+		{"bearer", testAuth, "Bearer token", "reporting", nil},
+		{"wrong password", testAuth, basicAuthorization("webapp", "wrong"), "", errInvalidCredentials},
+		{"password of another user", testAuth, basicAuthorization("reporting", "secret"), "", errInvalidCredentials},
+		{"token as password", testAuth, basicAuthorization("", "token"), "", errInvalidCredentials},
+		{"invalid base64", testAuth, "Basic !!!", "", errInvalidCredentials},
+		{"wrong token", testAuth, "Bearer wrong", "", errInvalidCredentials},
+		{"unknown scheme", testAuth, "Digest token", "", errInvalidCredentials},
+		{"no credentials", testAuth, "", "", nil},
+		{"no credentials while required", required, "", "", errMissingCredentials},
+		{"invalid credentials while required", required, "Bearer wrong", "", errInvalidCredentials},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		if test.authorization != "" {
+			req.Header.Set("Proxy-Authorization", test.authorization)
+		}
+		client, err := test.auth.authenticate(req)
+		if client != test.client || !errors.Is(err, test.err) {
+			t.Fatalf("%s: expected client '%s' and error %v, got '%s' and %v", test.name, test.client, test.err, client, err)
+		}
+	}
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		auth  AuthConfig
+		valid bool
+	}{
+		{"valid", testAuth, true},
+		{"no credentials", AuthConfig{}, true},
+		{"required without credentials", AuthConfig{Required: true}, false},
+		{"no client", AuthConfig{Credentials: []CredentialConfig{{Token: "token"}}}, false},
+		{"username and token", AuthConfig{Credentials: []CredentialConfig{{Client: "a", Username: "a", Password: "b", Token: "c"}}}, false},
+		{"username without password", AuthConfig{Credentials: []CredentialConfig{{Client: "a", Username: "a"}}}, false},
+		{"password without username", AuthConfig{Credentials: []CredentialConfig{{Client: "a", Password: "b"}}}, false},
+		{"no secret", AuthConfig{Credentials: []CredentialConfig{{Client: "a"}}}, false},
+		{"username used twice", AuthConfig{Credentials: []CredentialConfig{
+			{Client: "a", Username: "a", Password: "b"},
+			{Client: "b", Username: "a", Password: "c"},
+		}}, false},
+		{"token used twice", AuthConfig{Credentials: []CredentialConfig{{Client: "a", Token: "t"}, {Client: "b", Token: "t"}}}, false},
+	}
+	for _, test := range tests {
+		err := test.auth.Validate()
+		if (err == nil) != test.valid {
+			t.Fatalf("%s: expected valid to be %v, got error %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestClientForRequest(t *testing.T) {
+	configFile := &ConfigFile{
+		Auth: testAuth,
+		Clients: []ClientConfig{
+			{Name: "webapp", Addresses: []string{"10.1.0.0/16"}, Priority: "high"},
+			{Name: "batch-sync", Addresses: []string{"10.2.0.12"}, Priority: "low"},
+			{Name: "reporting", Weight: 3},
+			{Name: "crawler", Weight: 2},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		authorization string
+		header        string
+		client        string
+		err           error
+	}{
+		{"address", "10.1.2.3:1234", "", "", "webapp", nil},
+		{"single address", "10.2.0.12:1234", "", "", "batch-sync", nil},
+		{"unknown address", "192.0.2.1:1234", "", "", "192.0.2.1", nil},
+		{"credentials", "192.0.2.1:1234", "Bearer token", "", "reporting", nil},
+		{"credentials win over the address", "10.1.2.3:1234", "Bearer token", "", "reporting", nil},
+		{"credentials win over the header", "192.0.2.1:1234", "Bearer token", "crawler", "reporting", nil},
+		{"invalid credentials", "10.1.2.3:1234", "Bearer wrong", "", "", errInvalidCredentials},
+		{"header of a client without addresses", "192.0.2.1:1234", "", "crawler", "crawler", nil},
+		{"header of an unknown client", "192.0.2.1:1234", "", "scraper", "scraper", nil},
+		{"header wins over the address", "10.1.2.3:1234", "", "crawler", "crawler", nil},
+		{"header of a client from one of its addresses", "10.2.0.12:1234", "", "batch-sync", "batch-sync", nil},
+		{"header of a client from another address", "192.0.2.1:1234", "", "batch-sync", "192.0.2.1", nil},
+		{"header of a client from another client's address", "10.1.2.3:1234", "", "batch-sync", "webapp", nil},
+		{"header of a client with credentials", "192.0.2.1:1234", "", "reporting", "192.0.2.1", nil},
+		{"header of a client with credentials from its address", "10.1.2.3:1234", "", "webapp", "webapp", nil},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.authorization != "" {
+			req.Header.Set("Proxy-Authorization", test.authorization)
+		}
+		if test.header != "" {
+			req.Header.Set(proxy.ClientHeader, test.header)
+		}
+		client, err := configFile.ClientForRequest(req)
+		if client.Name != test.client || !errors.Is(err, test.err) {
+			t.Fatalf("%s: expected client '%s' and error %v, got '%s' and %v", test.name, test.client, test.err, client.Name, err)
+		}
+	}
+}
+
+func TestClientLabel(t *testing.T) {
+	configFile := &ConfigFile{Auth: testAuth, Clients: []ClientConfig{{Name: "crawler"}}}
+	for name, expected := range map[string]string{
+		"crawler":   "crawler",
+		"reporting": "reporting",
+		"scraper":   anonymousClient,
+		"192.0.2.1": anonymousClient,
+	} {
+		if label := configFile.clientLabel(ClientConfig{Name: name}); label != expected {
+			t.Fatalf("expected label '%s' for client '%s', got '%s'", expected, name, label)
+		}
+	}
+}
+
+func TestProxyAuthRequired(t *testing.T) {
+	w := httptest.NewRecorder()
+	proxyAuthRequired(w, errMissingCredentials)
+
+	if w.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("expected status 407, got %d", w.Code)
+	}
+	challenges := w.Header().Values("Proxy-Authenticate")
+	if len(challenges) != 2 || !strings.HasPrefix(challenges[0], "Basic ") || !strings.HasPrefix(challenges[1], "Bearer ") {
+		t.Fatalf("expected a Basic and a Bearer challenge, got %v", challenges)
+	}
+}
+
+func TestSecretsFile(t *testing.T) {
+	dir := t.TempDir()
+	secretsFile := filepath.Join(dir, "secrets.yaml")
+	err := os.WriteFile(secretsFile, []byte("credentials:\n  - client: reporting\n    token: from-secrets\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.yaml")
+	config := "auth:\n  required: true\n  secrets_file: " + secretsFile + "\n  credentials:\n    - client: webapp\n      username: webapp\n      password: secret\n"
+	if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cf, err := ParseConfigFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for authorization, expected := range map[string]string{
+		"Bearer from-secrets":                  "reporting",
+		basicAuthorization("webapp", "secret"): "webapp",
+	} {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Proxy-Authorization", authorization)
+		client, err := cf.Auth.authenticate(req)
+		if err != nil || client != expected {
+			t.Fatalf("expected client '%s', got '%s' and %v", expected, client, err)
+		}
+	}
+
+	// A missing secrets file fails the config file.
+	if err := os.Remove(secretsFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseConfigFile(configFile); err == nil {
+		t.Fatal("expected an error for the missing secrets file")
+	}
+}
+
+// Round tripper that records the requests it receives and responds with 200 OK.
+type recordingRoundTripper struct {
+	requests []*http.Request
+}
+
+func (r *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.requests = append(r.requests, req)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("OK")),
+		Request:    req,
+	}, nil
+}
+
+// Create a proxy with the config file that forwards requests to the round tripper.
+func newTestProxy(t *testing.T, configFile *ConfigFile, roundTripper http.RoundTripper) *ChaperoneProxy {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	p := &ChaperoneProxy{metrics: metrics.NewRegistry()}
+	p.client = proxy.NewNiceClient(ctx, roundTripper, proxy.NewMemoryHTTPThrottle(time.Millisecond), proxy.NewMemoryHTTPCache(ctx, 1<<20))
+	p.clientRequests = p.metrics.NewCounter("chaperone_client_requests_total", "Requests handled for every client.", "client")
+	p.config.Store(configFile)
+	return p
+}
+
+func TestTunnelAuthorization(t *testing.T) {
+	auth := testAuth
+	auth.Required = true
+	roundTripper := &recordingRoundTripper{}
+	p := newTestProxy(t, &ConfigFile{Auth: auth}, roundTripper)
+
+	tunneled := func(authorization string) *httptest.ResponseRecorder {
+		ctx := context.WithValue(context.Background(), tunnelTargetKey, "example.com:443")
+		ctx = context.WithValue(ctx, tunnelAuthorizationKey, authorization)
+		req := httptest.NewRequest("GET", "/orders", nil).WithContext(ctx)
+		req.Host = "example.com"
+		req.Header.Set(proxy.RespectRobotsHeader, "false")
+		w := httptest.NewRecorder()
+		p.serveTunneled(w, req)
+		return w
+	}
+
+	// The credentials of the CONNECT request authenticate the requests sent through the tunnel.
+	w := tunneled("Bearer token")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if len(roundTripper.requests) != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", len(roundTripper.requests))
+	}
+	upstream := roundTripper.requests[0]
+	if upstream.URL.String() != "https://example.com/orders" || upstream.Header.Get("Proxy-Authorization") != "" {
+		t.Fatalf("expected a request for https://example.com/orders without credentials, got %s %v", upstream.URL, upstream.Header)
+	}
+
+	// Tunnels without valid credentials are rejected.
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		w = tunneled(authorization)
+		if w.Code != http.StatusProxyAuthRequired {
+			t.Fatalf("expected status 407 for '%s', got %d", authorization, w.Code)
+		}
+	}
+	if len(roundTripper.requests) != 1 {
+		t.Fatalf("expected rejected requests not to be forwarded, got %d upstream requests", len(roundTripper.requests))
+	}
+}
@@ -1,36 +1,411 @@
 package chaperone
 
 import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/KillianMeersman/chaperone/pkg/config"
+	"github.com/KillianMeersman/chaperone/pkg/datastructures/eviction"
+	"github.com/KillianMeersman/chaperone/pkg/proxy"
 	"gopkg.in/yaml.v2"
 )
 
+// Defaults of the $RETRY_* and $BREAKER_* environment variables.
+var (
+	defaultRetryPolicy     = proxy.DefaultRetryPolicy()
+	defaultBreakerSettings = proxy.DefaultBreakerSettings()
+)
+
 var (
 	Port               = config.GetInt64("PORT", 8080, false)
 	ConfigFileLocation = config.GetString("CONFIGFILE", "./chaperone.yaml", false)
+	// Interval at which the config file is checked for changes, 0 disables checking.
+	ConfigReloadInterval = config.GetDuration("CONFIG_RELOAD_INTERVAL", 5*time.Second, false)
+	MITMEnabled          = config.GetBool("MITM_ENABLED", false, false)
+	CACertFile           = config.GetString("CA_CERT_FILE", "./ca.crt", false)
+	CAKeyFile            = config.GetString("CA_KEY_FILE", "./ca.key", false)
+	CacheMaxSize         = config.GetInt64("CACHE_MAX_SIZE", 512e6, false)
+	CacheEviction        = config.GetString("CACHE_EVICTION_POLICY", eviction.LRU, false)
+	CacheStore           = config.GetString("CACHE_STORE", "memory", false)
+	CacheDir             = config.GetString("CACHE_DIR", "./cache", false)
+	CacheDiskBudget      = config.GetInt64("CACHE_DISK_BUDGET", 10e9, false)
+	ThrottleStore        = config.GetString("THROTTLE_STORE", "memory", false)
+	RedisURL             = config.GetString("REDIS_URL", "redis://localhost:6379/0", true)
+	RedisPrefix          = config.GetString("REDIS_PREFIX", "chaperone:", false)
+	AdminAddr            = config.GetString("ADMIN_ADDR", "127.0.0.1:8081", false)
+	// Global retry policy, rate limit rules can override it. Zero attempts or retry time is unlimited.
+	RetryMaxAttempts    = config.GetInt64("RETRY_MAX_ATTEMPTS", int64(defaultRetryPolicy.MaxAttempts), false)
+	RetryMaxTime        = config.GetDuration("RETRY_MAX_TIME", defaultRetryPolicy.MaxRetryTime, false)
+	RetryInitialBackoff = config.GetDuration("RETRY_INITIAL_BACKOFF", defaultRetryPolicy.InitialBackoff, false)
+	RetryMaxBackoff     = config.GetDuration("RETRY_MAX_BACKOFF", defaultRetryPolicy.MaxBackoff, false)
+	RetryStatusCodes    = config.GetString("RETRY_STATUS_CODES", joinStatusCodes(defaultRetryPolicy.StatusCodes), false)
+	RetryErrors         = config.GetString("RETRY_ERRORS", strings.Join(defaultRetryPolicy.Errors, ","), false)
+	// Global circuit breaker settings, per host. Rate limit rules can have their own breaker.
+	BreakerConsecutiveFailures = config.GetInt64("BREAKER_CONSECUTIVE_FAILURES", int64(defaultBreakerSettings.ConsecutiveFailures), false)
+	BreakerFailureRate         = config.GetFloat64("BREAKER_FAILURE_RATE", defaultBreakerSettings.FailureRate, false)
+	BreakerMinRequests         = config.GetInt64("BREAKER_MIN_REQUESTS", int64(defaultBreakerSettings.MinRequests), false)
+	BreakerWindow              = config.GetDuration("BREAKER_WINDOW", defaultBreakerSettings.Window, false)
+	BreakerOpenDuration        = config.GetDuration("BREAKER_OPEN_DURATION", defaultBreakerSettings.OpenDuration, false)
+	BreakerProbes              = config.GetInt64("BREAKER_PROBES", int64(defaultBreakerSettings.Probes), false)
+	// Minimum fraction of a throttle's slots every priority gets while it has requests waiting.
+	PriorityMinShare = config.GetFloat64("PRIORITY_MIN_SHARE", 0.1, false)
+	// Respect the robots.txt of upstream servers, unless a request turns it off. The user agent token picks the robots.txt rules.
+	RespectRobots   = config.GetBool("RESPECT_ROBOTS", true, false)
+	RobotsUserAgent = config.GetString("ROBOTS_USER_AGENT", "Chaperone", false)
 )
 
+// Get the global circuit breaker settings from the $BREAKER_* environment variables.
+func globalBreakerSettings() (proxy.BreakerSettings, error) {
+	breaker := CircuitBreakerConfig{
+		ConsecutiveFailures: int(BreakerConsecutiveFailures),
+		FailureRate:         BreakerFailureRate,
+		MinRequests:         int(BreakerMinRequests),
+		Window:              BreakerWindow,
+		OpenDuration:        BreakerOpenDuration,
+		Probes:              int(BreakerProbes),
+	}
+	if err := breaker.Validate(); err != nil {
+		return proxy.BreakerSettings{}, fmt.Errorf("circuit breaker: %w", err)
+	}
+	return breaker.Settings(proxy.BreakerSettings{}), nil
+}
+
+// Circuit breaker settings, settings that aren't set are taken from the global settings.
+type CircuitBreakerConfig struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures"`
+	FailureRate         float64       `yaml:"failure_rate"`
+	MinRequests         int           `yaml:"min_requests"`
+	Window              time.Duration `yaml:"window"`
+	OpenDuration        time.Duration `yaml:"open_duration"`
+	Probes              int           `yaml:"probes"`
+}
+
+// Check that the circuit breaker settings are valid.
+func (b CircuitBreakerConfig) Validate() error {
+	if b.ConsecutiveFailures < 0 || b.MinRequests < 0 || b.Window < 0 || b.OpenDuration < 0 || b.Probes < 0 {
+		return fmt.Errorf("consecutive_failures, min_requests, window, open_duration and probes can't be negative")
+	}
+	if b.FailureRate < 0 || b.FailureRate > 1 {
+		return fmt.Errorf("failure_rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// Get the circuit breaker settings, taking the settings that aren't set from the provided settings.
+func (b CircuitBreakerConfig) Settings(defaults proxy.BreakerSettings) proxy.BreakerSettings {
+	settings := defaults
+	if b.ConsecutiveFailures != 0 {
+		settings.ConsecutiveFailures = b.ConsecutiveFailures
+	}
+	if b.FailureRate != 0 {
+		settings.FailureRate = b.FailureRate
+	}
+	if b.MinRequests != 0 {
+		settings.MinRequests = b.MinRequests
+	}
+	if b.Window != 0 {
+		settings.Window = b.Window
+	}
+	if b.OpenDuration != 0 {
+		settings.OpenDuration = b.OpenDuration
+	}
+	if b.Probes != 0 {
+		settings.Probes = b.Probes
+	}
+	return settings
+}
+
+// Join status codes into a comma separated list.
+func joinStatusCodes(codes []int) string {
+	rawCodes := make([]string, len(codes))
+	for i, code := range codes {
+		rawCodes[i] = strconv.Itoa(code)
+	}
+	return strings.Join(rawCodes, ",")
+}
+
+// Get the global retry policy from the $RETRY_* environment variables.
+func globalRetryPolicy() (proxy.RetryPolicy, error) {
+	retry := RetryConfig{
+		MaxAttempts:    int(RetryMaxAttempts),
+		MaxRetryTime:   RetryMaxTime,
+		InitialBackoff: RetryInitialBackoff,
+		MaxBackoff:     RetryMaxBackoff,
+		StatusCodes:    make([]int, 0),
+		Errors:         make([]string, 0),
+	}
+	for _, rawCode := range strings.Split(RetryStatusCodes, ",") {
+		if rawCode = strings.TrimSpace(rawCode); rawCode == "" {
+			continue
+		}
+		code, err := strconv.Atoi(rawCode)
+		if err != nil {
+			return proxy.RetryPolicy{}, fmt.Errorf("RETRY_STATUS_CODES: invalid status code '%s'", rawCode)
+		}
+		retry.StatusCodes = append(retry.StatusCodes, code)
+	}
+	for _, class := range strings.Split(RetryErrors, ",") {
+		if class = strings.TrimSpace(class); class != "" {
+			retry.Errors = append(retry.Errors, class)
+		}
+	}
+
+	if err := retry.Validate(); err != nil {
+		return proxy.RetryPolicy{}, fmt.Errorf("retry policy: %w", err)
+	}
+	return retry.Policy(proxy.RetryPolicy{}), nil
+}
+
+// A retry policy, settings that aren't set are taken from the global retry policy.
+type RetryConfig struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	MaxRetryTime   time.Duration `yaml:"max_retry_time"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	StatusCodes    []int         `yaml:"status_codes"`
+	// Classes of errors to retry, connection and timeout.
+	Errors []string `yaml:"errors"`
+}
+
+// Check that the retry policy is valid.
+func (r RetryConfig) Validate() error {
+	if r.MaxAttempts < 0 || r.MaxRetryTime < 0 || r.InitialBackoff < 0 || r.MaxBackoff < 0 {
+		return fmt.Errorf("max_attempts, max_retry_time, initial_backoff and max_backoff can't be negative")
+	}
+	for _, code := range r.StatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid status code %d", code)
+		}
+	}
+	for _, class := range r.Errors {
+		if class != proxy.RetryErrorConnection && class != proxy.RetryErrorTimeout {
+			return fmt.Errorf("unknown error class '%s', expected %s or %s", class, proxy.RetryErrorConnection, proxy.RetryErrorTimeout)
+		}
+	}
+	return nil
+}
+
+// Get the retry policy, taking the settings that aren't set from the provided policy.
+func (r RetryConfig) Policy(defaults proxy.RetryPolicy) proxy.RetryPolicy {
+	policy := defaults
+	if r.MaxAttempts != 0 {
+		policy.MaxAttempts = r.MaxAttempts
+	}
+	if r.MaxRetryTime != 0 {
+		policy.MaxRetryTime = r.MaxRetryTime
+	}
+	if r.InitialBackoff != 0 {
+		policy.InitialBackoff = r.InitialBackoff
+	}
+	if r.MaxBackoff != 0 {
+		policy.MaxBackoff = r.MaxBackoff
+	}
+	if r.StatusCodes != nil {
+		policy.StatusCodes = r.StatusCodes
+	}
+	if r.Errors != nil {
+		policy.Errors = r.Errors
+	}
+	return policy
+}
+
 type RateLimit struct {
-	URL          string        `yaml:"url"`
-	Method       string        `yaml:"method"`
-	WaitDuration time.Duration `yaml:"wait_duration"`
+	URL    string `yaml:"url" json:"url"`
+	Method string `yaml:"method" json:"method"`
+	// Shorthand for a rate of one request per wait_duration.
+	WaitDuration time.Duration `yaml:"wait_duration" json:"-"`
+	// Rate like 1000/minute, enforced by a token bucket holding burst requests.
+	Rate  string `yaml:"rate" json:"rate"`
+	Burst int    `yaml:"burst" json:"burst"`
+	// Rates over longer windows like 10000/day, enforced in fixed windows.
+	Quotas []string `yaml:"quotas" json:"quotas"`
+	// Maximum number of requests in flight at once, further requests queue until one finishes.
+	MaxConcurrent int `yaml:"max_concurrent" json:"max_concurrent"`
+	// Maximum number of requests waiting on the rule at once, further requests are rejected with a 503 status.
+	MaxQueue int `yaml:"max_queue" json:"max_queue"`
+	// Maximum time a request waits on the rule, requests that would wait longer are rejected with a 429 status.
+	MaxWait time.Duration `yaml:"max_wait" json:"-"`
+	// Adapt the rate to the upstream server's responses, between min_rate and max_rate.
+	// The rate starts at rate or wait_duration if set, otherwise at min_rate.
+	Adaptive bool   `yaml:"adaptive" json:"adaptive"`
+	MinRate  string `yaml:"min_rate" json:"min_rate"`
+	MaxRate  string `yaml:"max_rate" json:"max_rate"`
+	// Retry policy for requests matching the rule, overriding the global retry policy.
+	Retry *RetryConfig `yaml:"retry" json:"-"`
+	// Circuit breaker for requests matching the rule, instead of the breaker of their host.
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker" json:"-"`
+}
+
+// Get the limit the rate limit describes.
+func (r RateLimit) Limit() (proxy.Limit, error) {
+	limit := proxy.Limit{}
+
+	switch {
+	case r.WaitDuration != 0 && r.Rate != "":
+		return limit, fmt.Errorf("wait_duration and rate can't both be set")
+	case r.WaitDuration < 0:
+		return limit, fmt.Errorf("wait_duration must be positive")
+	case r.WaitDuration > 0:
+		limit = proxy.IntervalLimit(r.WaitDuration)
+	case r.Rate != "":
+		rate, err := proxy.ParseRate(r.Rate)
+		if err != nil {
+			return limit, err
+		}
+		limit = proxy.NewRateLimit(rate, 1)
+	case len(r.Quotas) == 0 && r.MaxConcurrent == 0 && !r.Adaptive && r.MaxQueue == 0 && r.MaxWait == 0:
+		return limit, fmt.Errorf("one of wait_duration, rate, quotas, max_concurrent or adaptive is required")
+	}
+
+	if r.Adaptive {
+		bounds, err := r.adaptiveRate()
+		if err != nil {
+			return limit, err
+		}
+		if limit.Interval == 0 {
+			limit = proxy.NewRateLimit(bounds.MinRate, 1)
+		}
+		limit.Adaptive = &bounds
+	} else if r.MinRate != "" || r.MaxRate != "" {
+		return limit, fmt.Errorf("min_rate and max_rate require adaptive")
+	}
+
+	if r.MaxConcurrent < 0 {
+		return limit, fmt.Errorf("max_concurrent can't be negative")
+	}
+	limit.MaxConcurrent = r.MaxConcurrent
+
+	if r.MaxQueue < 0 {
+		return limit, fmt.Errorf("max_queue can't be negative")
+	}
+	limit.MaxQueue = r.MaxQueue
+	if r.MaxWait < 0 {
+		return limit, fmt.Errorf("max_wait can't be negative")
+	}
+	limit.MaxWait = r.MaxWait
+
+	if r.Burst < 0 {
+		return limit, fmt.Errorf("burst can't be negative")
+	}
+	if r.Burst > 0 {
+		if limit.Interval == 0 {
+			return limit, fmt.Errorf("burst requires wait_duration or rate")
+		}
+		limit.Burst = r.Burst
+	}
+
+	for _, rawQuota := range r.Quotas {
+		quota, err := proxy.ParseRate(rawQuota)
+		if err != nil {
+			return limit, err
+		}
+		limit.Quotas = append(limit.Quotas, quota)
+	}
+
+	return limit, nil
+}
+
+// Get the bounds of an adaptive rate limit.
+func (r RateLimit) adaptiveRate() (proxy.AdaptiveRate, error) {
+	if r.MinRate == "" || r.MaxRate == "" {
+		return proxy.AdaptiveRate{}, fmt.Errorf("adaptive requires min_rate and max_rate")
+	}
+	minRate, err := proxy.ParseRate(r.MinRate)
+	if err != nil {
+		return proxy.AdaptiveRate{}, err
+	}
+	maxRate, err := proxy.ParseRate(r.MaxRate)
+	if err != nil {
+		return proxy.AdaptiveRate{}, err
+	}
+	if minRate.PerSecond() > maxRate.PerSecond() {
+		return proxy.AdaptiveRate{}, fmt.Errorf("min_rate can't be higher than max_rate")
+	}
+	return proxy.AdaptiveRate{MinRate: minRate, MaxRate: maxRate}, nil
 }
 
 type CacheConfig struct {
-	URL        string        `yaml:"url"`
-	MinTTL     time.Duration `yaml:"min_ttl"`
-	MaxTTL     time.Duration `yaml:"max_ttl"`
-	DefaultTTL time.Duration `yaml:"default_ttl"`
+	URL                  string        `yaml:"url"`
+	MinTTL               time.Duration `yaml:"min_ttl"`
+	MaxTTL               time.Duration `yaml:"max_ttl"`
+	DefaultTTL           time.Duration `yaml:"default_ttl"`
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate"`
+	StaleIfError         time.Duration `yaml:"stale_if_error"`
+}
+
+// A client of the proxy, identified by its proxy credentials, its X-Chaperone-Client header or the address it connects from.
+type ClientConfig struct {
+	Name string `yaml:"name"`
+	// IP addresses and CIDR ranges the client connects from.
+	Addresses []string `yaml:"addresses"`
+	// Default priority of the client's requests, the X-Chaperone-Priority header overrides it.
+	Priority string `yaml:"priority"`
+	// Share of every throttle the client gets relative to the other clients waiting on it, 1 if unset.
+	Weight float64 `yaml:"weight"`
+	// Budget of upstream requests the client may make, over all urls, like the rate and quotas of a rate limit.
+	Rate   string   `yaml:"rate"`
+	Quotas []string `yaml:"quotas"`
+}
+
+// Return true if the client has a budget of upstream requests.
+func (c ClientConfig) hasBudget() bool {
+	return c.Rate != "" || len(c.Quotas) > 0
+}
+
+// Get the rate limit for the client's budget, set on the client's throttle.
+func (c ClientConfig) budget() RateLimit {
+	return RateLimit{
+		URL:    proxy.ClientThrottleRequest(c.Name).URL.String(),
+		Method: proxy.ClientThrottleMethod,
+		Rate:   c.Rate,
+		Quotas: c.Quotas,
+	}
+}
+
+// Return true if the client connects from the ip.
+func (c ClientConfig) matchesIP(ip net.IP) bool {
+	for _, address := range c.Addresses {
+		if _, network, err := net.ParseCIDR(address); err == nil && network.Contains(ip) {
+			return true
+		}
+		if net.ParseIP(address).Equal(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 type ConfigFile struct {
-	RateLimits     []RateLimit   `yaml:"rate_limits"`
-	CacheOverrides []CacheConfig `yaml:"cache_overrides"`
+	RateLimits     []RateLimit    `yaml:"rate_limits"`
+	CacheOverrides []CacheConfig  `yaml:"cache_overrides"`
+	Clients        []ClientConfig `yaml:"clients"`
+	Auth           AuthConfig     `yaml:"auth"`
+	InjectHeaders  []HeaderConfig `yaml:"inject_headers"`
+	Egress         EgressConfig   `yaml:"egress"`
+	Routes         []RouteConfig  `yaml:"routes"`
+
+	// Sets the headers of InjectHeaders, read when the config file is parsed.
+	headers *proxy.HeaderInjector
+	// Policy of Egress, built when the config file is parsed.
+	egress *proxy.EgressPolicy
+}
+
+// Get the rate limits to set on the throttle: the rate limit rules and the budgets of the clients.
+func (c *ConfigFile) throttleRateLimits() []RateLimit {
+	rateLimits := slices.Clone(c.RateLimits)
+	for _, client := range c.Clients {
+		if client.hasBudget() {
+			rateLimits = append(rateLimits, client.budget())
+		}
+	}
+	return rateLimits
 }
 
 // Get the correct CacheConfig for the given url, if any exist.
@@ -52,6 +427,173 @@ func (c *ConfigFile) CacheOverrideForURL(url string) (CacheConfig, bool) {
 	return CacheConfig{}, false
 }
 
+// Check that the rules in the config file can be applied.
+func (c *ConfigFile) Validate() error {
+	for i, rateLimit := range c.RateLimits {
+		rateLimitURL, err := url.Parse(rateLimit.URL)
+		if err != nil {
+			return fmt.Errorf("rate_limits[%d]: %w", i, err)
+		}
+		if rateLimitURL.Scheme == "" || rateLimitURL.Host == "" {
+			return fmt.Errorf("rate_limits[%d]: url '%s' must be absolute", i, rateLimit.URL)
+		}
+		if rateLimit.Method == "" {
+			return fmt.Errorf("rate_limits[%d]: method is required", i)
+		}
+		if _, err := rateLimit.Limit(); err != nil {
+			return fmt.Errorf("rate_limits[%d]: %w", i, err)
+		}
+		if rateLimit.Retry != nil {
+			if err := rateLimit.Retry.Validate(); err != nil {
+				return fmt.Errorf("rate_limits[%d].retry: %w", i, err)
+			}
+		}
+		if rateLimit.CircuitBreaker != nil {
+			if err := rateLimit.CircuitBreaker.Validate(); err != nil {
+				return fmt.Errorf("rate_limits[%d].circuit_breaker: %w", i, err)
+			}
+		}
+	}
+
+	for i, override := range c.CacheOverrides {
+		if override.URL == "" {
+			return fmt.Errorf("cache_overrides[%d]: url is required", i)
+		}
+		if override.MinTTL < 0 || override.MaxTTL < 0 || override.DefaultTTL < 0 || override.StaleWhileRevalidate < 0 || override.StaleIfError < 0 {
+			return fmt.Errorf("cache_overrides[%d]: durations can't be negative", i)
+		}
+		if override.MaxTTL > 0 && override.MinTTL > override.MaxTTL {
+			return fmt.Errorf("cache_overrides[%d]: min_ttl exceeds max_ttl", i)
+		}
+	}
+
+	for i, client := range c.Clients {
+		if client.Name == "" {
+			return fmt.Errorf("clients[%d]: name is required", i)
+		}
+		for _, address := range client.Addresses {
+			if _, _, err := net.ParseCIDR(address); err != nil && net.ParseIP(address) == nil {
+				return fmt.Errorf("clients[%d]: invalid address '%s', expected an IP address or CIDR range", i, address)
+			}
+		}
+		if client.Priority != "" {
+			if _, err := proxy.ParsePriority(client.Priority); err != nil {
+				return fmt.Errorf("clients[%d]: %w", i, err)
+			}
+		}
+		if client.Weight < 0 {
+			return fmt.Errorf("clients[%d]: weight can't be negative", i)
+		}
+		if client.hasBudget() {
+			budget := client.budget()
+			if budgetURL, err := url.Parse(budget.URL); err != nil || budgetURL.Host != client.Name {
+				return fmt.Errorf("clients[%d]: name '%s' can't have a budget, use letters, digits, dots and dashes", i, client.Name)
+			}
+			if _, err := budget.Limit(); err != nil {
+				return fmt.Errorf("clients[%d]: %w", i, err)
+			}
+		}
+	}
+
+	for i, rule := range c.InjectHeaders {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("inject_headers[%d]: %w", i, err)
+		}
+	}
+
+	if err := c.Egress.Validate(); err != nil {
+		return err
+	}
+
+	routes := make(map[string]bool)
+	for i, route := range c.Routes {
+		if err := route.Validate(); err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+		if routes[route.Name] {
+			return fmt.Errorf("routes[%d]: route '%s' is defined twice", i, route.Name)
+		}
+		routes[route.Name] = true
+	}
+
+	return c.Auth.Validate()
+}
+
+// Get the RateLimit with the longest url that prefixes the given url, for the given method, if any exist.
+// The second return value indicates if a value was found.
+func (c *ConfigFile) RateLimitForRequest(method string, url string) (RateLimit, bool) {
+	var match RateLimit
+	found := false
+	for _, rateLimit := range c.RateLimits {
+		if rateLimit.Method == method && strings.HasPrefix(url, rateLimit.URL) && (!found || len(rateLimit.URL) > len(match.URL)) {
+			match = rateLimit
+			found = true
+		}
+	}
+
+	return match, found
+}
+
+// Identify the client of a request: the client its Proxy-Authorization credentials belong to, otherwise the client named
+// by its X-Chaperone-Client header if it can be trusted, otherwise the first client that connects from its address.
+// The header is ignored for clients with credentials, which have to authenticate, and for clients with addresses that
+// the request doesn't come from.
+// Clients that aren't in the config file are named after their credentials, header or IP address.
+// Returns an error if the credentials are invalid, or missing while authentication is required.
+func (c *ConfigFile) ClientForRequest(req *http.Request) (ClientConfig, error) {
+	authenticated, err := c.Auth.authenticate(req)
+	if err != nil {
+		return ClientConfig{}, err
+	}
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+	remoteIP := net.ParseIP(ip)
+
+	// Authenticated clients can't pass for another client.
+	name := authenticated
+	if name == "" {
+		name = c.trustedClientHeader(req.Header.Get(proxy.ClientHeader), remoteIP)
+	}
+	for _, client := range c.Clients {
+		if (name != "" && client.Name == name) || (name == "" && client.matchesIP(remoteIP)) {
+			return client, nil
+		}
+	}
+
+	if name == "" {
+		name = ip
+	}
+	return ClientConfig{Name: name}, nil
+}
+
+// Get the client named by an X-Chaperone-Client header, empty if the request can't pass for it.
+func (c *ConfigFile) trustedClientHeader(name string, ip net.IP) string {
+	if name == "" || c.Auth.hasCredentials(name) {
+		return ""
+	}
+	for _, client := range c.Clients {
+		if client.Name == name && len(client.Addresses) > 0 && !client.matchesIP(ip) {
+			return ""
+		}
+	}
+	return name
+}
+
+// Metrics label of clients that aren't in the config file, which would otherwise be labelled with any name or address.
+const anonymousClient = "anonymous"
+
+// Get the metrics label of a client: its name if it's in the config file or has credentials, otherwise anonymous.
+func (c *ConfigFile) clientLabel(client ClientConfig) string {
+	if c.Auth.hasCredentials(client.Name) {
+		return client.Name
+	}
+	for _, configured := range c.Clients {
+		if configured.Name == client.Name {
+			return client.Name
+		}
+	}
+	return anonymousClient
+}
+
 func ParseConfigFile(path string) (*ConfigFile, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -64,5 +606,21 @@ func ParseConfigFile(path string) (*ConfigFile, error) {
 		return nil, err
 	}
 
+	err = cf.Auth.loadSecretsFile()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cf.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	cf.headers, err = cf.headerInjector()
+	if err != nil {
+		return nil, err
+	}
+	cf.egress = cf.Egress.policy()
+
 	return cf, nil
 }
@@ -0,0 +1,96 @@
+package chaperone
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/KillianMeersman/chaperone/pkg/log"
+	"github.com/KillianMeersman/chaperone/pkg/proxy"
+)
+
+// Upstream servers requests may be forwarded to.
+type EgressConfig struct {
+	// Host patterns like `api.example.com`, or `*.example.com` for its subdomains. Denied hosts take precedence.
+	AllowHosts []string `yaml:"allow_hosts"`
+	DenyHosts  []string `yaml:"deny_hosts"`
+	// Deny hosts that match none of the patterns, otherwise they're allowed.
+	DefaultDeny bool `yaml:"default_deny"`
+	// IP addresses and CIDR ranges that are never connected to, whatever host resolves to them.
+	BlockRanges []string `yaml:"block_ranges"`
+}
+
+// Parse an IP address or CIDR range, an address is a range of one.
+func parseRange(address string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(address); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address '%s', expected an IP address or CIDR range", address)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Check that a host pattern is a host, or a wildcard for its subdomains.
+func validateHostPattern(pattern string) error {
+	if pattern == "" || strings.Contains(strings.TrimPrefix(pattern, "*."), "*") {
+		return fmt.Errorf("invalid host pattern '%s', expected a host like 'api.example.com' or '*.example.com'", pattern)
+	}
+	if strings.Contains(pattern, "/") || strings.Contains(pattern, ":") && net.ParseIP(pattern) == nil {
+		return fmt.Errorf("invalid host pattern '%s', expected a host without scheme, port or path", pattern)
+	}
+	return nil
+}
+
+// Check the host patterns and address ranges.
+func (e EgressConfig) Validate() error {
+	for i, pattern := range e.AllowHosts {
+		if err := validateHostPattern(pattern); err != nil {
+			return fmt.Errorf("egress.allow_hosts[%d]: %w", i, err)
+		}
+	}
+	for i, pattern := range e.DenyHosts {
+		if err := validateHostPattern(pattern); err != nil {
+			return fmt.Errorf("egress.deny_hosts[%d]: %w", i, err)
+		}
+	}
+	if e.DefaultDeny && len(e.AllowHosts) == 0 {
+		return fmt.Errorf("egress: allow_hosts is required when default_deny is set")
+	}
+	for i, address := range e.BlockRanges {
+		if _, err := parseRange(address); err != nil {
+			return fmt.Errorf("egress.block_ranges[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Get the policy upstream requests are checked against, the config was validated.
+func (e EgressConfig) policy() *proxy.EgressPolicy {
+	policy := &proxy.EgressPolicy{
+		AllowHosts:  e.AllowHosts,
+		DenyHosts:   e.DenyHosts,
+		DefaultDeny: e.DefaultDeny,
+	}
+	for _, address := range e.BlockRanges {
+		network, _ := parseRange(address)
+		policy.BlockedRanges = append(policy.BlockedRanges, network)
+	}
+	return policy
+}
+
+// Reject a request the egress policy doesn't allow, with a response clients can tell apart from the upstream server's own 403s.
+func egressDenied(w http.ResponseWriter, err *proxy.EgressError, logger *log.Logger) {
+	logger = logger.With("egress_host", err.Host)
+	if err.Address != "" {
+		logger = logger.With("egress_address", err.Address)
+	}
+	logger.Warning("egress denied")
+	w.Header().Set(proxy.EgressHeader, "denied")
+	http.Error(w, err.Error(), http.StatusForbidden)
+}
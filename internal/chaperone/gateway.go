@@ -0,0 +1,129 @@
+package chaperone
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/KillianMeersman/chaperone/pkg/log"
+)
+
+// Marks requests received in gateway mode, whose responses are rewritten to point back at the gateway.
+const gatewayKey = contextKey("gateway")
+
+// A named upstream server for clients that can't use a forward proxy.
+// Requests for `/<name>/<path>` are forwarded to `<upstream>/<path>`.
+type RouteConfig struct {
+	Name     string `yaml:"name"`
+	Upstream string `yaml:"upstream"`
+}
+
+// Check that the name is a single path segment and the upstream an absolute url without query.
+func (r RouteConfig) Validate() error {
+	if r.Name == "" || strings.Contains(r.Name, "/") || r.Name == "." || r.Name == ".." {
+		return fmt.Errorf("invalid name '%s', expected a single path segment", r.Name)
+	}
+	if r.Name != url.PathEscape(r.Name) {
+		return fmt.Errorf("invalid name '%s', it can't contain characters that need escaping", r.Name)
+	}
+	upstreamURL, err := url.Parse(r.Upstream)
+	if err != nil {
+		return err
+	}
+	if (upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https") || upstreamURL.Host == "" {
+		return fmt.Errorf("upstream '%s' must be an absolute http or https url", r.Upstream)
+	}
+	if upstreamURL.RawQuery != "" || upstreamURL.Fragment != "" {
+		return fmt.Errorf("upstream '%s' can't have a query or fragment", r.Upstream)
+	}
+	return nil
+}
+
+// Get the gateway path of the route.
+func (r RouteConfig) prefix() string {
+	return "/" + r.Name
+}
+
+// Get the upstream url without trailing slash.
+func (r RouteConfig) upstream() string {
+	return strings.TrimSuffix(r.Upstream, "/")
+}
+
+// Get the route whose name is the first segment of the path, and the rest of the path.
+// The second return value indicates if a route was found.
+func (c *ConfigFile) RouteForPath(path string) (RouteConfig, string, bool) {
+	for _, route := range c.Routes {
+		rest, ok := strings.CutPrefix(path, route.prefix())
+		if ok && (rest == "" || rest[0] == '/') {
+			return route, rest, true
+		}
+	}
+	return RouteConfig{}, "", false
+}
+
+// Return true if the path has `.` or `..` segments, which could take a request outside its route's upstream path.
+func hasDotSegments(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrite a Location header that points into a route's upstream to the route's gateway path, so that clients keep going
+// through the gateway. Relative locations are resolved against the upstream url, as the client can't resolve them.
+func (c *ConfigFile) rewriteGatewayLocation(header http.Header, requestURL *url.URL) {
+	location := header.Get("Location")
+	if location == "" {
+		return
+	}
+	locationURL, err := requestURL.Parse(location)
+	if err != nil {
+		return
+	}
+	location = locationURL.String()
+
+	// The most specific upstream wins when routes share a server.
+	routes := slices.Clone(c.Routes)
+	slices.SortStableFunc(routes, func(a, b RouteConfig) int {
+		return len(b.upstream()) - len(a.upstream())
+	})
+	for _, route := range routes {
+		rest, ok := strings.CutPrefix(location, route.upstream())
+		if ok && (rest == "" || strings.ContainsRune("/?#", rune(rest[0]))) {
+			location = route.prefix() + rest
+			break
+		}
+	}
+	header.Set("Location", location)
+}
+
+// Forward a request for a path instead of a url to the upstream server of its route.
+func (p *ChaperoneProxy) serveGateway(w http.ResponseWriter, req *http.Request, logger *log.Logger) {
+	route, rest, ok := p.config.Load().RouteForPath(req.URL.EscapedPath())
+	if !ok {
+		http.Error(w, "no route for path "+req.URL.Path, http.StatusNotFound)
+		logger.With("path", req.URL.Path).Warning("no gateway route for path")
+		return
+	}
+	if hasDotSegments(req.URL.Path) {
+		http.Error(w, "invalid path "+req.URL.Path, http.StatusBadRequest)
+		return
+	}
+
+	upstreamURL, err := url.Parse(route.upstream() + rest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upstreamURL.RawQuery = req.URL.RawQuery
+	req.URL = upstreamURL
+	req.Host = upstreamURL.Host
+
+	logger = logger.With("route", route.Name)
+	p.forward(w, req.WithContext(context.WithValue(req.Context(), gatewayKey, true)), logger)
+}
@@ -0,0 +1,146 @@
+package chaperone
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/KillianMeersman/chaperone/pkg/proxy"
+)
+
+func TestRouteForPath(t *testing.T) {
+	configFile := &ConfigFile{Routes: []RouteConfig{
+		{Name: "api", Upstream: "https://api.example.com/v1/"},
+		{Name: "apix", Upstream: "https://apix.example.com"},
+	}}
+
+	tests := []struct {
+		path  string
+		route string
+		rest  string
+	}{
+		{"/api/orders", "api", "/orders"},
+		{"/api/", "api", "/"},
+		{"/api", "api", ""},
+		{"/apix/orders", "apix", "/orders"},
+		{"/apiy/orders", "", ""},
+		{"/other/api", "", ""},
+		{"/", "", ""},
+	}
+	for _, test := range tests {
+		route, rest, ok := configFile.RouteForPath(test.path)
+		if ok != (test.route != "") || route.Name != test.route || rest != test.rest {
+			t.Fatalf("%s: expected route '%s' and rest '%s', got '%s' and '%s'", test.path, test.route, test.rest, route.Name, rest)
+		}
+	}
+}
+
+func TestHasDotSegments(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/api/orders":      false,
+		"/api/orders.json": false,
+		"/api/..orders":    false,
+		"/api/./orders":    true,
+		"/api/../admin":    true,
+		"/api/orders/..":   true,
+		"/api/orders/.":    true,
+		"/api/orders/...":  false,
+		"/api//orders":     false,
+	} {
+		if hasDotSegments(path) != expected {
+			t.Fatalf("%s: expected dot segments to be %v", path, expected)
+		}
+	}
+}
+
+func TestServeGateway(t *testing.T) {
+	roundTripper := &recordingRoundTripper{}
+	p := newTestProxy(t, &ConfigFile{Routes: []RouteConfig{
+		{Name: "api", Upstream: "https://api.example.com/v1/"},
+	}}, roundTripper)
+
+	tests := []struct {
+		target   string
+		status   int
+		upstream string
+	}{
+		{"/api/orders", http.StatusOK, "https://api.example.com/v1/orders"},
+		{"/api", http.StatusOK, "https://api.example.com/v1"},
+		// The query is passed through as is.
+		{"/api/orders?id=1&name=a%20b&empty", http.StatusOK, "https://api.example.com/v1/orders?id=1&name=a%20b&empty"},
+		{"/api/a%2Fb", http.StatusOK, "https://api.example.com/v1/a%2Fb"},
+		{"/api/../admin", http.StatusBadRequest, ""},
+		{"/api/%2e%2e/admin", http.StatusBadRequest, ""},
+		{"/api/./orders", http.StatusBadRequest, ""},
+		{"/other/orders", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		roundTripper.requests = nil
+		req := httptest.NewRequest("GET", test.target, nil)
+		req.Header.Set(proxy.RespectRobotsHeader, "false")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Fatalf("%s: expected status %d, got %d", test.target, test.status, w.Code)
+		}
+		if test.upstream == "" {
+			if len(roundTripper.requests) != 0 {
+				t.Fatalf("%s: expected no upstream request, got %s", test.target, roundTripper.requests[0].URL)
+			}
+			continue
+		}
+		if len(roundTripper.requests) != 1 || roundTripper.requests[0].URL.String() != test.upstream {
+			t.Fatalf("%s: expected an upstream request for %s, got %v", test.target, test.upstream, roundTripper.requests)
+		}
+	}
+}
+
+func TestRewriteGatewayLocation(t *testing.T) {
+	configFile := &ConfigFile{Routes: []RouteConfig{
+		{Name: "site", Upstream: "https://example.com"},
+		{Name: "v2", Upstream: "https://example.com/v2/"},
+		{Name: "shop", Upstream: "https://shop.example.com/store"},
+	}}
+
+	tests := []struct {
+		name       string
+		requestURL string
+		location   string
+		expected   string
+	}{
+		{"absolute", "https://example.com/a", "https://example.com/b", "/site/b"},
+		{"with query", "https://example.com/a", "https://example.com/b?page=2#top", "/site/b?page=2#top"},
+		{"upstream root", "https://example.com/a", "https://example.com", "/site"},
+		{"most specific upstream", "https://example.com/a", "https://example.com/v2/orders", "/v2/orders"},
+		{"most specific upstream root", "https://example.com/a", "https://example.com/v2", "/v2"},
+		{"upstream prefix of a segment", "https://example.com/a", "https://example.com/v2x/orders", "/site/v2x/orders"},
+		{"upstream query", "https://example.com/a", "https://example.com/v2?page=2", "/v2?page=2"},
+		{"relative", "https://example.com/v2/orders", "details", "/v2/details"},
+		{"relative to the root", "https://example.com/v2/orders", "/login", "/site/login"},
+		{"relative to the parent", "https://example.com/v2/orders/1", "../orders", "/v2/orders"},
+		{"query only", "https://example.com/v2/orders", "?page=2", "/v2/orders?page=2"},
+		{"scheme relative", "https://example.com/a", "//shop.example.com/store/cart", "/shop/cart"},
+		{"other host", "https://example.com/a", "https://other.example.com/b", "https://other.example.com/b"},
+		{"other scheme", "https://example.com/a", "http://example.com/b", "http://example.com/b"},
+		{"outside any route", "https://shop.example.com/store/cart", "https://shop.example.com/login", "https://shop.example.com/login"},
+		{"relative outside any route", "https://shop.example.com/store/cart", "/login", "https://shop.example.com/login"},
+		{"upstream prefix outside the route", "https://shop.example.com/store/cart", "/storefront", "https://shop.example.com/storefront"},
+		{"no location", "https://example.com/a", "", ""},
+	}
+	for _, test := range tests {
+		requestURL, err := url.Parse(test.requestURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := http.Header{}
+		if test.location != "" {
+			header.Set("Location", test.location)
+		}
+		configFile.rewriteGatewayLocation(header, requestURL)
+		if location := header.Get("Location"); location != test.expected {
+			t.Fatalf("%s: expected location '%s', got '%s'", test.name, test.expected, location)
+		}
+	}
+}
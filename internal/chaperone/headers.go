@@ -0,0 +1,115 @@
+package chaperone
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/KillianMeersman/chaperone/pkg/config"
+	"github.com/KillianMeersman/chaperone/pkg/proxy"
+)
+
+// A secret read from an environment variable or a file, like a secret mounted into the container.
+type SecretConfig struct {
+	Env  string `yaml:"env"`
+	File string `yaml:"file"`
+}
+
+// Read the secret. Errors name the environment variable or file, never the secret.
+func (s SecretConfig) Value() (string, error) {
+	switch {
+	case s.Env != "" && s.File != "":
+		return "", fmt.Errorf("env and file can't both be set")
+	case s.Env != "":
+		value := config.GetString(s.Env, "", true)
+		if value == "" {
+			return "", fmt.Errorf("environment variable '%s' is not set", s.Env)
+		}
+		return value, nil
+	case s.File != "":
+		value, err := config.ReadFile(s.File, true)
+		if err != nil {
+			return "", err
+		}
+		if value == "" {
+			return "", fmt.Errorf("file '%s' is empty", s.File)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("either env or file is required")
+}
+
+// Credentials for Basic authentication with the upstream server.
+type BasicAuthConfig struct {
+	Username string       `yaml:"username"`
+	Password SecretConfig `yaml:"password"`
+}
+
+// Headers set on upstream requests whose url starts with the prefix, replacing any the client sent.
+type HeaderConfig struct {
+	URL     string                  `yaml:"url"`
+	Headers map[string]SecretConfig `yaml:"headers"`
+	// Sets the Authorization header for Basic authentication.
+	BasicAuth *BasicAuthConfig `yaml:"basic_auth"`
+}
+
+// Check that the rule has an absolute url and sets at least one header.
+func (h HeaderConfig) Validate() error {
+	headerURL, err := url.Parse(h.URL)
+	if err != nil {
+		return err
+	}
+	if headerURL.Scheme == "" || headerURL.Host == "" {
+		return fmt.Errorf("url '%s' must be absolute", h.URL)
+	}
+	if len(h.Headers) == 0 && h.BasicAuth == nil {
+		return fmt.Errorf("headers or basic_auth is required")
+	}
+	if h.BasicAuth != nil {
+		if h.BasicAuth.Username == "" {
+			return fmt.Errorf("basic_auth: username is required")
+		}
+		for name := range h.Headers {
+			if http.CanonicalHeaderKey(name) == "Authorization" {
+				return fmt.Errorf("basic_auth and an Authorization header can't both be set")
+			}
+		}
+	}
+	return nil
+}
+
+// Read the headers the rule sets.
+func (h HeaderConfig) header() (http.Header, error) {
+	header := make(http.Header)
+	for name, secret := range h.Headers {
+		value, err := secret.Value()
+		if err != nil {
+			return nil, fmt.Errorf("headers.%s: %w", name, err)
+		}
+		header.Set(name, value)
+	}
+
+	if h.BasicAuth != nil {
+		password, err := h.BasicAuth.Password.Value()
+		if err != nil {
+			return nil, fmt.Errorf("basic_auth.password: %w", err)
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(h.BasicAuth.Username + ":" + password))
+		header.Set("Authorization", "Basic "+credentials)
+	}
+	return header, nil
+}
+
+// Read the headers of every rule into an injector for upstream requests.
+func (c *ConfigFile) headerInjector() (*proxy.HeaderInjector, error) {
+	rules := make([]proxy.HeaderRule, 0, len(c.InjectHeaders))
+	for i, rule := range c.InjectHeaders {
+		header, err := rule.header()
+		if err != nil {
+			return nil, fmt.Errorf("inject_headers[%d]: %w", i, err)
+		}
+		rules = append(rules, proxy.HeaderRule{URL: rule.URL, Header: header})
+	}
+	return proxy.NewHeaderInjector(rules), nil
+}
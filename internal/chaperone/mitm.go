@@ -0,0 +1,219 @@
+package chaperone
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/KillianMeersman/chaperone/pkg/log"
+	"github.com/KillianMeersman/chaperone/pkg/proxy"
+)
+
+type contextKey string
+
+const (
+	tunnelTargetKey        = contextKey("tunnel target")
+	tunnelAuthorizationKey = contextKey("tunnel authorization")
+)
+
+// A decrypted connection that was tunneled through a CONNECT request.
+type tunnelConn struct {
+	net.Conn
+	// The host:port the client asked to CONNECT to.
+	target string
+	// Proxy-Authorization header of the CONNECT request, which authenticates the requests sent through the tunnel.
+	authorization string
+}
+
+// A connection whose first reads are served from a buffered reader.
+// Used so that bytes buffered by the http server before hijacking aren't lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// A net.Listener that accepts connections handed to it through Serve.
+// This allows intercepted tunnels to be served by a regular http.Server.
+type tunnelListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  *sync.Once
+	addr  net.Addr
+}
+
+func newTunnelListener(addr net.Addr) *tunnelListener {
+	return &tunnelListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+		once:  &sync.Once{},
+		addr:  addr,
+	}
+}
+
+// Hand a connection to the listener. Returns an error if the listener is closed.
+func (l *tunnelListener) Serve(conn net.Conn) error {
+	select {
+	case l.conns <- conn:
+		return nil
+	case <-l.done:
+		return net.ErrClosed
+	}
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tunnelListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *tunnelListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Start the server that handles requests decrypted from CONNECT tunnels.
+func (p *ChaperoneProxy) startTunnelServer(ctx context.Context) {
+	p.tunnels = newTunnelListener(&net.TCPAddr{})
+	server := &http.Server{
+		Handler: http.HandlerFunc(p.serveTunneled),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if conn, ok := c.(*tunnelConn); ok {
+				ctx = context.WithValue(ctx, tunnelTargetKey, conn.target)
+				return context.WithValue(ctx, tunnelAuthorizationKey, conn.authorization)
+			}
+			return ctx
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	go func() {
+		err := server.Serve(p.tunnels)
+		if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+			log.DefaultLogger.Error(err.Error())
+		}
+	}()
+}
+
+// Terminate a CONNECT tunnel with a certificate minted for the target host,
+// then pass the decrypted connection on to the tunnel server.
+func (p *ChaperoneProxy) handleConnect(w http.ResponseWriter, req *http.Request, logger *log.Logger) {
+	if p.ca == nil {
+		msg := "CONNECT is not supported, enable MITM mode to intercept https requests"
+		http.Error(w, msg, http.StatusMethodNotAllowed)
+		logger.Error(msg)
+		return
+	}
+
+	// Authenticate the tunnel up front, its requests are authenticated again when they're forwarded.
+	if _, err := p.config.Load().ClientForRequest(req); err != nil {
+		logger.With("remote_addr", req.RemoteAddr).Warning(err.Error())
+		proxyAuthRequired(w, err)
+		return
+	}
+
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+
+	// Refuse tunnels to denied hosts up front, the requests sent through the tunnel are checked again when they're forwarded.
+	var egressErr *proxy.EgressError
+	if err := p.config.Load().egress.CheckHost(host); errors.As(err, &egressErr) {
+		egressDenied(w, egressErr, logger)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		msg := "connection does not support hijacking"
+		http.Error(w, msg, http.StatusInternalServerError)
+		logger.Error(msg)
+		return
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		logger.Error(err.Error())
+		conn.Close()
+		return
+	}
+
+	var clientConn net.Conn = conn
+	if buffered.Reader.Buffered() > 0 {
+		clientConn = &bufferedConn{conn, buffered.Reader}
+	}
+
+	logger.With("host", req.Host).Debug("intercepting CONNECT tunnel")
+	tlsConn := tls.Server(clientConn, p.ca.TLSConfig(host))
+	err = p.tunnels.Serve(&tunnelConn{tlsConn, req.Host, req.Header.Get("Proxy-Authorization")})
+	if err != nil {
+		logger.Error(err.Error())
+		conn.Close()
+	}
+}
+
+// Return true if the host of a request sent through a tunnel is the tunnel's target, ports default to 443.
+func isTunnelTarget(host string, target string) bool {
+	splitHostPort := func(hostport string) (string, string) {
+		host, port, err := net.SplitHostPort(hostport)
+		if err != nil {
+			return strings.Trim(hostport, "[]"), "443"
+		}
+		return host, port
+	}
+	host, port := splitHostPort(host)
+	targetHost, targetPort := splitHostPort(target)
+	return strings.EqualFold(host, targetHost) && port == targetPort
+}
+
+// Handle a request decrypted from a CONNECT tunnel.
+func (p *ChaperoneProxy) serveTunneled(w http.ResponseWriter, req *http.Request) {
+	logger := newRequestLogger()
+
+	target, _ := req.Context().Value(tunnelTargetKey).(string)
+	req.URL.Scheme = "https"
+	req.URL.Host = req.Host
+	if req.URL.Host == "" {
+		req.URL.Host = target
+	}
+	// The tunnel's certificate and egress check only cover its target.
+	if !isTunnelTarget(req.URL.Host, target) {
+		msg := "host " + req.URL.Host + " is not the target of the CONNECT tunnel " + target
+		http.Error(w, msg, http.StatusMisdirectedRequest)
+		logger.Warning(msg)
+		return
+	}
+	if authorization, _ := req.Context().Value(tunnelAuthorizationKey).(string); authorization != "" && req.Header.Get("Proxy-Authorization") == "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+
+	p.forward(w, req, logger)
+}
@@ -0,0 +1,72 @@
+package chaperone
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/KillianMeersman/chaperone/pkg/proxy"
+)
+
+func TestIsTunnelTarget(t *testing.T) {
+	tests := []struct {
+		host     string
+		target   string
+		expected bool
+	}{
+		{"example.com", "example.com:443", true},
+		{"example.com:443", "example.com:443", true},
+		{"EXAMPLE.com", "example.com:443", true},
+		{"example.com:8443", "example.com:8443", true},
+		{"[::1]", "[::1]:443", true},
+		{"example.com", "example.com:8443", false},
+		{"example.com:8443", "example.com:443", false},
+		{"other.example.com", "example.com:443", false},
+		{"example.com.evil.com", "example.com:443", false},
+		{"example.com", "", false},
+	}
+	for _, test := range tests {
+		if isTunnelTarget(test.host, test.target) != test.expected {
+			t.Fatalf("%s for tunnel to %s: expected %v", test.host, test.target, test.expected)
+		}
+	}
+}
+
+func TestServeTunneledChecksHost(t *testing.T) {
+	roundTripper := &recordingRoundTripper{}
+	p := newTestProxy(t, &ConfigFile{}, roundTripper)
+
+	tests := []struct {
+		host     string
+		status   int
+		upstream string
+	}{
+		{"example.com", http.StatusOK, "https://example.com/orders"},
+		{"", http.StatusOK, "https://example.com:443/orders"},
+		{"other.example.com", http.StatusMisdirectedRequest, ""},
+		{"example.com:8443", http.StatusMisdirectedRequest, ""},
+	}
+	for _, test := range tests {
+		roundTripper.requests = nil
+		ctx := context.WithValue(context.Background(), tunnelTargetKey, "example.com:443")
+		req := httptest.NewRequest("GET", "/orders", nil).WithContext(ctx)
+		req.Host = test.host
+		req.Header.Set(proxy.RespectRobotsHeader, "false")
+		w := httptest.NewRecorder()
+		p.serveTunneled(w, req)
+
+		if w.Code != test.status {
+			t.Fatalf("%s: expected status %d, got %d", test.host, test.status, w.Code)
+		}
+		if test.upstream == "" {
+			if len(roundTripper.requests) != 0 {
+				t.Fatalf("%s: expected no upstream request, got %s", test.host, roundTripper.requests[0].URL)
+			}
+			continue
+		}
+		if len(roundTripper.requests) != 1 || roundTripper.requests[0].URL.String() != test.upstream {
+			t.Fatalf("%s: expected an upstream request for %s, got %v", test.host, test.upstream, roundTripper.requests)
+		}
+	}
+}
@@ -2,58 +2,168 @@ package chaperone
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
-	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/KillianMeersman/chaperone/pkg/datastructures/eviction"
+	"github.com/KillianMeersman/chaperone/pkg/datastructures/kvstore"
 	"github.com/KillianMeersman/chaperone/pkg/log"
+	"github.com/KillianMeersman/chaperone/pkg/metrics"
+	"github.com/KillianMeersman/chaperone/pkg/mitm"
 	"github.com/KillianMeersman/chaperone/pkg/proxy"
+	"github.com/redis/go-redis/v9"
 )
 
 // The Chaperone proxy.
-// Note that this is an http-only proxy, as such, it does not support https CONNECT requests.
+// By default this is an http-only proxy, as such, it does not support https CONNECT requests.
 // CONNECT requests would turn the proxy into a tcp relay, unaware of the http stream. This would prevent it from caching or rate-limiting based on url.
 // ----
 // To proxy https requests, change your request scheme to http and add the X-Upgrade-HTTPS=true header.
+// Alternatively, enable MITM mode: CONNECT tunnels are then terminated with a certificate signed by the configured CA,
+// so that the decrypted requests can be cached and rate-limited like any other.
 // Will fetch and respect the robots.txt file by default, use the X-Respect-Robots=false header to turn this off.
 type ChaperoneProxy struct {
-	client *proxy.NiceClient
-	config *ConfigFile
+	client   *proxy.NiceClient
+	throttle proxy.HTTPThrottle
+	cache    *proxy.HTTPCache
+	metrics  *metrics.Registry
+	// Requests by client, labelled by the client's name.
+	clientRequests *metrics.Counter
+	// The active config file, replaced as a whole when it's reloaded.
+	config atomic.Pointer[ConfigFile]
+	// Serializes config reloads.
+	reloadLock sync.Mutex
+	ca         *mitm.CertificateAuthority
+	tunnels    *tunnelListener
 }
 
 func (p *ChaperoneProxy) Start(ctx context.Context) error {
-	throttle := proxy.NewMemoryHTTPThrottle(time.Second)
-	cache := proxy.NewMemoryHTTPCache(ctx, 512e6)
-	p.client = proxy.NewNiceClient(ctx, http.DefaultTransport, throttle, cache)
+	// A single Redis client is shared by the cache and throttle, if either uses Redis.
+	var redisClient *redis.Client
+	if CacheStore == "redis" || ThrottleStore == "redis" {
+		options, err := redis.ParseURL(RedisURL)
+		if err != nil {
+			return err
+		}
+		log.DefaultLogger.Info("Connecting to redis", "addr", options.Addr)
+		redisClient = redis.NewClient(options)
+	}
+
+	throttle, err := newHTTPThrottle(ctx, redisClient)
+	if err != nil {
+		return err
+	}
+
+	cache, err := newHTTPCache(ctx, redisClient)
+	if err != nil {
+		return err
+	}
+	p.throttle = throttle
+	p.cache = cache
+	p.metrics = metrics.NewRegistry()
+	// The transport checks the addresses it connects to against the egress policy of the current config file.
+	transport := proxy.NewEgressTransport(func() *proxy.EgressPolicy {
+		if configFile := p.config.Load(); configFile != nil {
+			return configFile.egress
+		}
+		return nil
+	})
+	p.client = proxy.NewNiceClient(ctx, transport, throttle, cache)
+	p.client.Metrics = proxy.NewClientMetrics(p.metrics)
+	p.clientRequests = p.metrics.NewCounter("chaperone_client_requests_total", "Requests handled for every client.", "client")
+	p.client.RetryPolicy, err = globalRetryPolicy()
+	if err != nil {
+		return err
+	}
+	breakerSettings, err := globalBreakerSettings()
+	if err != nil {
+		return err
+	}
+	p.client.Breakers = proxy.NewCircuitBreakers(breakerSettings)
+	if PriorityMinShare < 0 || PriorityMinShare > 1 {
+		return fmt.Errorf("PRIORITY_MIN_SHARE must be between 0 and 1")
+	}
+	proxy.PriorityMinShare = PriorityMinShare
 
 	configFile, err := ParseConfigFile(ConfigFileLocation)
 	if err != nil {
 		log.DefaultLogger.Fatal(err.Error())
 	}
 
-	p.config = configFile
-
-	for _, rateLimit := range configFile.RateLimits {
-		url, err := url.Parse(rateLimit.URL)
+	if MITMEnabled {
+		p.ca, err = mitm.LoadCA(CACertFile, CAKeyFile)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		log.DefaultLogger.Info("Setting throttle for url", "url", rateLimit.URL, "method", rateLimit.Method, "wait_time", rateLimit.WaitDuration.String())
-		throttle.SetThrottle(&http.Request{
-			Method: rateLimit.Method,
-			URL:    url,
-		}, rateLimit.WaitDuration)
+		log.DefaultLogger.Info("MITM mode enabled, intercepting CONNECT tunnels", "ca_cert", CACertFile)
+		p.startTunnelServer(ctx)
+	}
+
+	p.applyRateLimits(nil, configFile.throttleRateLimits())
+	p.config.Store(configFile)
+	go p.watchConfigFile(ctx)
+
+	if AdminAddr != "" {
+		p.startAdminServer()
 	}
 
 	listenAddr := fmt.Sprintf("0.0.0.0:%d", Port)
 	return http.ListenAndServe(listenAddr, p)
 }
 
+// Create the HTTPThrottle selected by $THROTTLE_STORE.
+func newHTTPThrottle(ctx context.Context, redisClient *redis.Client) (proxy.HTTPThrottle, error) {
+	switch ThrottleStore {
+	case "memory":
+		return proxy.NewMemoryHTTPThrottle(time.Second), nil
+	case "redis":
+		log.DefaultLogger.Info("Using redis throttle store")
+		return proxy.NewRedisHTTPThrottle(ctx, redisClient, RedisPrefix, time.Second), nil
+	default:
+		return nil, fmt.Errorf("unknown throttle store '%s'", ThrottleStore)
+	}
+}
+
+// Create the HTTPCache selected by $CACHE_STORE.
+func newHTTPCache(ctx context.Context, redisClient *redis.Client) (*proxy.HTTPCache, error) {
+	evictionPolicy, err := eviction.New[string](CacheEviction, CacheMaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	switch CacheStore {
+	case "memory":
+		return proxy.NewHTTPCache(ctx, int(CacheMaxSize), evictionPolicy, kvstore.NewMemoryKVStore[string, *proxy.CachedResponse](ctx), kvstore.NewMemoryKVStore[string, []string](ctx)), nil
+	case "redis":
+		log.DefaultLogger.Info("Using redis cache store")
+		// Redis bounds the size of the shared cache, $CACHE_MAX_SIZE only bounds the size of a single response.
+		return proxy.NewRedisHTTPCache(ctx, redisClient, RedisPrefix, int(CacheMaxSize)), nil
+	case "disk":
+		log.DefaultLogger.Info("Using disk cache store", "dir", CacheDir)
+		// The disk budget replaces the in-memory maximum size.
+		evictionPolicy, err = eviction.New[string](CacheEviction, CacheDiskBudget)
+		if err != nil {
+			return nil, err
+		}
+		return proxy.NewDiskHTTPCache(ctx, CacheDir, CacheDiskBudget, evictionPolicy)
+	default:
+		return nil, fmt.Errorf("unknown cache store '%s'", CacheStore)
+	}
+}
+
+// Metrics label of requests that matched no config rule.
+const defaultRule = "default"
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -93,8 +203,23 @@ func appendHostToXForwardHeader(header http.Header, host string) {
 	header.Set("X-Forwarded-For", host)
 }
 
+func newRequestLogger() *log.Logger {
+	return log.DefaultLogger.With("request_id", fmt.Sprint(rand.Int()))
+}
+
 func (p *ChaperoneProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	logger := log.DefaultLogger.With("request_id", fmt.Sprint(rand.Int()))
+	logger := newRequestLogger()
+
+	if req.Method == http.MethodConnect {
+		p.handleConnect(w, req, logger)
+		return
+	}
+
+	// Requests for a path instead of a url come from clients using the proxy as a gateway.
+	if req.URL.Host == "" {
+		p.serveGateway(w, req, logger)
+		return
+	}
 
 	// Code from https://gist.github.com/yowu/f7dc34bd4736a65ff28d
 	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
@@ -104,6 +229,32 @@ func (p *ChaperoneProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// HTTPS upgrade directives
+	if !isFalse(req.Header.Get("X-Upgrade-HTTPS")) {
+		req.URL.Scheme = "https"
+	}
+
+	p.forward(w, req, logger)
+}
+
+// Return true if the value of a directive header turns it off, with `false` or `0`.
+func isFalse(value string) bool {
+	return strings.ToLower(value) == "false" || value == "0"
+}
+
+// Forward the request to the upstream server through the NiceClient and copy back the response.
+func (p *ChaperoneProxy) forward(w http.ResponseWriter, req *http.Request, logger *log.Logger) {
+	configFile := p.config.Load()
+	client, err := configFile.ClientForRequest(req)
+	if err != nil {
+		logger.With("remote_addr", req.RemoteAddr).Warning(err.Error())
+		proxyAuthRequired(w, err)
+		return
+	}
+	req.Header.Del(proxy.ClientHeader)
+	logger = logger.With("client", client.Name)
+	p.clientRequests.Inc(configFile.clientLabel(client))
+
 	// Save logger to request context.
 	ctx := log.NewContext(req.Context(), logger)
 	req = req.WithContext(ctx)
@@ -118,35 +269,109 @@ func (p *ChaperoneProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		appendHostToXForwardHeader(req.Header, clientIP)
 	}
 
-	// HTTPS upgrade directives
-	upgradeConnection := true
-	upgradeConnectionHeader := req.Header.Get("X-Upgrade-HTTPS")
-	if strings.ToLower(upgradeConnectionHeader) == "false" || upgradeConnectionHeader == "0" {
-		upgradeConnection = false
+	options := &proxy.RequestOptions{
+		UserAgent:       RobotsUserAgent,
+		RespectRobots:   RespectRobots && !isFalse(req.Header.Get(proxy.RespectRobotsHeader)),
+		MinCacheTTL:     0,
+		MaxCacheTTL:     24 * time.Hour,
+		DefaultCacheTTL: 0,
+		CacheRule:       defaultRule,
+		RateLimitRule:   defaultRule,
+		Client:          client.Name,
+		ClientWeight:    client.Weight,
+		ClientThrottle:  client.hasBudget(),
+		Headers:         configFile.headers,
+		Egress:          configFile.egress,
 	}
-	if upgradeConnection {
-		req.URL.Scheme = "https"
+	req.Header.Del(proxy.RespectRobotsHeader)
+
+	if maxWait := req.Header.Get(proxy.MaxWaitHeader); maxWait != "" {
+		req.Header.Del(proxy.MaxWaitHeader)
+		options.MaxWait = parseMaxWait(maxWait)
+		if options.MaxWait <= 0 {
+			http.Error(w, "invalid "+proxy.MaxWaitHeader+" header "+maxWait, http.StatusBadRequest)
+			return
+		}
 	}
 
-	minTTL := time.Duration(0)
-	maxTTL := 24 * time.Hour
-	defaultTTL := time.Duration(0)
+	// The priority header overrides the client's default priority, which was validated with the config file.
+	if client.Priority != "" {
+		options.Priority, _ = proxy.ParsePriority(client.Priority)
+	}
+	if priority := req.Header.Get(proxy.PriorityHeader); priority != "" {
+		req.Header.Del(proxy.PriorityHeader)
+		options.Priority, err = proxy.ParsePriority(priority)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if rateLimit, ok := configFile.RateLimitForRequest(req.Method, req.URL.String()); ok {
+		options.RateLimitRule = rateLimitKey(rateLimit)
+		if rateLimit.Retry != nil {
+			retryPolicy := rateLimit.Retry.Policy(p.client.RetryPolicy)
+			options.RetryPolicy = &retryPolicy
+		}
+		if rateLimit.CircuitBreaker != nil {
+			breakerSettings := rateLimit.CircuitBreaker.Settings(p.client.Breakers.Settings(nil))
+			options.CircuitBreakerKey = rateLimitKey(rateLimit)
+			options.CircuitBreaker = &breakerSettings
+		}
+	}
 
 	// Check if there is a cache override for the provided url.
-	cacheOverride, ok := p.config.CacheOverrideForURL(req.URL.String())
+	cacheOverride, ok := configFile.CacheOverrideForURL(req.URL.String())
 	if ok {
-		minTTL = cacheOverride.MinTTL
-		maxTTL = cacheOverride.MaxTTL
-		defaultTTL = cacheOverride.DefaultTTL
+		options.CacheRule = cacheOverride.URL
+		options.MinCacheTTL = cacheOverride.MinTTL
+		options.MaxCacheTTL = cacheOverride.MaxTTL
+		options.DefaultCacheTTL = cacheOverride.DefaultTTL
+		options.StaleWhileRevalidate = cacheOverride.StaleWhileRevalidate
+		options.StaleIfError = cacheOverride.StaleIfError
 	}
 
 	// Make proxied request.
-	res, err := p.client.RoundTripWithOptions(req, &proxy.RequestOptions{
-		UserAgent:       "Chaperone",
-		MinCacheTTL:     minTTL,
-		MaxCacheTTL:     maxTTL,
-		DefaultCacheTTL: defaultTTL,
-	})
+	res, err := p.client.RoundTripWithOptions(req, options)
+	var circuitOpenErr *proxy.CircuitOpenError
+	if errors.As(err, &circuitOpenErr) {
+		// Fail fast with a distinctive response, so that clients can tell it apart from the upstream server's own 503s.
+		logger.Warning(err.Error())
+		w.Header().Set(proxy.CircuitBreakerHeader, proxy.CircuitOpen)
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(circuitOpenErr.RetryAfter.Seconds()))))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	var robotsErr *proxy.RobotsError
+	if errors.As(err, &robotsErr) {
+		logger.Warning(err.Error())
+		w.Header().Set(proxy.RobotsHeader, "disallowed")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	var egressErr *proxy.EgressError
+	if errors.As(err, &egressErr) {
+		egressDenied(w, egressErr, logger)
+		return
+	}
+	var throttleErr *proxy.ThrottleError
+	if errors.As(err, &throttleErr) {
+		// Shed the request instead of letting it queue past the client's deadline or the rule's limits.
+		logger.Warning(err.Error())
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, proxy.ErrWaitTooLong) {
+			status = http.StatusTooManyRequests
+		}
+		if throttleErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(throttleErr.RetryAfter.Seconds()))))
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if err != nil && req.Context().Err() != nil {
+		// The client went away, there's no one to respond to.
+		logger.Debug(err.Error())
+		return
+	}
 	if err != nil {
 		logger.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -155,6 +380,9 @@ func (p *ChaperoneProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer res.Body.Close()
 
 	delHopHeaders(res.Header)
+	if gateway, _ := req.Context().Value(gatewayKey).(bool); gateway {
+		configFile.rewriteGatewayLocation(res.Header, req.URL)
+	}
 
 	// Copy headers and body.
 	copyHeader(w.Header(), res.Header)
@@ -166,3 +394,15 @@ func (p *ChaperoneProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 }
+
+// Parse the value of the max wait header, a duration like "5s" or a number of seconds. Returns zero if it's invalid.
+func parseMaxWait(value string) time.Duration {
+	if maxWait, err := time.ParseDuration(value); err == nil {
+		return maxWait
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
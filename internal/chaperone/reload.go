@@ -0,0 +1,117 @@
+package chaperone
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/log"
+)
+
+// Identifies the throttle a rate limit applies to.
+func rateLimitKey(rateLimit RateLimit) string {
+	return rateLimit.Method + " " + rateLimit.URL
+}
+
+// Apply the difference between the old and new rate limits to the throttle.
+// Throttles for rate limits that were removed are removed, new and changed ones are set.
+// Rate limits must be validated beforehand.
+func (p *ChaperoneProxy) applyRateLimits(oldRateLimits, newRateLimits []RateLimit) {
+	current := make(map[string]RateLimit)
+	for _, rateLimit := range oldRateLimits {
+		current[rateLimitKey(rateLimit)] = rateLimit
+	}
+	next := make(map[string]RateLimit)
+	for _, rateLimit := range newRateLimits {
+		next[rateLimitKey(rateLimit)] = rateLimit
+	}
+
+	for key, rateLimit := range current {
+		if _, ok := next[key]; ok {
+			continue
+		}
+		rateLimitURL, _ := url.Parse(rateLimit.URL)
+		log.DefaultLogger.Info("Removing throttle for url", "url", rateLimit.URL, "method", rateLimit.Method)
+		p.throttle.RemoveThrottle(&http.Request{
+			Method: rateLimit.Method,
+			URL:    rateLimitURL,
+		})
+	}
+
+	for key, rateLimit := range next {
+		if previous, ok := current[key]; ok && reflect.DeepEqual(previous, rateLimit) {
+			continue
+		}
+		rateLimitURL, _ := url.Parse(rateLimit.URL)
+		limit, _ := rateLimit.Limit()
+		log.DefaultLogger.Info("Setting throttle for url", "url", rateLimit.URL, "method", rateLimit.Method, "limit", limit.String())
+		p.throttle.SetThrottle(&http.Request{
+			Method: rateLimit.Method,
+			URL:    rateLimitURL,
+		}, limit)
+	}
+}
+
+// Parse the config file again and apply it.
+// If the new config file is invalid, it is rejected and the current config stays active.
+func (p *ChaperoneProxy) reloadConfig() error {
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+
+	configFile, err := ParseConfigFile(ConfigFileLocation)
+	if err != nil {
+		log.DefaultLogger.Error("invalid config file, keeping the current config", "path", ConfigFileLocation, "error", err.Error())
+		return err
+	}
+
+	p.applyRateLimits(p.config.Load().throttleRateLimits(), configFile.throttleRateLimits())
+	p.config.Store(configFile)
+
+	log.DefaultLogger.Info("Reloaded config file", "path", ConfigFileLocation)
+	return nil
+}
+
+// Get the modification time of the config file, zero if it can't be read.
+func configFileModTime() time.Time {
+	info, err := os.Stat(ConfigFileLocation)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Reload the config file when the process receives SIGHUP or when the file changes, until the context is cancelled.
+func (p *ChaperoneProxy) watchConfigFile(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	var changes <-chan time.Time
+	if ConfigReloadInterval > 0 {
+		ticker := time.NewTicker(ConfigReloadInterval)
+		defer ticker.Stop()
+		changes = ticker.C
+	}
+
+	modTime := configFileModTime()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.DefaultLogger.Info("Received SIGHUP, reloading config file", "path", ConfigFileLocation)
+			modTime = configFileModTime()
+			p.reloadConfig()
+		case <-changes:
+			if current := configFileModTime(); !current.Equal(modTime) {
+				modTime = current
+				p.reloadConfig()
+			}
+		}
+	}
+}
@@ -5,16 +5,39 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/KillianMeersman/chaperone/pkg/log"
 )
 
+// Logged instead of the values of secrets.
+const Redacted = "[redacted]"
+
+// Get a value to log, redacted if it's a secret.
+func loggedValue(value string, isSecret bool) string {
+	if isSecret {
+		return Redacted
+	}
+	return value
+}
+
+// Log a configuration value that was loaded at debug level, redacted if it's a secret.
+func logValue(name, value string, isSecret bool) {
+	log.Debug("loaded configuration value", "name", name, "value", loggedValue(value, isSecret))
+}
+
+// Exit because a configuration value is invalid, the value is only logged if it isn't a secret.
+func invalidValue(name, value string, isSecret bool) {
+	log.Fatal("invalid configuration value", "name", name, "value", loggedValue(value, isSecret))
+}
+
 // Get an environment variable as a string.
 func GetString(name, defaultValue string, isSecret bool) string {
 	value := os.Getenv(name)
 	if value == "" {
 		return defaultValue
 	}
+	logValue(name, value, isSecret)
 	return value
 }
 
@@ -24,9 +47,21 @@ func MustGetString(name string, isSecret bool) string {
 	if value == "" {
 		panic(fmt.Sprintf("environment variable '%s' is required but not present", name))
 	}
+	logValue(name, value, isSecret)
 	return value
 }
 
+// Read a file as a string, like a secret mounted into a container. A trailing newline is removed.
+func ReadFile(path string, isSecret bool) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	logValue(path, value, isSecret)
+	return value, nil
+}
+
 // Get an environment variable as an int64.
 func GetInt64(name string, defaultValue int64, isSecret bool) int64 {
 	str := GetString(name, "", isSecret)
@@ -36,7 +71,7 @@ func GetInt64(name string, defaultValue int64, isSecret bool) int64 {
 	value, err := strconv.ParseInt(str, 10, 64)
 
 	if err != nil {
-		log.Fatal("invalid configuration value", "name", name)
+		invalidValue(name, str, isSecret)
 	}
 
 	return value
@@ -48,7 +83,7 @@ func MustGetInt64(name string, isSecret bool) int64 {
 	value, err := strconv.ParseInt(str, 10, 64)
 
 	if err != nil {
-		log.Fatal("invalid configuration value", "name", name)
+		invalidValue(name, str, isSecret)
 	}
 
 	return value
@@ -63,7 +98,7 @@ func GetFloat64(name string, defaultValue float64, isSecret bool) float64 {
 
 	value, err := strconv.ParseFloat(str, 64)
 	if err != nil {
-		log.Fatal("invalid configuration value", "name", name)
+		invalidValue(name, str, isSecret)
 	}
 
 	return value
@@ -75,7 +110,34 @@ func MustGetFloat64(name string, isSecret bool) float64 {
 
 	value, err := strconv.ParseFloat(str, 64)
 	if err != nil {
-		log.Fatal("invalid configuration value", "name", name)
+		invalidValue(name, str, isSecret)
+	}
+
+	return value
+}
+
+// Get an environment variable as a time.Duration, e.g. `1m30s`.
+func GetDuration(name string, defaultValue time.Duration, isSecret bool) time.Duration {
+	str := GetString(name, "", isSecret)
+	if str == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(str)
+
+	if err != nil {
+		invalidValue(name, str, isSecret)
+	}
+
+	return value
+}
+
+// Get an environment variable as a time.Duration, e.g. `1m30s`. Panics if this variable is not defined.
+func MustGetDuration(name string, isSecret bool) time.Duration {
+	str := MustGetString(name, isSecret)
+	value, err := time.ParseDuration(str)
+
+	if err != nil {
+		invalidValue(name, str, isSecret)
 	}
 
 	return value
@@ -95,7 +157,7 @@ func GetBool(name string, defaultValue bool, isSecret bool) bool {
 		return false
 	}
 
-	log.Fatal("invalid configuration value", "name", name)
+	invalidValue(name, str, isSecret)
 	return false
 }
 
@@ -110,7 +172,7 @@ func MustGetBool(name string, isSecret bool) bool {
 		return false
 	}
 
-	log.Fatal("invalid configuration value", "name", name)
+	invalidValue(name, str, isSecret)
 	return false
 }
 
@@ -124,7 +186,7 @@ func GetStringMap(name string, defaultValue map[string]string, isSecret bool) ma
 	for _, part := range parts {
 		subParts := strings.SplitN(part, "=", 2)
 		if len(subParts) < 2 {
-			log.Fatal("invalid configuration value", "name", name)
+			invalidValue(name, str, isSecret)
 		}
 		strMap[subParts[0]] = subParts[1]
 	}
@@ -142,7 +204,7 @@ func MustGetStringMap(name string, isSecret bool) map[string]string {
 	for _, part := range parts {
 		subParts := strings.SplitN(part, "=", 2)
 		if len(subParts) < 2 {
-			log.Fatal("invalid configuration value", "name", name)
+			invalidValue(name, str, isSecret)
 		}
 		strMap[subParts[0]] = subParts[1]
 	}
@@ -2,7 +2,9 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestConfigurationGetString(t *testing.T) {
@@ -52,6 +54,16 @@ func TestConfigurationGetFloat(t *testing.T) {
 	}
 }
 
+func TestConfigurationGetDuration(t *testing.T) {
+	os.Setenv("TEST", "1m30s")
+
+	x := GetDuration("TEST", -1, false)
+
+	if x != 90*time.Second {
+		t.Fail()
+	}
+}
+
 func TestConfigurationGetStringMap(t *testing.T) {
 	os.Setenv("TEST", "1=a,2=b,3=c")
 
@@ -66,3 +78,22 @@ func TestConfigurationGetStringMap(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestConfigurationReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(path, []byte("s3cret\n"), 0600)
+
+	x, err := ReadFile(path, true)
+	if err != nil || x != "s3cret" {
+		t.Fail()
+	}
+}
+
+func TestConfigurationSecretsAreRedacted(t *testing.T) {
+	if loggedValue("s3cret", true) != Redacted {
+		t.Fail()
+	}
+	if loggedValue("8080", false) != "8080" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,42 @@
+package eviction
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Policy decides which entry to evict from a cache that is bounded in bytes.
+// Policies only track keys, the cache is responsible for storing values and tracking its size.
+// Policies are not safe for concurrent use.
+type Policy[K comparable] interface {
+	// Record that the key was added to the cache with the provided size in bytes.
+	Add(key K, size int64)
+	// Record an access to the key.
+	Touch(key K)
+	// Remove the key from the policy.
+	Remove(key K)
+	// Return the key that should be evicted next. Returns false if the policy is empty.
+	Victim() (K, bool)
+	// Return the number of tracked keys.
+	Len() int
+}
+
+const (
+	LRU      = "lru"
+	LFU      = "lfu"
+	WTinyLFU = "wtinylfu"
+)
+
+// Create the policy with the provided name (lru, lfu or wtinylfu) for a cache of the provided capacity in bytes.
+func New[K comparable](name string, capacity int64) (Policy[K], error) {
+	switch strings.ToLower(name) {
+	case LRU:
+		return NewLRU[K](), nil
+	case LFU:
+		return NewLFU[K](), nil
+	case WTinyLFU, "w-tinylfu":
+		return NewWTinyLFU[K](capacity), nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy '%s'", name)
+	}
+}
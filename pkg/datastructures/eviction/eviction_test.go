@@ -0,0 +1,98 @@
+package eviction
+
+import (
+	"testing"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	policy := NewLRU[string]()
+	policy.Add("a", 1)
+	policy.Add("b", 1)
+	policy.Add("c", 1)
+	policy.Touch("a")
+
+	victim, ok := policy.Victim()
+	if !ok || victim != "b" {
+		t.Fatalf("expected b to be evicted, got %s", victim)
+	}
+
+	policy.Remove("b")
+	victim, _ = policy.Victim()
+	if victim != "c" {
+		t.Fatalf("expected c to be evicted, got %s", victim)
+	}
+}
+
+func TestLFUEvictsLeastFrequentlyUsed(t *testing.T) {
+	policy := NewLFU[string]()
+	policy.Add("a", 1)
+	policy.Add("b", 1)
+	policy.Add("c", 1)
+	policy.Touch("a")
+	policy.Touch("a")
+	policy.Touch("c")
+
+	victim, ok := policy.Victim()
+	if !ok || victim != "b" {
+		t.Fatalf("expected b to be evicted, got %s", victim)
+	}
+
+	policy.Remove("b")
+	victim, _ = policy.Victim()
+	if victim != "c" {
+		t.Fatalf("expected c to be evicted, got %s", victim)
+	}
+
+	policy.Remove("c")
+	policy.Remove("a")
+	if _, ok := policy.Victim(); ok || policy.Len() != 0 {
+		t.Fail()
+	}
+}
+
+func TestWTinyLFUKeepsFrequentlyUsed(t *testing.T) {
+	policy := NewWTinyLFU[string](1000)
+
+	policy.Add("popular", 100)
+	for range 10 {
+		policy.Touch("popular")
+	}
+
+	// A scan of one-off keys should not push out the popular key.
+	keys := []string{"popular"}
+	for i := range 20 {
+		key := string(rune('a' + i))
+		policy.Add(key, 100)
+		keys = append(keys, key)
+
+		for policy.Len() > 10 {
+			victim, ok := policy.Victim()
+			if !ok {
+				t.Fatal("expected a victim")
+			}
+			if victim == "popular" {
+				t.Fatal("popular key was evicted")
+			}
+			policy.Remove(victim)
+		}
+	}
+
+	for _, key := range keys {
+		policy.Remove(key)
+	}
+	if policy.Len() != 0 {
+		t.Fatalf("expected empty policy, got %d keys", policy.Len())
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	for _, name := range []string{LRU, LFU, WTinyLFU} {
+		if _, err := New[string](name, 1000); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := New[string]("fifo", 1000); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,115 @@
+package eviction
+
+import "container/heap"
+
+type lfuEntry[K comparable] struct {
+	key       K
+	frequency uint64
+	// Access sequence number, used to evict the least recently used key among keys with equal frequency.
+	sequence uint64
+	index    int
+}
+
+// Min-heap of entries ordered by frequency, then recency.
+type lfuHeap[K comparable] []*lfuEntry[K]
+
+func (h lfuHeap[K]) Len() int {
+	return len(h)
+}
+
+func (h lfuHeap[K]) Less(i, j int) bool {
+	if h[i].frequency == h[j].frequency {
+		return h[i].sequence < h[j].sequence
+	}
+	return h[i].frequency < h[j].frequency
+}
+
+func (h lfuHeap[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap[K]) Push(x any) {
+	entry := x.(*lfuEntry[K])
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *lfuHeap[K]) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return entry
+}
+
+// Least frequently used policy, evicts the key with the fewest accesses.
+// Ties are broken by evicting the least recently used key.
+type LFUPolicy[K comparable] struct {
+	entries  map[K]*lfuEntry[K]
+	heap     *lfuHeap[K]
+	sequence uint64
+}
+
+func NewLFU[K comparable]() *LFUPolicy[K] {
+	return &LFUPolicy[K]{
+		entries: make(map[K]*lfuEntry[K]),
+		heap:    &lfuHeap[K]{},
+	}
+}
+
+func (p *LFUPolicy[K]) Add(key K, size int64) {
+	p.sequence++
+
+	if entry, ok := p.entries[key]; ok {
+		entry.frequency++
+		entry.sequence = p.sequence
+		heap.Fix(p.heap, entry.index)
+		return
+	}
+
+	entry := &lfuEntry[K]{
+		key:       key,
+		frequency: 1,
+		sequence:  p.sequence,
+	}
+	p.entries[key] = entry
+	heap.Push(p.heap, entry)
+}
+
+func (p *LFUPolicy[K]) Touch(key K) {
+	entry, ok := p.entries[key]
+	if !ok {
+		return
+	}
+
+	p.sequence++
+	entry.frequency++
+	entry.sequence = p.sequence
+	heap.Fix(p.heap, entry.index)
+}
+
+func (p *LFUPolicy[K]) Remove(key K) {
+	entry, ok := p.entries[key]
+	if !ok {
+		return
+	}
+
+	heap.Remove(p.heap, entry.index)
+	delete(p.entries, key)
+}
+
+func (p *LFUPolicy[K]) Victim() (K, bool) {
+	if p.heap.Len() == 0 {
+		var zero K
+		return zero, false
+	}
+
+	return (*p.heap)[0].key, true
+}
+
+func (p *LFUPolicy[K]) Len() int {
+	return len(p.entries)
+}
@@ -0,0 +1,52 @@
+package eviction
+
+import "container/list"
+
+// Least recently used policy, evicts the key that was accessed longest ago.
+type LRUPolicy[K comparable] struct {
+	order    *list.List
+	elements map[K]*list.Element
+}
+
+func NewLRU[K comparable]() *LRUPolicy[K] {
+	return &LRUPolicy[K]{
+		order:    list.New(),
+		elements: make(map[K]*list.Element),
+	}
+}
+
+func (p *LRUPolicy[K]) Add(key K, size int64) {
+	if el, ok := p.elements[key]; ok {
+		p.order.MoveToFront(el)
+		return
+	}
+
+	p.elements[key] = p.order.PushFront(key)
+}
+
+func (p *LRUPolicy[K]) Touch(key K) {
+	if el, ok := p.elements[key]; ok {
+		p.order.MoveToFront(el)
+	}
+}
+
+func (p *LRUPolicy[K]) Remove(key K) {
+	if el, ok := p.elements[key]; ok {
+		p.order.Remove(el)
+		delete(p.elements, key)
+	}
+}
+
+func (p *LRUPolicy[K]) Victim() (K, bool) {
+	el := p.order.Back()
+	if el == nil {
+		var zero K
+		return zero, false
+	}
+
+	return el.Value.(K), true
+}
+
+func (p *LRUPolicy[K]) Len() int {
+	return len(p.elements)
+}
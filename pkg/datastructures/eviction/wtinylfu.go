@@ -0,0 +1,236 @@
+package eviction
+
+import (
+	"container/list"
+	"fmt"
+	"hash/maphash"
+)
+
+// Count-min sketch with 8-bit counters, estimating how often keys were accessed.
+// Counters are halved periodically so that the sketch favours recent accesses.
+type frequencySketch struct {
+	rows       [4][]uint8
+	mask       uint64
+	seed       maphash.Seed
+	additions  int
+	sampleSize int
+}
+
+func newFrequencySketch(width int) *frequencySketch {
+	size := 16
+	for size < width {
+		size *= 2
+	}
+
+	sketch := &frequencySketch{
+		mask:       uint64(size - 1),
+		seed:       maphash.MakeSeed(),
+		sampleSize: 10 * size,
+	}
+	for i := range sketch.rows {
+		sketch.rows[i] = make([]uint8, size)
+	}
+
+	return sketch
+}
+
+func (s *frequencySketch) indexes(hash uint64) [4]uint64 {
+	var indexes [4]uint64
+	for i := range indexes {
+		// Derive a different index per row from a single hash.
+		indexes[i] = (hash + uint64(i)*(hash>>32|1)) & s.mask
+	}
+	return indexes
+}
+
+func (s *frequencySketch) Increment(hash uint64) {
+	for i, index := range s.indexes(hash) {
+		if s.rows[i][index] < 255 {
+			s.rows[i][index]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+func (s *frequencySketch) Estimate(hash uint64) uint8 {
+	estimate := uint8(255)
+	for i, index := range s.indexes(hash) {
+		estimate = min(estimate, s.rows[i][index])
+	}
+	return estimate
+}
+
+func (s *frequencySketch) reset() {
+	for _, row := range s.rows {
+		for i := range row {
+			row[i] /= 2
+		}
+	}
+	s.additions /= 2
+}
+
+type segment int
+
+const (
+	windowSegment segment = iota
+	probationSegment
+	protectedSegment
+)
+
+type wtinylfuEntry[K comparable] struct {
+	key     K
+	size    int64
+	segment segment
+}
+
+// W-TinyLFU policy.
+// New keys enter a small LRU window (1% of the capacity), keys leaving the window move to a segmented LRU main space.
+// On eviction, the newest key in the main space has to beat the oldest one on estimated access frequency to stay.
+// This keeps frequently used keys around while still allowing recent keys to build up a frequency.
+type WTinyLFUPolicy[K comparable] struct {
+	sketch   *frequencySketch
+	elements map[K]*list.Element
+
+	window    *list.List
+	probation *list.List
+	protected *list.List
+
+	windowSize    int64
+	protectedSize int64
+	windowMax     int64
+	protectedMax  int64
+}
+
+// Create a W-TinyLFU policy for a cache of the provided capacity in bytes.
+func NewWTinyLFU[K comparable](capacity int64) *WTinyLFUPolicy[K] {
+	windowMax := max(capacity/100, 1)
+
+	return &WTinyLFUPolicy[K]{
+		// Assume an average entry size of 4kB to size the sketch.
+		sketch:       newFrequencySketch(int(min(max(capacity/4096, 1), 1<<20))),
+		elements:     make(map[K]*list.Element),
+		window:       list.New(),
+		probation:    list.New(),
+		protected:    list.New(),
+		windowMax:    windowMax,
+		protectedMax: (capacity - windowMax) * 8 / 10,
+	}
+}
+
+func (p *WTinyLFUPolicy[K]) hash(key K) uint64 {
+	return maphash.String(p.sketch.seed, fmt.Sprint(key))
+}
+
+func (p *WTinyLFUPolicy[K]) list(s segment) *list.List {
+	switch s {
+	case windowSegment:
+		return p.window
+	case probationSegment:
+		return p.probation
+	default:
+		return p.protected
+	}
+}
+
+func (p *WTinyLFUPolicy[K]) Add(key K, size int64) {
+	p.sketch.Increment(p.hash(key))
+
+	if _, ok := p.elements[key]; ok {
+		p.Remove(key)
+	}
+
+	p.elements[key] = p.window.PushFront(&wtinylfuEntry[K]{key, size, windowSegment})
+	p.windowSize += size
+
+	// Move keys that fall out of the window to the main space, where they'll compete for admission on eviction.
+	for p.windowSize > p.windowMax && p.window.Len() > 1 {
+		el := p.window.Back()
+		entry := el.Value.(*wtinylfuEntry[K])
+		p.window.Remove(el)
+		p.windowSize -= entry.size
+
+		entry.segment = probationSegment
+		p.elements[entry.key] = p.probation.PushFront(entry)
+	}
+}
+
+func (p *WTinyLFUPolicy[K]) Touch(key K) {
+	p.sketch.Increment(p.hash(key))
+
+	el, ok := p.elements[key]
+	if !ok {
+		return
+	}
+
+	entry := el.Value.(*wtinylfuEntry[K])
+	switch entry.segment {
+	case windowSegment:
+		p.window.MoveToFront(el)
+	case protectedSegment:
+		p.protected.MoveToFront(el)
+	case probationSegment:
+		// Promote the key to the protected segment, demoting the oldest protected keys if it's full.
+		p.probation.Remove(el)
+		entry.segment = protectedSegment
+		p.elements[key] = p.protected.PushFront(entry)
+		p.protectedSize += entry.size
+
+		for p.protectedSize > p.protectedMax && p.protected.Len() > 1 {
+			demoted := p.protected.Back()
+			demotedEntry := demoted.Value.(*wtinylfuEntry[K])
+			p.protected.Remove(demoted)
+			p.protectedSize -= demotedEntry.size
+
+			demotedEntry.segment = probationSegment
+			p.elements[demotedEntry.key] = p.probation.PushFront(demotedEntry)
+		}
+	}
+}
+
+func (p *WTinyLFUPolicy[K]) Remove(key K) {
+	el, ok := p.elements[key]
+	if !ok {
+		return
+	}
+
+	entry := el.Value.(*wtinylfuEntry[K])
+	p.list(entry.segment).Remove(el)
+	delete(p.elements, key)
+
+	switch entry.segment {
+	case windowSegment:
+		p.windowSize -= entry.size
+	case protectedSegment:
+		p.protectedSize -= entry.size
+	}
+}
+
+func (p *WTinyLFUPolicy[K]) Victim() (K, bool) {
+	// The newest key in the probation segment (the candidate) competes with the oldest one (the victim).
+	if p.probation.Len() > 1 {
+		candidate := p.probation.Front().Value.(*wtinylfuEntry[K])
+		victim := p.probation.Back().Value.(*wtinylfuEntry[K])
+
+		if p.sketch.Estimate(p.hash(candidate.key)) > p.sketch.Estimate(p.hash(victim.key)) {
+			return victim.key, true
+		}
+		return candidate.key, true
+	}
+
+	for _, l := range []*list.List{p.probation, p.protected, p.window} {
+		if el := l.Back(); el != nil {
+			return el.Value.(*wtinylfuEntry[K]).key, true
+		}
+	}
+
+	var zero K
+	return zero, false
+}
+
+func (p *WTinyLFUPolicy[K]) Len() int {
+	return len(p.elements)
+}
@@ -9,4 +9,8 @@ type KVStore[K comparable, V any] interface {
 	// Store the value under the provided key for ttl. If ttl is <= 0, store forever.
 	Store(ctx context.Context, key K, value V, ttl time.Duration) error
 	Get(ctx context.Context, key K) (V, bool, error)
+	// Delete the value stored under the provided key, if any.
+	Delete(ctx context.Context, key K) error
+	// Get the keys that start with the provided prefix.
+	Keys(ctx context.Context, prefix string) ([]K, error)
 }
@@ -0,0 +1,80 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// A KVStore that encodes values to strings before storing them in an underlying string store, e.g. Redis.
+// Keys are prefixed so that several stores can share the underlying store.
+type CodecKVStore[V any] struct {
+	store  KVStore[string, string]
+	prefix string
+	encode func(value V) (string, error)
+	decode func(data string) (V, error)
+}
+
+func NewCodecKVStore[V any](store KVStore[string, string], prefix string, encode func(value V) (string, error), decode func(data string) (V, error)) *CodecKVStore[V] {
+	return &CodecKVStore[V]{
+		store:  store,
+		prefix: prefix,
+		encode: encode,
+		decode: decode,
+	}
+}
+
+// Create a CodecKVStore that encodes values as JSON.
+func NewJSONKVStore[V any](store KVStore[string, string], prefix string) *CodecKVStore[V] {
+	return NewCodecKVStore(store, prefix, func(value V) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	}, func(data string) (V, error) {
+		var value V
+		err := json.Unmarshal([]byte(data), &value)
+		return value, err
+	})
+}
+
+func (s *CodecKVStore[V]) Store(ctx context.Context, key string, value V, ttl time.Duration) error {
+	data, err := s.encode(value)
+	if err != nil {
+		return err
+	}
+
+	return s.store.Store(ctx, s.prefix+key, data, ttl)
+}
+
+func (s *CodecKVStore[V]) Get(ctx context.Context, key string) (V, bool, error) {
+	var value V
+
+	data, exists, err := s.store.Get(ctx, s.prefix+key)
+	if err != nil || !exists {
+		return value, exists, err
+	}
+
+	value, err = s.decode(data)
+	if err != nil {
+		return value, false, err
+	}
+
+	return value, true, nil
+}
+
+func (s *CodecKVStore[V]) Delete(ctx context.Context, key string) error {
+	return s.store.Delete(ctx, s.prefix+key)
+}
+
+func (s *CodecKVStore[V]) Keys(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := s.store.Keys(ctx, s.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, s.prefix)
+	}
+
+	return keys, nil
+}
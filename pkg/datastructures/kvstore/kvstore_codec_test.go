@@ -0,0 +1,52 @@
+package kvstore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type codecTestValue struct {
+	Name  string
+	Data  []byte
+	Until time.Time
+}
+
+func TestJSONKVStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	strings := NewMemoryKVStore[string, string](ctx)
+	store := NewJSONKVStore[*codecTestValue](strings, "test:")
+
+	value := &codecTestValue{
+		Name:  "test",
+		Data:  []byte{0, 1, 2, 255},
+		Until: time.Now().Round(0),
+	}
+	err := store.Store(ctx, "key", value, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys are prefixed in the underlying store.
+	if _, exists, _ := strings.Get(ctx, "test:key"); !exists {
+		t.Fatal("expected prefixed key in underlying store")
+	}
+
+	decoded, exists, err := store.Get(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || decoded.Name != value.Name || string(decoded.Data) != string(value.Data) || !decoded.Until.Equal(value.Until) {
+		t.Fatalf("decoded value %+v does not match %+v", decoded, value)
+	}
+
+	err = store.Delete(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists, _ := store.Get(ctx, "key"); exists {
+		t.Fail()
+	}
+}
@@ -0,0 +1,189 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/log"
+)
+
+// Interval at which the FileKVStore writes changes to disk and drops expired values.
+const FileFlushInterval = 10 * time.Second
+
+type fileEntry struct {
+	Value string
+	// Zero if the value never expires.
+	ExpiresAt time.Time
+}
+
+func (e *fileEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && now.After(e.ExpiresAt)
+}
+
+// A string KVStore that is kept in memory and persisted to a JSON file, so that it survives restarts.
+// Changes are written to disk periodically and when the context is cancelled.
+type FileKVStore struct {
+	path    string
+	entries map[string]*fileEntry
+	dirty   bool
+	lock    *sync.Mutex
+	// Serializes writes to disk.
+	flushLock *sync.Mutex
+}
+
+// Create a FileKVStore persisted at the provided path, loading any values stored there before.
+func NewFileKVStore(ctx context.Context, path string) (*FileKVStore, error) {
+	store := &FileKVStore{
+		path:      path,
+		entries:   make(map[string]*fileEntry),
+		lock:      &sync.Mutex{},
+		flushLock: &sync.Mutex{},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &store.entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go store.run(ctx)
+
+	return store, nil
+}
+
+// Periodically drop expired values and write changes to disk.
+func (s *FileKVStore) run(ctx context.Context) {
+	ticker := time.NewTicker(FileFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Flush(); err != nil {
+				log.DefaultLogger.Error(err.Error(), "path", s.path)
+			}
+			return
+		case now := <-ticker.C:
+			s.lock.Lock()
+			for key, entry := range s.entries {
+				if entry.expired(now) {
+					delete(s.entries, key)
+					s.dirty = true
+				}
+			}
+			s.lock.Unlock()
+
+			if err := s.Flush(); err != nil {
+				log.DefaultLogger.Error(err.Error(), "path", s.path)
+			}
+		}
+	}
+}
+
+// Write the store to disk if it changed since the last flush.
+func (s *FileKVStore) Flush() error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	s.lock.Lock()
+	if !s.dirty {
+		s.lock.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.entries)
+	s.dirty = false
+	s.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(s.path, data)
+}
+
+// Write the file to a temporary path first and rename it, so that a crash never leaves a partially written file.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FileKVStore) Store(ctx context.Context, key string, value string, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry := &fileEntry{Value: value}
+	if ttl > 0 {
+		entry.ExpiresAt = time.Now().Add(ttl)
+	}
+	s.entries[key] = entry
+	s.dirty = true
+
+	return nil
+}
+
+func (s *FileKVStore) Get(ctx context.Context, key string) (string, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok || entry.expired(time.Now()) {
+		return "", false, nil
+	}
+
+	return entry.Value, true, nil
+}
+
+func (s *FileKVStore) Delete(ctx context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.entries[key]; ok {
+		delete(s.entries, key)
+		s.dirty = true
+	}
+
+	return nil
+}
+
+func (s *FileKVStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0)
+	for key, entry := range s.entries {
+		if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
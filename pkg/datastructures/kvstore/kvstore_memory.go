@@ -2,6 +2,8 @@ package kvstore
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"sync"
 	"time"
 )
@@ -63,3 +65,30 @@ func (s *MemoryKVStore[K, V]) Get(ctx context.Context, key K) (V, bool, error) {
 	x, ok := s.values[key]
 	return x, ok, nil
 }
+
+func (s *MemoryKVStore[K, V]) Delete(ctx context.Context, key K) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if cancelJanitor, ok := s.janitors[key]; ok {
+		cancelJanitor()
+		delete(s.janitors, key)
+	}
+	delete(s.values, key)
+
+	return nil
+}
+
+func (s *MemoryKVStore[K, V]) Keys(ctx context.Context, prefix string) ([]K, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := make([]K, 0)
+	for key := range s.values {
+		if strings.HasPrefix(fmt.Sprint(key), prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
@@ -56,3 +56,21 @@ func TestTTL(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemoryKVStore[string, string](ctx)
+	store.Store(ctx, "a/1", ":)", -1)
+	store.Store(ctx, "a/2", ":)", -1)
+	store.Store(ctx, "b/1", ":)", -1)
+
+	keys, err := store.Keys(ctx, "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatal(keys)
+	}
+}
@@ -2,6 +2,7 @@ package kvstore
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -28,3 +29,20 @@ func (s *RedisKVStore[K, V]) Get(ctx context.Context, key string) (string, bool,
 	}
 	return value, true, err
 }
+
+func (s *RedisKVStore[K, V]) Delete(ctx context.Context, key string) error {
+	return s.client.Del(ctx, key).Err()
+}
+
+// Escapes the glob-style pattern characters in s, so that it matches literally in SCAN's MATCH option.
+var redisPatternEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (s *RedisKVStore[K, V]) Keys(ctx context.Context, prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	iter := s.client.Scan(ctx, 0, redisPatternEscaper.Replace(prefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+
+	return keys, iter.Err()
+}
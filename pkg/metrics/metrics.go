@@ -0,0 +1,321 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Buckets for durations in seconds, from 1ms to 2 minutes.
+var DefaultDurationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// A metric that can write its series in the Prometheus text format.
+type collector interface {
+	write(w io.Writer) error
+}
+
+// A registry of metrics, served in the Prometheus text exposition format.
+type Registry struct {
+	collectors []collector
+	lock       *sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make([]collector, 0),
+		lock:       &sync.Mutex{},
+	}
+}
+
+func (r *Registry) register(c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Write all metrics in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.lock.Unlock()
+
+	for _, c := range collectors {
+		err := c.write(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// Name and label names shared by all metric types.
+type metric struct {
+	name       string
+	help       string
+	metricType string
+	labels     []string
+	lock       *sync.Mutex
+}
+
+func newMetric(name, help, metricType string, labels []string) metric {
+	return metric{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		lock:       &sync.Mutex{},
+	}
+}
+
+// Get the key of a series from its label values. Panics if the number of values doesn't match the labels.
+func (m *metric) seriesKey(labelValues []string) string {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", m.name, len(m.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// Format the labels of a series, with optional extra labels, e.g. `{method="GET",code="200"}`.
+func (m *metric) formatLabels(labelValues []string, extra ...string) string {
+	pairs := make([]string, 0, len(m.labels)+len(extra)/2)
+	for i, label := range m.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, labelValueEscaper.Replace(labelValues[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], labelValueEscaper.Replace(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metric) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, helpEscaper.Replace(m.help), m.name, m.metricType)
+	return err
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// A series holding a single value.
+type valueSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// A metric with a single value per series, the base of counters and gauges.
+type valueMetric struct {
+	metric
+	series map[string]*valueSeries
+}
+
+func (m *valueMetric) get(labelValues []string) *valueSeries {
+	key := m.seriesKey(labelValues)
+	series, ok := m.series[key]
+	if !ok {
+		series = &valueSeries{labelValues: slices.Clone(labelValues)}
+		m.series[key] = series
+	}
+	return series
+}
+
+func (m *valueMetric) write(w io.Writer) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	err := m.writeHeader(w)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		series := m.series[key]
+		_, err = fmt.Fprintf(w, "%s%s %s\n", m.name, m.formatLabels(series.labelValues), formatValue(series.value))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A counter only goes up, e.g. the number of requests.
+type Counter struct {
+	valueMetric
+}
+
+// Create a counter with the provided label names and register it.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	counter := &Counter{valueMetric{newMetric(name, help, "counter", labels), make(map[string]*valueSeries)}}
+	r.register(counter)
+	return counter
+}
+
+// Increment the counter for the provided label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add a value to the counter for the provided label values. Panics if the value is negative.
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("counter %s can't decrease", c.name))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.get(labelValues).value += value
+}
+
+// A gauge can go up and down, e.g. the number of requests in flight.
+type Gauge struct {
+	valueMetric
+}
+
+// Create a gauge with the provided label names and register it.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	gauge := &Gauge{valueMetric{newMetric(name, help, "gauge", labels), make(map[string]*valueSeries)}}
+	r.register(gauge)
+	return gauge
+}
+
+// Set the gauge for the provided label values.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.get(labelValues).value = value
+}
+
+// Add a value, which may be negative, to the gauge for the provided label values.
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.get(labelValues).value += value
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// Number of observations per bucket, not cumulative.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// A histogram counts observations in buckets, e.g. request durations.
+type Histogram struct {
+	metric
+	// Upper bounds of the buckets, sorted. The +Inf bucket is implicit.
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+// Create a histogram with the provided bucket upper bounds and label names, and register it.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+
+	histogram := &Histogram{
+		metric:  newMetric(name, help, "histogram", labels),
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	r.register(histogram)
+	return histogram
+}
+
+// Observe a value for the provided label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	key := h.seriesKey(labelValues)
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{
+			labelValues: slices.Clone(labelValues),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = series
+	}
+
+	index, _ := slices.BinarySearch(h.buckets, value)
+	if index < len(h.buckets) {
+		series.counts[index]++
+	}
+	series.sum += value
+	series.count++
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	err := h.writeHeader(w)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		series := h.series[key]
+
+		cumulative := uint64(0)
+		for i, upperBound := range h.buckets {
+			cumulative += series.counts[i]
+			_, err = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(series.labelValues, "le", formatValue(upperBound)), cumulative)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.name, h.formatLabels(series.labelValues, "le", "+Inf"), series.count,
+			h.name, h.formatLabels(series.labelValues), formatValue(series.sum),
+			h.name, h.formatLabels(series.labelValues), series.count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
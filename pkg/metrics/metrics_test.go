@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	registry := NewRegistry()
+
+	requests := registry.NewCounter("requests_total", "Number of requests.", "host", "code")
+	requests.Inc("example.com", "200")
+	requests.Add(2, "example.com", "200")
+	requests.Inc(`quo"te`, "500")
+
+	inFlight := registry.NewGauge("in_flight", "Requests in flight.")
+	inFlight.Inc()
+	inFlight.Inc()
+	inFlight.Dec()
+
+	durations := registry.NewHistogram("duration_seconds", "Duration.", []float64{1, 0.1}, "rule")
+	durations.Observe(0.05, "a")
+	durations.Observe(0.1, "a")
+	durations.Observe(5, "a")
+
+	buffer := &bytes.Buffer{}
+	err := registry.Write(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := buffer.String()
+
+	for _, expected := range []string{
+		"# TYPE requests_total counter\n",
+		`requests_total{host="example.com",code="200"} 3` + "\n",
+		`requests_total{host="quo\"te",code="500"} 1` + "\n",
+		"# TYPE in_flight gauge\nin_flight 1\n",
+		`duration_seconds_bucket{rule="a",le="0.1"} 2` + "\n",
+		`duration_seconds_bucket{rule="a",le="1"} 2` + "\n",
+		`duration_seconds_bucket{rule="a",le="+Inf"} 3` + "\n",
+		`duration_seconds_sum{rule="a"} 5.15` + "\n",
+		`duration_seconds_count{rule="a"} 3` + "\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("expected %q in output:\n%s", expected, output)
+		}
+	}
+}
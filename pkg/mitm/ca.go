@@ -0,0 +1,240 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/datastructures/eviction"
+)
+
+// Validity of the leaf certificates minted by the CertificateAuthority.
+// Leaf certificates are cached and renewed once they come within a day of expiring.
+const LeafValidity = 30 * 24 * time.Hour
+
+// Number of leaf certificates the CertificateAuthority caches, the least recently used are minted again when needed.
+const MaxCachedLeaves = 10000
+
+// A certificate authority that mints leaf certificates for intercepted hosts.
+// Clients must trust the CA's certificate for the intercepted connections to be accepted.
+type CertificateAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// All leaf certificates share a single key, generating a key per host is slow and gains us nothing.
+	leafKey *ecdsa.PrivateKey
+	leaves  map[string]*tls.Certificate
+	// Order in which the cached leaves were used, see MaxCachedLeaves.
+	leafOrder *eviction.LRUPolicy[string]
+	maxLeaves int
+	lock      *sync.Mutex
+}
+
+func newCertificateAuthority(cert *x509.Certificate, key crypto.Signer) (*CertificateAuthority, error) {
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertificateAuthority{
+		cert:      cert,
+		key:       key,
+		leafKey:   leafKey,
+		leaves:    make(map[string]*tls.Certificate),
+		leafOrder: eviction.NewLRU[string](),
+		maxLeaves: MaxCachedLeaves,
+		lock:      &sync.Mutex{},
+	}, nil
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// Generate a new self-signed certificate authority, valid for the provided duration.
+func GenerateCA(commonName string, validity time.Duration) (*CertificateAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{"Chaperone"},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCertificateAuthority(cert, key)
+}
+
+// Load a certificate authority from PEM encoded certificate and key files.
+func LoadCA(certFile, keyFile string) (*CertificateAuthority, error) {
+	keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate %s is not a certificate authority", certFile)
+	}
+
+	key, ok := keyPair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported certificate authority key type")
+	}
+
+	return newCertificateAuthority(cert, key)
+}
+
+// Return the CA certificate.
+func (ca *CertificateAuthority) Certificate() *x509.Certificate {
+	return ca.cert
+}
+
+// Write the PEM encoded certificate and private key to the provided paths.
+// The key file is only readable by the current user.
+func (ca *CertificateAuthority) WriteFiles(certFile, keyFile string) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(ca.key)
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	err = os.WriteFile(certFile, certPEM, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(keyFile, keyPEM, 0600)
+}
+
+// Return true if the leaf certificate is about to expire and a later one can be minted.
+func (ca *CertificateAuthority) needsRenewal(leaf *x509.Certificate) bool {
+	if leaf.NotAfter.Equal(ca.cert.NotAfter) {
+		return time.Now().After(leaf.NotAfter)
+	}
+	return time.Until(leaf.NotAfter) < 24*time.Hour
+}
+
+// Get a leaf certificate for the provided host, signed by the CA.
+// Certificates are cached per host, up to MaxCachedLeaves.
+func (ca *CertificateAuthority) CertificateForHost(host string) (*tls.Certificate, error) {
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+
+	if leaf, ok := ca.leaves[host]; ok && !ca.needsRenewal(leaf.Leaf) {
+		ca.leafOrder.Touch(host)
+		return leaf, nil
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(LeafValidity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: host,
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, ca.leafKey.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leafKey,
+		Leaf:        leaf,
+	}
+	ca.leaves[host] = cert
+	ca.leafOrder.Add(host, 1)
+	for len(ca.leaves) > ca.maxLeaves {
+		victim, ok := ca.leafOrder.Victim()
+		if !ok {
+			break
+		}
+		ca.leafOrder.Remove(victim)
+		delete(ca.leaves, victim)
+	}
+
+	return cert, nil
+}
+
+// Get a TLS server config that presents a minted certificate for the requested server name.
+// The fallback host is used when the client does not send SNI.
+func (ca *CertificateAuthority) TLSConfig(fallbackHost string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			host := hello.ServerName
+			if host == "" {
+				host = fallbackHost
+			}
+			return ca.CertificateForHost(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+}
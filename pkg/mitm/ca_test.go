@@ -0,0 +1,109 @@
+package mitm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLeafCertificateIsSignedByCA(t *testing.T) {
+	ca, err := GenerateCA("Chaperone Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := ca.CertificateForHost("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+	_, err = leaf.Leaf.Verify(x509.VerifyOptions{
+		DNSName: "example.com",
+		Roots:   roots,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Leaf certificates must not outlive the CA.
+	if leaf.Leaf.NotAfter.After(ca.Certificate().NotAfter) {
+		t.Fail()
+	}
+
+	cached, err := ca.CertificateForHost("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != leaf {
+		t.Fail()
+	}
+}
+
+func TestLeafCacheIsBounded(t *testing.T) {
+	ca, err := GenerateCA("Chaperone Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.maxLeaves = 2
+
+	leaves := make(map[string]*tls.Certificate)
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		leaves[host], err = ca.CertificateForHost(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Use a again, so that b is the least recently used.
+	if _, err := ca.CertificateForHost("a.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.CertificateForHost("c.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ca.leaves) != 2 {
+		t.Fatalf("expected 2 cached leaves, got %d", len(ca.leaves))
+	}
+	if cached, _ := ca.CertificateForHost("a.example.com"); cached != leaves["a.example.com"] {
+		t.Fatal("expected the recently used leaf to stay cached")
+	}
+	if minted, _ := ca.CertificateForHost("b.example.com"); minted == leaves["b.example.com"] {
+		t.Fatal("expected the least recently used leaf to be minted again")
+	}
+}
+
+func TestWriteAndLoadCA(t *testing.T) {
+	ca, err := GenerateCA("Chaperone Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+	err = ca.WriteFiles(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadCA(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !loaded.Certificate().Equal(ca.Certificate()) {
+		t.Fail()
+	}
+
+	leaf, err := loaded.CertificateForHost("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.Leaf.IPAddresses) != 1 {
+		t.Fail()
+	}
+}
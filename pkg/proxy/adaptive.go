@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/log"
+)
+
+var (
+	// Fraction of the maximum rate the rate increases by after every healthy response.
+	AdaptiveIncrease = 0.01
+	// Factor the rate is multiplied by after a 429 or 503 response or a latency spike.
+	AdaptiveDecrease = 0.5
+	// Responses taking longer than this factor times the average latency are latency spikes.
+	AdaptiveLatencySpike = 3.0
+)
+
+const (
+	// Weight of a response in the moving average of the latency.
+	adaptiveLatencyWeight = 0.1
+	// Number of responses to average before latency spikes are detected.
+	adaptiveLatencySamples = 10
+	// Minimum time between decreases, so that a burst of 429 responses to requests sent at the same rate only decreases it once.
+	adaptiveDecreaseCooldown = time.Second
+)
+
+// Bounds of a rate that adapts to the upstream server's responses.
+type AdaptiveRate struct {
+	MinRate Quota `json:"min_rate"`
+	MaxRate Quota `json:"max_rate"`
+}
+
+// Get the number of requests per second of a quota.
+func (q Quota) PerSecond() float64 {
+	return float64(q.Requests) / q.Window.Seconds()
+}
+
+// Get the interval between requests at a rate in requests per second.
+func rateInterval(perSecond float64) time.Duration {
+	return time.Duration(float64(time.Second) / perSecond)
+}
+
+// Format a rate in requests per second like `12.5/second`.
+func FormatRate(interval time.Duration) string {
+	if interval <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.4g/second", float64(time.Second)/float64(interval))
+}
+
+// State of an adaptive rate, adjusted with additive increase, multiplicative decrease (AIMD):
+// the rate grows steadily while responses are healthy and halves when the upstream server pushes back.
+type aimd struct {
+	bounds AdaptiveRate
+	// Current rate in requests per second.
+	rate float64
+	// Moving average of the latency and the number of responses in it.
+	latency      time.Duration
+	samples      int
+	lastDecrease time.Time
+}
+
+func newAIMD(bounds AdaptiveRate, interval time.Duration) *aimd {
+	a := &aimd{bounds: bounds, rate: bounds.MinRate.PerSecond()}
+	if interval > 0 {
+		a.rate = float64(time.Second) / float64(interval)
+	}
+	a.clamp()
+	return a
+}
+
+func (a *aimd) clamp() {
+	a.rate = min(max(a.rate, a.bounds.MinRate.PerSecond()), a.bounds.MaxRate.PerSecond())
+}
+
+// Change the bounds, keeping the current rate within them.
+func (a *aimd) setBounds(bounds AdaptiveRate) {
+	a.bounds = bounds
+	a.clamp()
+}
+
+// Adjust the rate to the outcome of a request, its latency and whether the upstream server asked to back off.
+// Returns the new interval between requests and whether the rate decreased.
+func (a *aimd) update(now time.Time, latency time.Duration, backoff bool) (time.Duration, bool) {
+	spike := a.samples >= adaptiveLatencySamples && float64(latency) > float64(a.latency)*AdaptiveLatencySpike
+	if a.samples == 0 {
+		a.latency = latency
+	} else {
+		a.latency += time.Duration(adaptiveLatencyWeight * float64(latency-a.latency))
+	}
+	a.samples++
+
+	decreased := false
+	if backoff || spike {
+		if now.Sub(a.lastDecrease) >= adaptiveDecreaseCooldown {
+			a.rate *= AdaptiveDecrease
+			a.lastDecrease = now
+			decreased = true
+		}
+	} else {
+		a.rate += AdaptiveIncrease * a.bounds.MaxRate.PerSecond()
+	}
+	a.clamp()
+
+	return rateInterval(a.rate), decreased
+}
+
+// Log the new rate of an adaptive throttle, decreases are logged as info and increases as debug to limit the noise.
+func logAdaptedRate(key string, interval time.Duration, decreased bool) {
+	logger := log.DefaultLogger.With("throttle", key).With("rate", FormatRate(interval))
+	if decreased {
+		logger.Info("Decreased adaptive throttle rate")
+	} else {
+		logger.Debug("Increased adaptive throttle rate")
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAIMD(t *testing.T) {
+	bounds := AdaptiveRate{MinRate: Quota{1, time.Second}, MaxRate: Quota{100, time.Second}}
+	a := newAIMD(bounds, 0)
+	if a.rate != 1 {
+		t.Fatalf("expected to start at the minimum rate, got %f", a.rate)
+	}
+
+	now := time.Now()
+	// Healthy responses increase the rate additively, up to the maximum.
+	interval, _ := a.update(now, 10*time.Millisecond, false)
+	if interval != time.Second/2 {
+		t.Fatalf("expected the rate to increase to 2/second, got %s", FormatRate(interval))
+	}
+	for range 200 {
+		interval, _ = a.update(now, 10*time.Millisecond, false)
+	}
+	if interval != 10*time.Millisecond {
+		t.Fatalf("expected the rate to stop at the maximum, got %s", FormatRate(interval))
+	}
+
+	// Backing off halves the rate, once per cooldown.
+	interval, decreased := a.update(now, 10*time.Millisecond, true)
+	if !decreased || interval != 20*time.Millisecond {
+		t.Fatalf("expected the rate to halve, got %s", FormatRate(interval))
+	}
+	interval, decreased = a.update(now, 10*time.Millisecond, true)
+	if decreased || interval != 20*time.Millisecond {
+		t.Fatalf("expected the rate to decrease once per cooldown, got %s", FormatRate(interval))
+	}
+
+	// So does a latency spike.
+	_, decreased = a.update(now.Add(adaptiveDecreaseCooldown), time.Second, false)
+	if !decreased {
+		t.Fatal("expected a latency spike to decrease the rate")
+	}
+}
+
+func TestMemoryHTTPThrottleAdapt(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+
+	url, err := url.Parse("http://example.com/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: "GET", URL: url}
+	bounds := &AdaptiveRate{MinRate: Quota{1, time.Second}, MaxRate: Quota{10, time.Second}}
+	throttle.SetThrottle(req, Limit{Interval: 200 * time.Millisecond, Burst: 1, Adaptive: bounds})
+
+	throttle.Adapt(req, 10*time.Millisecond, true)
+	if interval := throttle.Throttles()[0].Limit.Interval; interval != 400*time.Millisecond {
+		t.Fatalf("expected the rate to halve, got %s", FormatRate(interval))
+	}
+
+	// Setting the throttle again keeps its current rate.
+	throttle.SetThrottle(req, Limit{Interval: 200 * time.Millisecond, Burst: 1, Adaptive: bounds})
+	if interval := throttle.Throttles()[0].Limit.Interval; interval != 400*time.Millisecond {
+		t.Fatalf("expected the rate to be kept, got %s", FormatRate(interval))
+	}
+}
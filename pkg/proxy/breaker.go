@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/log"
+)
+
+// Header set on responses rejected because a circuit breaker is open.
+const CircuitBreakerHeader = "X-Chaperone-Circuit"
+
+// States of a circuit breaker.
+const (
+	// Requests are sent, failures are counted.
+	CircuitClosed = "closed"
+	// Requests fail fast without being sent.
+	CircuitOpen = "open"
+	// A limited number of probe requests are sent to find out if the upstream server recovered.
+	CircuitHalfOpen = "half-open"
+)
+
+// Decides when a circuit breaker opens and how it recovers.
+type BreakerSettings struct {
+	// Number of consecutive failures after which the breaker opens. Zero to disable.
+	ConsecutiveFailures int
+	// Fraction of failed requests in a window after which the breaker opens, if the window has at least MinRequests requests.
+	// Zero to disable.
+	FailureRate float64
+	MinRequests int
+	Window      time.Duration
+	// Time the breaker stays open before it sends probes.
+	OpenDuration time.Duration
+	// Number of probes that must succeed in a row before the breaker closes.
+	Probes int
+}
+
+// The settings used when none are configured: open after 10 consecutive failures, probe again after 30 seconds.
+func DefaultBreakerSettings() BreakerSettings {
+	return BreakerSettings{
+		ConsecutiveFailures: 10,
+		MinRequests:         20,
+		Window:              time.Minute,
+		OpenDuration:        30 * time.Second,
+		Probes:              1,
+	}
+}
+
+// Returned when a request is rejected because its circuit breaker is open.
+type CircuitOpenError struct {
+	Breaker string
+	// Time until the breaker sends probes again.
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker %s is open, retry after %s", e.Breaker, e.RetryAfter.Round(time.Second))
+}
+
+type circuitBreaker struct {
+	key      string
+	settings BreakerSettings
+	state    string
+	// Incremented on every state change, so that outcomes of requests sent in an earlier state are ignored.
+	generation          int
+	consecutiveFailures int
+	windowStart         time.Time
+	windowRequests      int
+	windowFailures      int
+	openUntil           time.Time
+	probesInFlight      int
+	probeSuccesses      int
+}
+
+func (b *circuitBreaker) setState(now time.Time, state string) {
+	b.state = state
+	b.generation++
+	b.consecutiveFailures = 0
+	b.windowStart = now
+	b.windowRequests = 0
+	b.windowFailures = 0
+	b.probesInFlight = 0
+	b.probeSuccesses = 0
+	if state == CircuitOpen {
+		b.openUntil = now.Add(b.settings.OpenDuration)
+	}
+	log.DefaultLogger.With("breaker", b.key).Warning("Circuit breaker is " + state)
+}
+
+// Return true if a request may be sent, moving to half-open once the open duration passed.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b.state == CircuitOpen && !now.Before(b.openUntil) {
+		b.setState(now, CircuitHalfOpen)
+	}
+
+	switch b.state {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		if b.probesInFlight+b.probeSuccesses >= max(b.settings.Probes, 1) {
+			return false
+		}
+		b.probesInFlight++
+	}
+	return true
+}
+
+// Release the probe of a request allowed in the generation that wasn't sent.
+func (b *circuitBreaker) cancel(generation int) {
+	if generation == b.generation && b.state == CircuitHalfOpen {
+		b.probesInFlight--
+	}
+}
+
+// Record the outcome of a request sent in the generation.
+// Returns true if the breaker opened.
+func (b *circuitBreaker) record(now time.Time, generation int, failed bool) bool {
+	if generation != b.generation {
+		return false
+	}
+
+	switch b.state {
+	case CircuitHalfOpen:
+		b.probesInFlight--
+		if failed {
+			b.setState(now, CircuitOpen)
+			return true
+		}
+		b.probeSuccesses++
+		if b.probeSuccesses >= max(b.settings.Probes, 1) {
+			b.setState(now, CircuitClosed)
+		}
+	case CircuitClosed:
+		if b.settings.Window > 0 && now.Sub(b.windowStart) >= b.settings.Window {
+			b.windowStart = now
+			b.windowRequests = 0
+			b.windowFailures = 0
+		}
+		b.windowRequests++
+		if !failed {
+			b.consecutiveFailures = 0
+			return false
+		}
+		b.consecutiveFailures++
+		b.windowFailures++
+
+		tooManyFailures := b.settings.ConsecutiveFailures > 0 && b.consecutiveFailures >= b.settings.ConsecutiveFailures
+		failureRate := float64(b.windowFailures) / float64(b.windowRequests)
+		highFailureRate := b.settings.FailureRate > 0 && b.windowRequests >= b.settings.MinRequests && failureRate >= b.settings.FailureRate
+		if tooManyFailures || highFailureRate {
+			b.setState(now, CircuitOpen)
+			return true
+		}
+	}
+	return false
+}
+
+// Circuit breakers by name, created on first use.
+type CircuitBreakers struct {
+	breakers map[string]*circuitBreaker
+	lock     *sync.Mutex
+	// Settings of breakers that don't have their own.
+	defaults BreakerSettings
+}
+
+func NewCircuitBreakers(defaults BreakerSettings) *CircuitBreakers {
+	return &CircuitBreakers{
+		breakers: make(map[string]*circuitBreaker),
+		lock:     &sync.Mutex{},
+		defaults: defaults,
+	}
+}
+
+// Get the breaker with the key, creating it if needed, with the provided settings or the default settings if nil.
+// The lock must be held.
+func (c *CircuitBreakers) breaker(key string, settings *BreakerSettings) *circuitBreaker {
+	breaker, ok := c.breakers[key]
+	if !ok {
+		breaker = &circuitBreaker{key: key, state: CircuitClosed, windowStart: time.Now()}
+		c.breakers[key] = breaker
+	}
+	breaker.settings = c.defaults
+	if settings != nil {
+		breaker.settings = *settings
+	}
+	return breaker
+}
+
+// Get the provided breaker settings, or the default settings if nil.
+func (c *CircuitBreakers) Settings(settings *BreakerSettings) BreakerSettings {
+	if settings != nil {
+		return *settings
+	}
+	return c.defaults
+}
+
+// Return a CircuitOpenError if the breaker with the key is open, without sending a probe if it's half-open.
+// Used to fail fast before waiting on the throttle.
+func (c *CircuitBreakers) Check(key string, settings *BreakerSettings) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	breaker := c.breaker(key, settings)
+	now := time.Now()
+	if breaker.state == CircuitOpen && now.Before(breaker.openUntil) {
+		return &CircuitOpenError{Breaker: key, RetryAfter: breaker.openUntil.Sub(now)}
+	}
+	return nil
+}
+
+// Ask the breaker with the key whether a request may be sent, with the provided settings or the default settings if nil.
+// Returns a function that must be called with the outcome of the request, or a CircuitOpenError if the breaker is open.
+// The function returns true if the outcome opened the breaker.
+// The second function must be called instead if the request wasn't sent, it releases the probe without recording an outcome.
+func (c *CircuitBreakers) Allow(key string, settings *BreakerSettings) (func(failed bool) bool, func(), error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	breaker := c.breaker(key, settings)
+	now := time.Now()
+	if !breaker.allow(now) {
+		return nil, nil, &CircuitOpenError{Breaker: key, RetryAfter: max(breaker.openUntil.Sub(now), 0)}
+	}
+
+	generation := breaker.generation
+	record := func(failed bool) bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return breaker.record(time.Now(), generation, failed)
+	}
+	cancel := func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		breaker.cancel(generation)
+	}
+	return record, cancel, nil
+}
+
+// Get the state of every breaker, by key.
+func (c *CircuitBreakers) States() map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	states := make(map[string]string, len(c.breakers))
+	for key, breaker := range c.breakers {
+		states[key] = breaker.state
+	}
+	return states
+}
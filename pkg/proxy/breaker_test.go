@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breakers := NewCircuitBreakers(BreakerSettings{
+		ConsecutiveFailures: 2,
+		OpenDuration:        100 * time.Millisecond,
+		Probes:              1,
+	})
+
+	send := func(failed bool) (bool, error) {
+		record, _, err := breakers.Allow("example.com", nil)
+		if err != nil {
+			return false, err
+		}
+		return record(failed), nil
+	}
+
+	// Consecutive failures open the breaker, a success in between resets the count.
+	for _, failed := range []bool{true, false, true} {
+		if opened, err := send(failed); opened || err != nil {
+			t.Fatalf("breaker opened too early: %v", err)
+		}
+	}
+	if opened, _ := send(true); !opened {
+		t.Fatal("expected the breaker to open")
+	}
+
+	var openErr *CircuitOpenError
+	if _, err := send(false); !errors.As(err, &openErr) || openErr.RetryAfter <= 0 {
+		t.Fatalf("expected the open breaker to reject requests, got %v", err)
+	}
+	if err := breakers.Check("example.com", nil); err == nil {
+		t.Fatal("expected the check to fail")
+	}
+
+	// Once half-open, a single probe is sent, a failed probe opens the breaker again.
+	time.Sleep(100 * time.Millisecond)
+	record, _, err := breakers.Allow("example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := breakers.Allow("example.com", nil); err == nil {
+		t.Fatal("expected only one probe")
+	}
+	if !record(true) {
+		t.Fatal("expected the failed probe to open the breaker")
+	}
+
+	// A successful probe closes it.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := send(false); err != nil {
+		t.Fatal(err)
+	}
+	if state := breakers.States()["example.com"]; state != CircuitClosed {
+		t.Fatalf("expected the breaker to close, got %s", state)
+	}
+}
+
+func TestCircuitBreakerFailureRate(t *testing.T) {
+	breakers := NewCircuitBreakers(BreakerSettings{
+		FailureRate:  0.5,
+		MinRequests:  4,
+		Window:       time.Minute,
+		OpenDuration: time.Minute,
+	})
+
+	opened := false
+	for _, failed := range []bool{false, true, false, true} {
+		record, _, err := breakers.Allow("example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened = record(failed)
+	}
+	if !opened {
+		t.Fatal("expected the breaker to open once half of the requests failed")
+	}
+}
+
+func TestCircuitBreakerCancel(t *testing.T) {
+	breakers := NewCircuitBreakers(BreakerSettings{
+		ConsecutiveFailures: 1,
+		OpenDuration:        50 * time.Millisecond,
+		Probes:              1,
+	})
+	record, _, err := breakers.Allow("example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !record(true) {
+		t.Fatal("expected the breaker to open")
+	}
+
+	// A probe that wasn't sent leaves the breaker half-open and lets another probe through.
+	time.Sleep(50 * time.Millisecond)
+	_, cancel, err := breakers.Allow("example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if state := breakers.States()["example.com"]; state != CircuitHalfOpen {
+		t.Fatalf("expected the breaker to stay half-open, got %s", state)
+	}
+	if _, _, err := breakers.Allow("example.com", nil); err != nil {
+		t.Fatalf("expected another probe to be allowed, got %v", err)
+	}
+}
@@ -3,17 +3,41 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/KillianMeersman/chaperone/pkg/datastructures/eviction"
 	"github.com/KillianMeersman/chaperone/pkg/datastructures/kvstore"
 	"github.com/KillianMeersman/chaperone/pkg/log"
 )
 
+// Header added to responses served by the NiceClient, indicating how the cache was used.
+const CacheStatusHeader = "X-Chaperone-Cache"
+
+const (
+	// The response was served from the cache without contacting the upstream server.
+	CacheStatusHit = "HIT"
+	// The response was fetched from the upstream server.
+	CacheStatusMiss = "MISS"
+	// The cached response was stale, but the upstream server confirmed it is still valid.
+	CacheStatusRevalidated = "REVALIDATED"
+	// A stale cached response was served, either while revalidating it in the background or because the upstream server failed.
+	CacheStatusStale = "STALE"
+	// The response was shared from an identical request that was in flight at the same time.
+	CacheStatusCollapsed = "COLLAPSED"
+)
+
+// Default duration that expired responses with validators are kept around for revalidation.
+const DefaultStaleRetention = 24 * time.Hour
+
 type CachedResponse struct {
 	URL             string
 	StatusCode      int
@@ -21,6 +45,82 @@ type CachedResponse struct {
 	FreshUntil      time.Time
 	ResponseHeaders http.Header
 	RequestHeaders  http.Header
+	// How long after FreshUntil the response may be served while it is revalidated in the background.
+	StaleWhileRevalidate time.Duration
+	// How long after FreshUntil the response may be served when the upstream server fails.
+	StaleIfError time.Duration
+	// Path of the file holding the body, set instead of Body by stores that keep bodies on disk.
+	BodyFile string `json:"-"`
+	// Size of the body in BodyFile.
+	BodySize int64 `json:"-"`
+	// Hex encoded sha256 hash of the body in BodyFile.
+	BodyHash string `json:"-"`
+	// BodyFile, opened by the store when the response was looked up so that the body can be read even if the store
+	// removes the file in the meantime. Handed out by the first BodyReadCloser.
+	openBodyFile *os.File
+}
+
+// Return true if the cached response can be served without revalidating it.
+func (c *CachedResponse) IsFresh() bool {
+	return time.Now().Before(c.FreshUntil)
+}
+
+// Return true if the stale response may be served while it is revalidated in the background.
+func (c *CachedResponse) CanServeWhileRevalidating() bool {
+	return time.Now().Before(c.FreshUntil.Add(c.StaleWhileRevalidate))
+}
+
+// Return true if the stale response may be served because the upstream server failed.
+func (c *CachedResponse) CanServeOnError() bool {
+	return time.Now().Before(c.FreshUntil.Add(c.StaleIfError))
+}
+
+// Get the cache key of the response for the provided request.
+func (c *CachedResponse) CacheKey(req *http.Request) string {
+	return GetCacheKey(GetVaryHeaderNames(&http.Response{Header: c.ResponseHeaders}), req)
+}
+
+// Return true if the response has an ETag or Last-Modified validator,
+// meaning it can be revalidated with a conditional request once it is stale.
+func (c *CachedResponse) CanRevalidate() bool {
+	return canRevalidate(c.ResponseHeaders)
+}
+
+// Return true if the response headers have an ETag or Last-Modified validator.
+func canRevalidate(header http.Header) bool {
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+// Add If-None-Match and If-Modified-Since headers to the request, based on the cached response's validators.
+func (c *CachedResponse) AddConditionalHeaders(req *http.Request) {
+	if etag := c.ResponseHeaders.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := c.ResponseHeaders.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// Build a response for the provided request from the cached response.
+// The cache status is set in the X-Chaperone-Cache header.
+func (c *CachedResponse) Response(req *http.Request, cacheStatus string) *http.Response {
+	header := c.ResponseHeaders.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set(CacheStatusHeader, cacheStatus)
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", c.StatusCode, http.StatusText(c.StatusCode)),
+		StatusCode:    c.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          c.BodyReadCloser(),
+		ContentLength: c.bodySize(),
+		Request:       req,
+	}
 }
 
 // Return true if the cached response can be used for the provided request.
@@ -40,71 +140,314 @@ func (c *CachedResponse) IsValidForRequest(req *http.Request) bool {
 	return true
 }
 
+// Approximate number of bytes the cached response occupies, including headers.
+func (c *CachedResponse) Size() int64 {
+	size := int64(len(c.URL)) + c.bodySize()
+	for _, header := range []http.Header{c.ResponseHeaders, c.RequestHeaders} {
+		for name, values := range header {
+			size += int64(len(name))
+			for _, value := range values {
+				size += int64(len(value))
+			}
+		}
+	}
+	return size
+}
+
+func (c *CachedResponse) bodySize() int64 {
+	if c.Body == nil && c.BodyFile != "" {
+		return c.BodySize
+	}
+	return int64(len(c.Body))
+}
+
+// A ReadCloser that reads from one source and closes another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// A reader that always returns the same error.
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
 // Returns a ReadCloser for the cached response's body.
-// Closing this does nothing.
+// Bodies kept on disk are streamed from their file, closing the ReadCloser closes the file.
+// Otherwise, closing this does nothing.
 func (c *CachedResponse) BodyReadCloser() io.ReadCloser {
+	if c.openBodyFile != nil {
+		file := c.openBodyFile
+		c.openBodyFile = nil
+		return file
+	}
+	if c.Body == nil && c.BodyFile != "" {
+		file, err := os.Open(c.BodyFile)
+		if err != nil {
+			return io.NopCloser(&errorReader{err})
+		}
+		return file
+	}
+
 	return io.NopCloser(bytes.NewReader(c.Body))
 }
 
+// Release the body file opened by the store, unless it was handed out by BodyReadCloser.
+// Responses looked up in a store that keeps bodies on disk should be closed when they aren't served.
+func (c *CachedResponse) Close() error {
+	if c == nil || c.openBodyFile == nil {
+		return nil
+	}
+	file := c.openBodyFile
+	c.openBodyFile = nil
+	return file.Close()
+}
+
+// Caching parameters for a single response.
+type CacheOptions struct {
+	MinTTL     time.Duration
+	MaxTTL     time.Duration
+	DefaultTTL time.Duration
+	// Minimum durations stale responses may be served, regardless of the response's Cache-Control header.
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+}
+
+// Interval at which the HTTPCache releases the space of expired responses.
+const CacheSweepInterval = time.Minute
+
+// Size and expiry of a stored response.
+type cacheEntry struct {
+	size      int64
+	expiresAt time.Time
+	// Tells the entry apart from later entries under the same cache key.
+	seq uint64
+	// True while the response is being written to the store.
+	pending bool
+}
+
+// Statistics of a HTTPCache.
+type CacheStats struct {
+	Entries   int    `json:"entries"`
+	Size      int64  `json:"size"`
+	MaxSize   int64  `json:"max_size"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
 // A HTTP cache caches responses according to their caching headers.
+// When storing a response would exceed the maximum size, responses are evicted according to the eviction policy.
 type HTTPCache struct {
 	// Stores the actual cached responses per cache-key (url + sorted vary headers).
 	cachedResponses kvstore.KVStore[string, *CachedResponse]
 	// Stores which headers to use in the cache keys per url.
 	// This is based on the Vary header.
 	urlVaryHeaders kvstore.KVStore[string, []string]
-	currentSize    int
-	maxSize        int
-	IgnoreHeaders  bool
+	// Size and expiry of the stored responses per cache-key, guarded by lock.
+	entries map[string]cacheEntry
+	// Nil if the store bounds its own size.
+	eviction      eviction.Policy[string]
+	stats         CacheStats
+	lock          *sync.Mutex
+	currentSize   int64
+	maxSize       int64
+	seq           uint64
+	IgnoreHeaders bool
+	// How long responses with an ETag or Last-Modified validator are kept after they expire,
+	// so that they can be revalidated instead of downloaded again.
+	StaleRetention time.Duration
 }
 
-func NewHTTPCache(maxSize int, responses kvstore.KVStore[string, *CachedResponse], varyHeaders kvstore.KVStore[string, []string]) *HTTPCache {
+// Create a new HTTPCache that holds at most maxSize bytes of responses.
+// The space of expired responses is released periodically until the context is cancelled.
+// If the eviction policy is nil, the store bounds its own size: responses aren't tracked or evicted,
+// and maxSize only bounds the size of a single response.
+func NewHTTPCache(ctx context.Context, maxSize int, policy eviction.Policy[string], responses kvstore.KVStore[string, *CachedResponse], varyHeaders kvstore.KVStore[string, []string]) *HTTPCache {
 	cache := &HTTPCache{
 		cachedResponses: responses,
 		urlVaryHeaders:  varyHeaders,
+		entries:         make(map[string]cacheEntry),
+		eviction:        policy,
+		lock:            &sync.Mutex{},
 		currentSize:     0,
-		maxSize:         maxSize,
+		maxSize:         int64(maxSize),
 		IgnoreHeaders:   false,
+		StaleRetention:  DefaultStaleRetention,
 	}
 
+	go cache.sweep(ctx)
+
 	return cache
 }
 
+// Create a new in-memory HTTPCache with an LRU eviction policy.
 func NewMemoryHTTPCache(ctx context.Context, maxSize int) *HTTPCache {
-	return NewHTTPCache(maxSize, kvstore.NewMemoryKVStore[string, *CachedResponse](ctx), kvstore.NewMemoryKVStore[string, []string](ctx))
+	return NewHTTPCache(ctx, maxSize, eviction.NewLRU[string](), kvstore.NewMemoryKVStore[string, *CachedResponse](ctx), kvstore.NewMemoryKVStore[string, []string](ctx))
+}
+
+// Periodically release the space of expired responses.
+func (c *HTTPCache) sweep(ctx context.Context) {
+	ticker := time.NewTicker(CacheSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.lock.Lock()
+			for key, entry := range c.entries {
+				if now.After(entry.expiresAt) {
+					c.removeEntry(key)
+				}
+			}
+			c.lock.Unlock()
+		}
+	}
+}
+
+// Stop tracking the entry under the cache key. The lock must be held.
+func (c *HTTPCache) removeEntry(key string) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	c.currentSize -= entry.size
+	delete(c.entries, key)
+	c.eviction.Remove(key)
+}
+
+// Reserve space for an entry of the provided size, evicting other entries if necessary.
+// Returns the cache keys of the evicted entries, which must be deleted from the store, the sequence number of the entry
+// and false if the entry doesn't fit in the cache at all. The entry is pending until finishStore is called.
+func (c *HTTPCache) reserve(key string, size int64, expiresAt time.Time) ([]string, uint64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if size > c.maxSize {
+		return nil, 0, false
+	}
+	if c.eviction == nil {
+		return nil, 0, true
+	}
+
+	// The entry replaces any previous entry under the same key.
+	c.removeEntry(key)
+
+	victims := make([]string, 0)
+	for c.currentSize+size > c.maxSize {
+		victim, ok := c.eviction.Victim()
+		if !ok {
+			break
+		}
+		c.removeEntry(victim)
+		c.stats.Evictions++
+		victims = append(victims, victim)
+	}
+
+	c.seq++
+	c.entries[key] = cacheEntry{
+		size:      size,
+		expiresAt: expiresAt,
+		seq:       c.seq,
+		pending:   true,
+	}
+	c.eviction.Add(key, size)
+	c.currentSize += size
+
+	return victims, c.seq, true
+}
+
+// Mark the entry reserved with the sequence number as stored, or stop tracking it if storing the response failed.
+func (c *HTTPCache) finishStore(key string, seq uint64, stored bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || entry.seq != seq {
+		return
+	}
+	if !stored {
+		c.removeEntry(key)
+		return
+	}
+	entry.pending = false
+	c.entries[key] = entry
+}
+
+// Track responses that are in the store already, e.g. after a restart, evicting responses that don't fit.
+// The responses closest to expiring are tracked first, so that they're the first to be evicted.
+func (c *HTTPCache) track(ctx context.Context, entries map[string]cacheEntry) error {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return entries[a].expiresAt.Compare(entries[b].expiresAt)
+	})
+
+	for _, key := range keys {
+		victims, seq, ok := c.reserve(key, entries[key].size, entries[key].expiresAt)
+		if ok {
+			c.finishStore(key, seq, true)
+		} else {
+			victims = append(victims, key)
+		}
+		for _, victim := range victims {
+			err := c.cachedResponses.Delete(ctx, victim)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Get the cache's statistics.
+func (c *HTTPCache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Size = c.currentSize
+	stats.MaxSize = c.maxSize
+	return stats
 }
 
 // Cache the response and return a ReadCloser so that the body can be re-read.
 // If re-using the response after caching, ensure the response body is replaced with the returned ReadCloser. e.g.
-// `res.Body, err = cache.Cache(ctx, url, res, ...)`
-func (c *HTTPCache) Cache(ctx context.Context, url string, res *http.Response, minTTL, maxTTL, defaultTTL time.Duration) (io.ReadCloser, error) {
-	ttl := defaultTTL
-	var err error
+// `res.Body, err = cache.Cache(ctx, url, res, options)`
+// The response body is closed if an error is returned.
+func (c *HTTPCache) Cache(ctx context.Context, url string, res *http.Response, options CacheOptions) (body io.ReadCloser, err error) {
+	defer func() {
+		if err != nil {
+			res.Body.Close()
+		}
+	}()
 
 	logger, _ := log.FromContext(ctx)
 	logger = logger.With("url", url)
 
-	// If the cache is configured to ignore caching headers,
-	// always cache with the default ttl.
-	if !c.IgnoreHeaders {
-		ttl, err = GetResponseCacheDuration(res, defaultTTL)
-		if err != nil {
-			return nil, err
-		}
+	// Not modified and partial responses can't be served to other requests.
+	if res.StatusCode == http.StatusNotModified || res.StatusCode == http.StatusPartialContent {
+		return res.Body, nil
 	}
 
-	// Clamp the ttl according to the responses's cache headers
-	// to the provided min. and maximum.
-	if ttl < minTTL {
-		logger.Debug("cache ttl too low, clamping to minimum")
-		ttl = minTTL
-	} else if ttl > maxTTL {
-		logger.Debug("cache ttl to high, clamping to maximum")
-		ttl = maxTTL
+	policy, err := c.responsePolicy(logger, res, options)
+	if err != nil {
+		return nil, err
 	}
+	ttl := max(policy.FreshUntil, 0)
 
-	// If not allowed to cache, return early.
-	if ttl <= 0 {
+	// Responses that are stale right away are still cached if they can be revalidated or served stale, unless they may not be stored.
+	if ttl <= 0 && (policy.NoStore || (!canRevalidate(res.Header) && policy.StaleWhileRevalidate <= 0 && policy.StaleIfError <= 0)) {
 		logger.Debug("not allowed to cache")
 		return res.Body, nil
 	}
@@ -114,13 +457,10 @@ func (c *HTTPCache) Cache(ctx context.Context, url string, res *http.Response, m
 
 	logger = logger.With("vary_headers", strings.Join(varyHeaders, ","))
 
-	// Store the headers upon which responses to the request's url vary.
-	// We compute cache keys based on this value.
-	c.urlVaryHeaders.Store(ctx, url, varyHeaders, ttl)
 	cacheKey := GetCacheKey(varyHeaders, res.Request)
 
 	// Check response size, assume the max allowed size unless specified by the Content-Length header.
-	contentLength := int64(c.maxSize)
+	contentLength := c.maxSize
 	if contentLengthHeader := res.Header.Get("Content-Length"); contentLengthHeader != "" {
 		contentLength, err = strconv.ParseInt(contentLengthHeader, 10, 64)
 		if err != nil {
@@ -129,61 +469,396 @@ func (c *HTTPCache) Cache(ctx context.Context, url string, res *http.Response, m
 
 		logger = logger.With("size", fmt.Sprintf("%d", contentLength))
 
-		if c.currentSize+int(contentLength) > c.maxSize {
-			logger.Warning("caching response would exceed max size, not caching")
+		if contentLength > c.maxSize {
+			logger.Warning("response exceeds max cache size, not caching")
 			return res.Body, nil
 		}
 	}
 
+	cached := &CachedResponse{
+		URL:                  url,
+		StatusCode:           res.StatusCode,
+		FreshUntil:           time.Now().Add(ttl),
+		ResponseHeaders:      res.Header.Clone(),
+		RequestHeaders:       varyRequestHeaders(varyHeaders, res.Request.Header),
+		StaleWhileRevalidate: policy.StaleWhileRevalidate,
+		StaleIfError:         policy.StaleIfError,
+	}
+
+	// Stores that keep bodies in files get the body as it's read, rather than holding it in memory.
+	if files, ok := c.cachedResponses.(bodyFileStore); ok {
+		file, err := files.createBodyFile()
+		if err != nil {
+			return nil, err
+		}
+		return &spoolingBody{
+			ReadCloser: res.Body,
+			file:       file,
+			limit:      contentLength,
+			store: func(file *bodyFile) string {
+				cached.BodyFile = file.file.Name()
+				cached.BodySize = file.size
+				cached.BodyHash = file.sum()
+				logger.With("ttl_seconds", fmt.Sprint(ttl.Seconds()), "size", fmt.Sprint(file.size)).Debug("caching response")
+				if err := c.store(ctx, url, varyHeaders, cacheKey, cached, ttl); err != nil {
+					logger.Error(err.Error())
+					return ""
+				}
+				return files.bodyPath(cached.BodyHash)
+			},
+			logger: logger,
+		}, nil
+	}
+
 	// Read response body to be cached until at most the content length (prevents certain DoS attacks).
 	limitedBody := io.LimitReader(res.Body, contentLength+1)
 	data, err := io.ReadAll(limitedBody)
 	if err != nil {
 		return nil, err
 	}
-	body := io.NopCloser(io.MultiReader(bytes.NewReader(data), res.Body))
+	body = &readCloser{io.MultiReader(bytes.NewReader(data), res.Body), res.Body}
 
 	logger = logger.With("size", fmt.Sprintf("%d", len(data)))
 
-	if len(data) > int(contentLength) {
+	if int64(len(data)) > contentLength {
 		logger.Warning("response larger than Content-Length, not caching")
 		return body, nil
-	} else if c.currentSize+len(data) > c.maxSize {
-		logger.Warning("caching response would exceed max size, not caching")
-		return body, nil
 	}
 
 	logger.With("ttl_seconds", fmt.Sprint(ttl.Seconds())).Debug("caching response")
-	c.cachedResponses.Store(ctx, cacheKey, &CachedResponse{
-		StatusCode:      res.StatusCode,
-		Body:            data,
-		ResponseHeaders: res.Header,
-		RequestHeaders:  res.Request.Header,
-	}, ttl)
-	c.currentSize += len(data)
+	cached.Body = data
+	err = c.store(ctx, url, varyHeaders, cacheKey, cached, ttl)
+	if err != nil {
+		return nil, err
+	}
 
 	return body, nil
 }
 
+// A store of cached responses that keeps bodies in files, see DiskResponseStore.createBodyFile.
+type bodyFileStore interface {
+	createBodyFile() (*bodyFile, error)
+	bodyPath(hash string) string
+}
+
+// A response body that is written to a body file as it's read, the response is cached once the body is read entirely.
+type spoolingBody struct {
+	io.ReadCloser
+	file *bodyFile
+	// Maximum size of the body, larger bodies aren't cached.
+	limit int64
+	// Cache the response with the complete body file, returns the path the body is kept at.
+	store    func(file *bodyFile) string
+	logger   *log.Logger
+	finished bool
+	// Path of the stored body, once the response is cached.
+	storedPath string
+}
+
+// Cache the response if the body file is complete, and remove the file unless the store took it over.
+func (b *spoolingBody) finish(complete bool) {
+	if b.finished {
+		return
+	}
+	b.finished = true
+	if complete && b.file.file.Close() == nil {
+		b.storedPath = b.store(b.file)
+	}
+	b.file.remove()
+}
+
+func (b *spoolingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.finished {
+		return n, err
+	}
+
+	if b.file.size+int64(n) > b.limit {
+		b.logger.Warning("response larger than Content-Length or the max cache size, not caching")
+		b.finish(false)
+		return n, err
+	}
+	if _, writeErr := b.file.Write(p[:n]); writeErr != nil {
+		b.logger.Error(writeErr.Error())
+		b.finish(false)
+	} else if errors.Is(err, io.EOF) {
+		b.finish(true)
+	} else if err != nil {
+		b.finish(false)
+	}
+	return n, err
+}
+
+// Get the path of the stored body once it's read entirely, empty if the response wasn't cached.
+// The file may be removed when the response is evicted.
+func (b *spoolingBody) spooledFile() string {
+	return b.storedPath
+}
+
+func (b *spoolingBody) Close() error {
+	// Closing before the end of the body leaves it incomplete.
+	b.finish(false)
+	return b.ReadCloser.Close()
+}
+
+// Get the request headers named in the response's Vary header, the only ones needed to match it to later requests.
+// Other request headers aren't stored, as they may hold credentials.
+func varyRequestHeaders(varyHeaders []string, header http.Header) http.Header {
+	stored := make(http.Header)
+	for _, name := range varyHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			stored[http.CanonicalHeaderKey(name)] = slices.Clone(values)
+		}
+	}
+	return stored
+}
+
+// Compute the caching policy of the response.
+// The ttl is clamped to the provided minimum and maximum, the stale durations are at least those provided
+// unless the response may not be served stale.
+func (c *HTTPCache) responsePolicy(logger *log.Logger, res *http.Response, options CacheOptions) (CachePolicy, error) {
+	policy := CachePolicy{
+		FreshUntil:  options.DefaultTTL,
+		CanUseStale: true,
+	}
+	var err error
+
+	// If the cache is configured to ignore caching headers,
+	// always cache with the default ttl.
+	if !c.IgnoreHeaders {
+		policy, err = GetResponseCachePolicy(res, options.DefaultTTL)
+		if err != nil {
+			return CachePolicy{}, err
+		}
+	}
+
+	// Clamp the ttl according to the responses's cache headers
+	// to the provided min. and maximum.
+	if policy.FreshUntil < options.MinTTL {
+		logger.Debug("cache ttl too low, clamping to minimum")
+		policy.FreshUntil = options.MinTTL
+	} else if policy.FreshUntil > options.MaxTTL {
+		logger.Debug("cache ttl to high, clamping to maximum")
+		policy.FreshUntil = options.MaxTTL
+	}
+
+	// Responses with must-revalidate or proxy-revalidate are never served stale, whatever the overrides.
+	if policy.CanUseStale {
+		policy.StaleWhileRevalidate = max(policy.StaleWhileRevalidate, options.StaleWhileRevalidate)
+		policy.StaleIfError = max(policy.StaleIfError, options.StaleIfError)
+	}
+
+	return policy, nil
+}
+
+// Store the cached response under the cache key, together with the headers upon which responses to the url vary.
+// Responses that can be revalidated are retained for StaleRetention after they expire,
+// responses that may be served stale are retained for as long as they may be served.
+func (c *HTTPCache) store(ctx context.Context, url string, varyHeaders []string, cacheKey string, cached *CachedResponse, ttl time.Duration) error {
+	retention := max(cached.StaleWhileRevalidate, cached.StaleIfError)
+	if cached.CanRevalidate() {
+		retention = max(retention, c.StaleRetention)
+	}
+	storeTTL := ttl + retention
+	// A ttl <= 0 would store the response forever.
+	if storeTTL <= 0 {
+		return nil
+	}
+
+	logger, _ := log.FromContext(ctx)
+
+	victims, seq, ok := c.reserve(cacheKey, cached.Size(), time.Now().Add(storeTTL))
+	if !ok {
+		logger.With("url", url).Warning("response exceeds max cache size, not caching")
+		return nil
+	}
+	// The entry is pending until the response is in the store, so that a Get that misses it in the meantime doesn't release its space.
+	var err error
+	defer func() {
+		c.finishStore(cacheKey, seq, err == nil)
+	}()
+
+	for _, victim := range victims {
+		logger.With("cache_key", victim).Debug("evicting cached response")
+		err = c.cachedResponses.Delete(ctx, victim)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Store the headers upon which responses to the request's url vary.
+	// We compute cache keys based on this value.
+	err = c.urlVaryHeaders.Store(ctx, url, varyHeaders, storeTTL)
+	if err != nil {
+		return err
+	}
+
+	err = c.cachedResponses.Store(ctx, cacheKey, cached, storeTTL)
+	return err
+}
+
+// Update a stale cached response after the upstream server answered a conditional request with 304 Not Modified.
+// The headers of the 304 response replace the cached ones and the freshness is recomputed, the body is kept.
+// Returns the updated cached response.
+func (c *HTTPCache) Revalidate(ctx context.Context, cached *CachedResponse, res *http.Response, options CacheOptions) (*CachedResponse, error) {
+	logger, _ := log.FromContext(ctx)
+	logger = logger.With("url", cached.URL)
+
+	header := cached.ResponseHeaders.Clone()
+	for name, values := range res.Header {
+		// The 304 response doesn't describe the body, keep the original framing headers.
+		if name == "Content-Length" || name == "Transfer-Encoding" {
+			continue
+		}
+		header[name] = values
+	}
+
+	updated := &CachedResponse{
+		URL:             cached.URL,
+		StatusCode:      cached.StatusCode,
+		Body:            cached.Body,
+		BodyFile:        cached.BodyFile,
+		BodySize:        cached.BodySize,
+		BodyHash:        cached.BodyHash,
+		ResponseHeaders: header,
+		RequestHeaders:  cached.RequestHeaders,
+	}
+
+	policy, err := c.responsePolicy(logger, &http.Response{
+		StatusCode: cached.StatusCode,
+		Header:     header,
+	}, options)
+	if err != nil {
+		return nil, err
+	}
+	ttl := policy.FreshUntil
+	updated.FreshUntil = time.Now().Add(ttl)
+	updated.StaleWhileRevalidate = policy.StaleWhileRevalidate
+	updated.StaleIfError = policy.StaleIfError
+
+	// The cache key is computed from the original request's headers, as the revalidating request carries
+	// conditional headers of its own.
+	varyHeaders := GetVaryHeaderNames(&http.Response{Header: header})
+	cacheKey := GetCacheKey(varyHeaders, &http.Request{
+		URL:    res.Request.URL,
+		Header: cached.RequestHeaders,
+	})
+
+	logger.With("ttl_seconds", fmt.Sprint(ttl.Seconds())).Debug("revalidated cached response")
+	err = c.store(ctx, cached.URL, varyHeaders, cacheKey, updated, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	// The store may have removed the body file since the stale response was looked up, keep reading the opened one.
+	updated.openBodyFile, cached.openBodyFile = cached.openBodyFile, nil
+
+	return updated, nil
+}
+
+// Get the cache key for the request, based on the headers upon which responses at the request url vary.
+func (c *HTTPCache) CacheKey(ctx context.Context, req *http.Request) (string, error) {
+	varyHeaders, _, err := c.urlVaryHeaders.Get(ctx, req.URL.String())
+	if err != nil {
+		return "", err
+	}
+
+	return GetCacheKey(varyHeaders, req), nil
+}
+
 // Get the cached response for the given url. Returns nil if no response was cached.
+// The returned response may be stale, use CachedResponse.IsFresh to check.
 func (c *HTTPCache) Get(ctx context.Context, req *http.Request) (*CachedResponse, error) {
-	// Get the headers upon which responses at the request url vary.
-	varyHeaders, _, err := c.urlVaryHeaders.Get(ctx, req.URL.String())
+	cacheKey, err := c.CacheKey(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
 	logger, _ := log.FromContext(ctx)
-	logger = logger.With("url", req.URL.String(), "vary_headers", strings.Join(varyHeaders, ","))
+	logger = logger.With("url", req.URL.String(), "cache_key", cacheKey)
 
-	cacheKey := GetCacheKey(varyHeaders, req)
+	c.lock.Lock()
+	entry, tracked := c.entries[cacheKey]
+	c.lock.Unlock()
 
 	data, exists, err := c.cachedResponses.Get(ctx, cacheKey)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	if exists {
 		logger.Debug("found cached response")
+		c.stats.Hits++
+		if c.eviction != nil {
+			c.eviction.Touch(cacheKey)
+		}
 		return data, err
 	}
 
 	logger.Debug("no cached response")
+	c.stats.Misses++
+	// The store dropped the response, release its space.
+	// A response that was still being stored when the lookup started may not have been written yet, and a response stored
+	// since is another entry.
+	if current, ok := c.entries[cacheKey]; err == nil && tracked && !entry.pending && ok && current.seq == entry.seq {
+		c.removeEntry(cacheKey)
+	}
 	return nil, err
 }
+
+// Remove the cached responses for the provided url, all variants included.
+// If prefix is true, the responses for all urls starting with the provided url are removed.
+// Returns the number of removed responses.
+func (c *HTTPCache) Purge(ctx context.Context, url string, prefix bool) (int, error) {
+	keyPrefix := url
+	if !prefix {
+		// Cache keys consist of the url, a colon and the vary header values.
+		keyPrefix = url + ":"
+	}
+
+	keys, err := c.cachedResponses.Keys(ctx, keyPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, key := range keys {
+		if !prefix {
+			// Skip the responses for other urls that happen to start with the same prefix.
+			cached, exists, err := c.cachedResponses.Get(ctx, key)
+			if err != nil {
+				return purged, err
+			}
+			cached.Close()
+			if !exists || cached.URL != url {
+				continue
+			}
+		}
+
+		err = c.cachedResponses.Delete(ctx, key)
+		if err != nil {
+			return purged, err
+		}
+
+		c.lock.Lock()
+		c.removeEntry(key)
+		c.lock.Unlock()
+		purged++
+	}
+
+	varyURLs := []string{url}
+	if prefix {
+		varyURLs, err = c.urlVaryHeaders.Keys(ctx, url)
+		if err != nil {
+			return purged, err
+		}
+	}
+	for _, varyURL := range varyURLs {
+		err = c.urlVaryHeaders.Delete(ctx, varyURL)
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,426 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/datastructures/eviction"
+	"github.com/KillianMeersman/chaperone/pkg/datastructures/kvstore"
+	"github.com/KillianMeersman/chaperone/pkg/log"
+)
+
+// Interval at which the DiskResponseStore writes its index to disk.
+const DiskIndexFlushInterval = 10 * time.Second
+
+// Index entry of a response stored on disk.
+type diskIndexEntry struct {
+	// The cached response, without its body.
+	Response *CachedResponse
+	BodyHash string
+	BodySize int64
+	// Zero if the response never expires.
+	ExpiresAt time.Time
+}
+
+func (e *diskIndexEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && now.After(e.ExpiresAt)
+}
+
+// A KVStore for cached responses that keeps bodies on disk, so that the cache survives restarts.
+// Bodies are stored content-addressed (by their sha256 hash), identical bodies are only stored once.
+// A small index of the cached responses is kept in memory and written to disk periodically.
+// The store doesn't evict responses itself, see NewDiskHTTPCache.
+type DiskResponseStore struct {
+	dir   string
+	index map[string]*diskIndexEntry
+	// Number of index entries per body hash.
+	references map[string]int
+	dirty      bool
+	lock       *sync.Mutex
+	// Serializes writes of the index.
+	flushLock *sync.Mutex
+}
+
+// Create a DiskResponseStore in the provided directory, loading the responses stored there before.
+// Expired responses are swept periodically until the context is cancelled, after which the index is written a last time.
+func NewDiskResponseStore(ctx context.Context, dir string) (*DiskResponseStore, error) {
+	store := &DiskResponseStore{
+		dir:        dir,
+		index:      make(map[string]*diskIndexEntry),
+		references: make(map[string]int),
+		lock:       &sync.Mutex{},
+		flushLock:  &sync.Mutex{},
+	}
+
+	err := os.MkdirAll(store.bodiesDir(), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.load()
+	if err != nil {
+		return nil, err
+	}
+
+	go store.run(ctx)
+
+	return store, nil
+}
+
+func (s *DiskResponseStore) bodiesDir() string {
+	return filepath.Join(s.dir, "bodies")
+}
+
+func (s *DiskResponseStore) indexPath() string {
+	return filepath.Join(s.dir, "index.json")
+}
+
+func (s *DiskResponseStore) bodyPath(hash string) string {
+	return filepath.Join(s.bodiesDir(), hash)
+}
+
+// Load the index from disk, dropping expired responses and responses whose body is missing.
+// Body files that aren't referenced by the index are removed.
+func (s *DiskResponseStore) load() error {
+	data, err := os.ReadFile(s.indexPath())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	index := make(map[string]*diskIndexEntry)
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &index)
+		if err != nil {
+			log.DefaultLogger.Warning("invalid cache index, starting with an empty cache", "path", s.indexPath(), "error", err.Error())
+			index = make(map[string]*diskIndexEntry)
+		}
+	}
+
+	now := time.Now()
+	for key, entry := range index {
+		if entry.expired(now) || entry.Response == nil {
+			continue
+		}
+		if _, err := os.Stat(s.bodyPath(entry.BodyHash)); err != nil {
+			continue
+		}
+		s.addEntry(key, entry)
+	}
+
+	files, err := os.ReadDir(s.bodiesDir())
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if s.references[file.Name()] == 0 {
+			os.Remove(filepath.Join(s.bodiesDir(), file.Name()))
+		}
+	}
+
+	s.dirty = true
+
+	return nil
+}
+
+// Periodically sweep expired responses and write the index to disk.
+func (s *DiskResponseStore) run(ctx context.Context) {
+	flushTicker := time.NewTicker(DiskIndexFlushInterval)
+	defer flushTicker.Stop()
+	sweepTicker := time.NewTicker(CacheSweepInterval)
+	defer sweepTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Flush(); err != nil {
+				log.DefaultLogger.Error(err.Error(), "path", s.indexPath())
+			}
+			return
+		case now := <-sweepTicker.C:
+			s.lock.Lock()
+			for key, entry := range s.index {
+				if entry.expired(now) {
+					s.removeEntry(key)
+				}
+			}
+			s.lock.Unlock()
+		case <-flushTicker.C:
+			if err := s.Flush(); err != nil {
+				log.DefaultLogger.Error(err.Error(), "path", s.indexPath())
+			}
+		}
+	}
+}
+
+// Write the index to disk if it changed since the last flush.
+func (s *DiskResponseStore) Flush() error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	s.lock.Lock()
+	if !s.dirty {
+		s.lock.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.index)
+	s.dirty = false
+	s.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return kvstore.WriteFileAtomic(s.indexPath(), data)
+}
+
+// Add an entry to the index. The lock must be held.
+func (s *DiskResponseStore) addEntry(key string, entry *diskIndexEntry) {
+	s.index[key] = entry
+	s.references[entry.BodyHash]++
+	s.dirty = true
+}
+
+// Remove an entry from the index, deleting its body file if no other entry references it. The lock must be held.
+func (s *DiskResponseStore) removeEntry(key string) {
+	entry, ok := s.index[key]
+	if !ok {
+		return
+	}
+
+	delete(s.index, key)
+	s.references[entry.BodyHash]--
+	if s.references[entry.BodyHash] <= 0 {
+		delete(s.references, entry.BodyHash)
+		err := os.Remove(s.bodyPath(entry.BodyHash))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.DefaultLogger.Error(err.Error())
+		}
+	}
+	s.dirty = true
+}
+
+// Get the size and expiry of every stored response.
+func (s *DiskResponseStore) entries() map[string]cacheEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries := make(map[string]cacheEntry, len(s.index))
+	for key, entry := range s.index {
+		response := *entry.Response
+		response.BodyFile = s.bodyPath(entry.BodyHash)
+		response.BodySize = entry.BodySize
+		entries[key] = cacheEntry{size: response.Size(), expiresAt: entry.ExpiresAt}
+	}
+	return entries
+}
+
+// Write the body to its content-addressed file, unless it exists already.
+func (s *DiskResponseStore) writeBody(hash string, body []byte) error {
+	path := s.bodyPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	return kvstore.WriteFileAtomic(path, body)
+}
+
+// A new body file in the store, that a response body is written to as it's read and hashed as it's written.
+type bodyFile struct {
+	file *os.File
+	hash hash.Hash
+	size int64
+}
+
+func (f *bodyFile) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.hash.Write(p[:n])
+	f.size += int64(n)
+	return n, err
+}
+
+// Get the hex encoded sha256 hash of the body written so far.
+func (f *bodyFile) sum() string {
+	return hex.EncodeToString(f.hash.Sum(nil))
+}
+
+// Close the file and remove it, unless the store took it over.
+func (f *bodyFile) remove() {
+	f.file.Close()
+	os.Remove(f.file.Name())
+}
+
+// Create a body file that a response body can be written to as it's read, instead of holding it in memory.
+// Once it's complete, store a CachedResponse with the file's path, size and hash to add the body to the store.
+func (s *DiskResponseStore) createBodyFile() (*bodyFile, error) {
+	file, err := os.CreateTemp(s.bodiesDir(), "body.tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &bodyFile{file: file, hash: sha256.New()}, nil
+}
+
+// Move a complete body file to its content-addressed path, or remove it if the body is stored already.
+// The lock must be held.
+func (s *DiskResponseStore) adoptBody(path string, hash string) error {
+	if filepath.Dir(path) != s.bodiesDir() {
+		return fmt.Errorf("body file %s is not in %s", path, s.bodiesDir())
+	}
+	if _, err := os.Stat(s.bodyPath(hash)); err == nil {
+		return os.Remove(path)
+	}
+	return os.Rename(path, s.bodyPath(hash))
+}
+
+func (s *DiskResponseStore) Store(ctx context.Context, key string, value *CachedResponse, ttl time.Duration) error {
+	entry := &diskIndexEntry{}
+	if ttl > 0 {
+		entry.ExpiresAt = time.Now().Add(ttl)
+	}
+
+	// Keep the body out of the index.
+	response := *value
+	response.Body = nil
+	response.BodyFile = ""
+	response.BodySize = 0
+	response.BodyHash = ""
+	response.openBodyFile = nil
+	entry.Response = &response
+
+	if value.Body != nil || value.BodyFile == "" {
+		hash := sha256.Sum256(value.Body)
+		entry.BodyHash = hex.EncodeToString(hash[:])
+		entry.BodySize = int64(len(value.Body))
+
+		// Write the body before taking the lock, so that lookups don't wait on it.
+		err := s.writeBody(entry.BodyHash, value.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if value.Body == nil && value.BodyFile != "" {
+		entry.BodyHash = value.BodyHash
+		entry.BodySize = value.BodySize
+		if value.BodyFile != s.bodyPath(entry.BodyHash) {
+			// A body file created with createBodyFile.
+			err := s.adoptBody(value.BodyFile, entry.BodyHash)
+			if err != nil {
+				return err
+			}
+		} else if s.references[entry.BodyHash] == 0 {
+			// The body was read from this store, e.g. when revalidating, and was removed since.
+			return nil
+		}
+	} else if _, err := os.Stat(s.bodyPath(entry.BodyHash)); err != nil {
+		// Another entry with the same body was removed since the body was written, taking the file with it.
+		err = s.writeBody(entry.BodyHash, value.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	if previous, ok := s.index[key]; ok && previous.BodyHash == entry.BodyHash {
+		// Same body, only replace the metadata so that the body isn't removed.
+		s.index[key] = entry
+		s.dirty = true
+		return nil
+	}
+
+	s.removeEntry(key)
+	s.addEntry(key, entry)
+
+	return nil
+}
+
+func (s *DiskResponseStore) Get(ctx context.Context, key string) (*CachedResponse, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.index[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if entry.expired(time.Now()) {
+		s.removeEntry(key)
+		return nil, false, nil
+	}
+
+	// Open the body while holding the lock, so that it can still be read if the entry is removed before it's served.
+	file, err := os.Open(s.bodyPath(entry.BodyHash))
+	if errors.Is(err, fs.ErrNotExist) {
+		log.DefaultLogger.Warning("cached response body is missing", "key", key)
+		s.removeEntry(key)
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	response := *entry.Response
+	response.BodyFile = s.bodyPath(entry.BodyHash)
+	response.BodySize = entry.BodySize
+	response.BodyHash = entry.BodyHash
+	response.openBodyFile = file
+
+	return &response, true, nil
+}
+
+func (s *DiskResponseStore) Delete(ctx context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.removeEntry(key)
+	return nil
+}
+
+func (s *DiskResponseStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0)
+	for key, entry := range s.index {
+		if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Create a HTTPCache that keeps responses on disk in the provided directory, so that it survives restarts.
+// The cached responses take up at most budget bytes, bodies shared by several responses count for each of them.
+// The responses loaded from disk are evicted according to the policy like any other.
+func NewDiskHTTPCache(ctx context.Context, dir string, budget int64, policy eviction.Policy[string]) (*HTTPCache, error) {
+	responses, err := NewDiskResponseStore(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	varyStore, err := kvstore.NewFileKVStore(ctx, filepath.Join(dir, "vary.json"))
+	if err != nil {
+		return nil, err
+	}
+	varyHeaders := kvstore.NewJSONKVStore[[]string](varyStore, "")
+
+	cache := NewHTTPCache(ctx, int(budget), policy, responses, varyHeaders)
+	err = cache.track(ctx, responses.entries())
+	if err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
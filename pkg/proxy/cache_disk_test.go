@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/datastructures/eviction"
+)
+
+func TestDiskResponseStoreSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	store, err := NewDiskResponseStore(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte("testtesttest")
+	for _, key := range []string{"a", "b"} {
+		err = store.Store(ctx, key, &CachedResponse{
+			URL:             "http://localhost:8080/" + key,
+			StatusCode:      200,
+			Body:            body,
+			FreshUntil:      time.Now().Add(time.Hour),
+			ResponseHeaders: http.Header{"Content-Type": []string{"text/plain"}},
+		}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Identical bodies are stored once.
+	files, err := os.ReadDir(store.bodiesDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 body file, got %d", len(files))
+	}
+
+	err = store.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewDiskResponseStore(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached, exists, err := restarted.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || cached.ResponseHeaders.Get("Content-Type") != "text/plain" || !cached.IsFresh() {
+		t.Fatalf("expected cached response after restart, got %+v", cached)
+	}
+
+	res := cached.Response(&http.Request{}, CacheStatusHit)
+	data, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, body) || res.ContentLength != int64(len(body)) {
+		t.Fatalf("unexpected body %q", data)
+	}
+
+	// The body is only removed once no response references it.
+	restarted.Delete(ctx, "a")
+	if _, err := os.Stat(cached.BodyFile); err != nil {
+		t.Fatal("body removed while still referenced")
+	}
+	restarted.Delete(ctx, "b")
+	if _, err := os.Stat(cached.BodyFile); err == nil {
+		t.Fatal("body not removed")
+	}
+}
+
+func TestDiskHTTPCacheEvictsReloadedResponses(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	store, err := NewDiskResponseStore(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range []string{"a", "b", "c"} {
+		err = store.Store(ctx, key, &CachedResponse{
+			StatusCode: 200,
+			Body:       bytes.Repeat([]byte(key), 10),
+		}, time.Duration(i+1)*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reloaded responses are tracked by the cache, the one closest to expiring doesn't fit.
+	cache, err := NewDiskHTTPCache(ctx, dir, 20, eviction.NewLRU[string]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := cache.Stats()
+	if stats.Entries != 2 || stats.Size != 20 || stats.Evictions != 1 {
+		t.Fatalf("expected 2 reloaded responses of 20 bytes and 1 eviction, got %+v", stats)
+	}
+
+	// Reloaded responses are evicted according to the cache's policy.
+	err = cache.store(ctx, "", nil, "d", &CachedResponse{StatusCode: 200, Body: bytes.Repeat([]byte("d"), 10)}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]bool{"a": false, "b": false, "c": true, "d": true} {
+		if _, exists, _ := cache.cachedResponses.Get(ctx, key); exists != expected {
+			t.Fatalf("expected %s to be cached: %v", key, expected)
+		}
+	}
+}
+
+func TestDiskHTTPCacheStreamsBodies(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	cache, err := NewDiskHTTPCache(ctx, dir, 1000, eviction.NewLRU[string]())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cacheResponse := func(path string, body []byte) io.ReadCloser {
+		req, _ := http.NewRequest("GET", "http://localhost:8080"+path, nil)
+		res := &http.Response{
+			Request:    req,
+			StatusCode: 200,
+			Header:     http.Header{"Cache-Control": {"max-age=1000"}},
+			Body:       io.NopCloser(bytes.NewReader(body)),
+		}
+		returnedBody, err := cache.Cache(ctx, req.URL.String(), res, CacheOptions{MaxTTL: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return returnedBody
+	}
+	get := func(path string) *CachedResponse {
+		req, _ := http.NewRequest("GET", "http://localhost:8080"+path, nil)
+		cached, err := cache.Get(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cached
+	}
+
+	// The response is cached once its body is read entirely.
+	body := []byte("testtesttest")
+	returnedBody := cacheResponse("/complete", body)
+	if get("/complete") != nil {
+		t.Fatal("expected the response to be cached only once its body is read")
+	}
+	data, err := io.ReadAll(returnedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	returnedBody.Close()
+	if !bytes.Equal(data, body) {
+		t.Fatalf("unexpected body %q", data)
+	}
+	cached := get("/complete")
+	if cached == nil || cached.BodySize != int64(len(body)) || filepath.Base(cached.BodyFile) != cached.BodyHash {
+		t.Fatalf("expected the cached response with its body on disk, got %+v", cached)
+	}
+
+	// Bodies that aren't read entirely aren't cached.
+	returnedBody = cacheResponse("/incomplete", []byte("incomplete"))
+	returnedBody.Read(make([]byte, 4))
+	returnedBody.Close()
+	if get("/incomplete") != nil {
+		t.Fatal("expected an incomplete body not to be cached")
+	}
+
+	// Body files are removed unless they're stored.
+	files, err := os.ReadDir(filepath.Join(dir, "bodies"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != cached.BodyHash {
+		t.Fatalf("expected only the stored body file, got %v", files)
+	}
+}
+
+func TestDiskResponseStoreGetOpensBody(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := NewDiskResponseStore(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte("testtesttest")
+	for _, key := range []string{"a", "b"} {
+		err = store.Store(ctx, key, &CachedResponse{StatusCode: 200, Body: body}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The body of a response that was looked up can be read after the response is removed.
+	cached, exists, err := store.Get(ctx, "a")
+	if err != nil || !exists {
+		t.Fatalf("expected cached response, got %v", err)
+	}
+	store.Delete(ctx, "a")
+	store.Delete(ctx, "b")
+	if _, err := os.Stat(cached.BodyFile); err == nil {
+		t.Fatal("body not removed")
+	}
+
+	res := cached.Response(&http.Request{}, CacheStatusHit)
+	data, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, body) {
+		t.Fatalf("unexpected body %q", data)
+	}
+
+	// Responses whose body file is missing are misses.
+	err = store.Store(ctx, "c", &CachedResponse{StatusCode: 200, Body: body}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(cached.BodyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists, err := store.Get(ctx, "c"); err != nil || exists {
+		t.Fatalf("expected a miss for a response without body, got %v, %v", exists, err)
+	}
+	if len(store.index) != 0 {
+		t.Fatal("expected the response without body to be removed")
+	}
+}
+
+func TestDiskResponseStoreConcurrentStores(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := NewDiskResponseStore(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Responses with the same body are stored and removed concurrently, the stored ones keep their body.
+	body := []byte("testtesttest")
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprint(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := store.Store(ctx, key, &CachedResponse{StatusCode: 200, Body: body}, time.Hour); err != nil {
+					t.Error(err)
+					return
+				}
+				cached, exists, err := store.Get(ctx, key)
+				if err != nil || !exists {
+					t.Errorf("expected response %s to be stored with its body, got %v", key, err)
+					return
+				}
+				cached.Close()
+				store.Delete(ctx, key)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -13,23 +13,44 @@ import (
 
 var UncachableHeaderValues = datastructures.NewSet("no-store", "no-cache")
 
+// The caching policy of a response, as described by its Cache-Control header.
 type CachePolicy struct {
-	FreshUntil           time.Duration
-	CanUseStale          bool
-	NoCache              bool
-	NoStore              bool
-	StaleWhileRevalidate bool
+	// How long the response is fresh.
+	FreshUntil time.Duration
+	// False if the response must be revalidated once stale (must-revalidate, proxy-revalidate).
+	CanUseStale bool
+	NoCache     bool
+	NoStore     bool
+	// How long a stale response may be served while it is revalidated in the background.
+	StaleWhileRevalidate time.Duration
+	// How long a stale response may be served when the upstream server errors.
+	StaleIfError time.Duration
 }
 
 // type CachePolicy interface {
 // 	MustRevalidate(url *url.URL) bool
 // }
 
-// Attempt to parse a Cache-Control header, returning the duration the associated
-// response is allowed to be cached.
-// Returns default duration if header could not be parsed.
-func ParseCacheControl(header string, defaultDuration time.Duration) time.Duration {
-	ttl := defaultDuration
+// Parse the seconds argument of a Cache-Control directive, returning false if it's missing or invalid.
+func parseDirectiveSeconds(header string, parts []string) (time.Duration, bool) {
+	if len(parts) < 2 {
+		log.DefaultLogger.With("header", header).Error("Invalid cache-control header")
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(strings.Trim(parts[1], `"`))
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// Attempt to parse a Cache-Control header into a CachePolicy.
+// FreshUntil is set to the default duration if the header contains no max-age.
+func ParseCachePolicy(header string, defaultDuration time.Duration) CachePolicy {
+	policy := CachePolicy{
+		FreshUntil:  defaultDuration,
+		CanUseStale: true,
+	}
 
 	directives := strings.Split(header, ",")
 	for _, directive := range directives {
@@ -40,25 +61,52 @@ func ParseCacheControl(header string, defaultDuration time.Duration) time.Durati
 
 		// check if no-cache or no-store
 		if UncachableHeaderValues.Contains(directive) {
-			return 0
+			policy.NoCache = policy.NoCache || directive == "no-cache"
+			policy.NoStore = policy.NoStore || directive == "no-store"
+			continue
 		}
 
 		switch directive {
+		case "must-revalidate", "proxy-revalidate":
+			policy.CanUseStale = false
 		case "max-age", "s-max-age":
-			if len(parts) < 2 {
-				log.DefaultLogger.With("header", header).Error("Invalid cache-control header")
-				continue
+			if ttl, ok := parseDirectiveSeconds(header, parts); ok {
+				policy.FreshUntil = ttl
 			}
-			seconds, err := strconv.Atoi(parts[1])
-			if err != nil {
-				continue
+		case "stale-while-revalidate":
+			if ttl, ok := parseDirectiveSeconds(header, parts); ok {
+				policy.StaleWhileRevalidate = ttl
+			}
+		case "stale-if-error":
+			if ttl, ok := parseDirectiveSeconds(header, parts); ok {
+				policy.StaleIfError = ttl
 			}
-			ttl = time.Duration(seconds) * time.Second
-
 		}
 	}
 
-	return ttl
+	// No-cache responses may only be served once revalidated, like must-revalidate responses.
+	if policy.NoCache {
+		policy.CanUseStale = false
+	}
+	if !policy.CanUseStale {
+		policy.StaleWhileRevalidate = 0
+		policy.StaleIfError = 0
+	}
+
+	return policy
+}
+
+// Attempt to parse a Cache-Control header, returning the duration the associated
+// response is allowed to be cached.
+// Returns default duration if header could not be parsed.
+func ParseCacheControl(header string, defaultDuration time.Duration) time.Duration {
+	policy := ParseCachePolicy(header, defaultDuration)
+
+	if policy.NoCache || policy.NoStore {
+		return 0
+	}
+
+	return policy.FreshUntil
 }
 
 // Attempt to parse the provided Expires header, returning the duration the associated
@@ -75,19 +123,41 @@ func ParseExpiresHeader(header string, defaultDuration time.Duration) time.Durat
 
 // Calculate how long we can cache the response based on headers & other response parameters.
 func GetResponseCacheDuration(res *http.Response, defaultDuration time.Duration) (time.Duration, error) {
+	policy, err := GetResponseCachePolicy(res, defaultDuration)
+	if err != nil {
+		return 0, err
+	}
+
+	return policy.FreshUntil, nil
+}
+
+// Calculate the caching policy of the response based on headers & other response parameters.
+// FreshUntil is 0 if the response may not be cached.
+func GetResponseCachePolicy(res *http.Response, defaultDuration time.Duration) (CachePolicy, error) {
 	headers := res.Header
 	if cacheControl := headers.Get("Cache-Control"); cacheControl != "" {
-		return ParseCacheControl(cacheControl, defaultDuration), nil
+		policy := ParseCachePolicy(cacheControl, defaultDuration)
+		policy.FreshUntil = ParseCacheControl(cacheControl, defaultDuration)
+		return policy, nil
 	} else if expires := headers.Get("Expires"); expires != "" {
-		return ParseExpiresHeader(expires, defaultDuration), nil
+		return CachePolicy{
+			FreshUntil:  ParseExpiresHeader(expires, defaultDuration),
+			CanUseStale: true,
+		}, nil
 	}
 
 	// HTTP 301: Moved permanently is cached for a very long time if no other caching headers are present.
 	if res.StatusCode == 301 {
-		return 365 * 24 * time.Hour, nil
+		return CachePolicy{
+			FreshUntil:  365 * 24 * time.Hour,
+			CanUseStale: true,
+		}, nil
 	}
 
-	return defaultDuration, nil
+	return CachePolicy{
+		FreshUntil:  defaultDuration,
+		CanUseStale: true,
+	}, nil
 }
 
 // Get the header names upon which the document at the provided url varies.
@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/KillianMeersman/chaperone/pkg/datastructures/kvstore"
+	"github.com/redis/go-redis/v9"
+)
+
+// Create a HTTPCache that stores responses in Redis, so that it can be shared by several proxies.
+// Keys are prefixed with the provided prefix.
+// The proxies don't track or evict the responses, configure Redis' maxmemory and an eviction policy to bound the total size.
+// Responses larger than maxResponseSize aren't cached.
+func NewRedisHTTPCache(ctx context.Context, client *redis.Client, prefix string, maxResponseSize int) *HTTPCache {
+	store := kvstore.NewRedisKVStore(client)
+	responses := kvstore.NewJSONKVStore[*CachedResponse](store, prefix+"response:")
+	varyHeaders := kvstore.NewJSONKVStore[[]string](store, prefix+"vary:")
+
+	return NewHTTPCache(ctx, maxResponseSize, nil, responses, varyHeaders)
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisHTTPCacheIsShared(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Skipf("redis is not running")
+		return
+	}
+
+	prefix := fmt.Sprintf("chaperone-test-%d:", time.Now().UnixNano())
+	cacheA := NewRedisHTTPCache(ctx, client, prefix, 1e6)
+	cacheB := NewRedisHTTPCache(ctx, client, prefix, 1e6)
+
+	url, err := url.Parse("http://localhost:8080/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte("testtesttest")
+	response := &http.Response{
+		Request: &http.Request{
+			Method: "GET",
+			URL:    url,
+			Header: http.Header{"Accept": []string{"text/plain"}},
+		},
+		StatusCode: 200,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Header: http.Header{
+			"Cache-Control": []string{"max-age=60"},
+			"Vary":          []string{"Accept"},
+		},
+	}
+
+	returnedBody, err := cacheA.Cache(ctx, url.String(), response, CacheOptions{MaxTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(returnedBody)
+
+	// The response cached by one proxy is served by the other.
+	cached, err := cacheB.Get(ctx, &http.Request{
+		Method: "GET",
+		URL:    url,
+		Header: http.Header{"Accept": []string{"text/plain"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached == nil || !bytes.Equal(cached.Body, body) || !cached.IsFresh() {
+		t.Fatalf("expected shared cached response, got %+v", cached)
+	}
+
+	// Responses vary on the Accept header.
+	cached, err = cacheB.Get(ctx, &http.Request{
+		Method: "GET",
+		URL:    url,
+		Header: http.Header{"Accept": []string{"application/json"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != nil {
+		t.Fail()
+	}
+}
@@ -9,6 +9,10 @@ import (
 	"net/url"
 	"testing"
 	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/datastructures/eviction"
+	"github.com/KillianMeersman/chaperone/pkg/datastructures/kvstore"
+	"github.com/KillianMeersman/chaperone/pkg/log"
 )
 
 func testCachingReturnsCorrectBody(t *testing.T, maxCacheSize int, headers http.Header, body []byte) {
@@ -31,7 +35,7 @@ func testCachingReturnsCorrectBody(t *testing.T, maxCacheSize int, headers http.
 		Header:     headers,
 	}
 
-	returnedBody, err := cache.Cache(context.Background(), url.String(), response, 0, time.Hour, 0)
+	returnedBody, err := cache.Cache(context.Background(), url.String(), response, CacheOptions{MaxTTL: time.Hour})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -82,3 +86,338 @@ func TestContentLengthCorrect(t *testing.T) {
 		"Cache-Control":  []string{"max-age=1000"},
 	}, []byte("testtesttest"))
 }
+
+func TestParseCachePolicy(t *testing.T) {
+	policy := ParseCachePolicy("max-age=60, stale-while-revalidate=30, stale-if-error=3600", 0)
+	if policy.FreshUntil != time.Minute {
+		t.Errorf("expected max-age of 1m, got %s", policy.FreshUntil)
+	}
+	if policy.StaleWhileRevalidate != 30*time.Second {
+		t.Errorf("expected stale-while-revalidate of 30s, got %s", policy.StaleWhileRevalidate)
+	}
+	if policy.StaleIfError != time.Hour {
+		t.Errorf("expected stale-if-error of 1h, got %s", policy.StaleIfError)
+	}
+
+	// must-revalidate forbids serving stale responses.
+	policy = ParseCachePolicy("max-age=60, must-revalidate, stale-if-error=3600", 0)
+	if policy.CanUseStale || policy.StaleIfError != 0 {
+		t.Fail()
+	}
+
+	if ParseCacheControl("no-store, max-age=60", time.Hour) != 0 {
+		t.Fail()
+	}
+}
+
+func TestResponsePolicyStaleOverrides(t *testing.T) {
+	cache := NewMemoryHTTPCache(context.Background(), 1000)
+	options := CacheOptions{MaxTTL: time.Hour, StaleWhileRevalidate: time.Minute, StaleIfError: time.Hour}
+
+	// The overrides extend the response's own stale durations.
+	res := &http.Response{StatusCode: 200, Header: http.Header{"Cache-Control": {"max-age=60, stale-if-error=7200"}}}
+	policy, err := cache.responsePolicy(log.DefaultLogger, res, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.StaleWhileRevalidate != time.Minute || policy.StaleIfError != 2*time.Hour {
+		t.Fatalf("expected the stale durations to be extended, got %+v", policy)
+	}
+
+	// Responses that may not be served stale aren't.
+	res.Header.Set("Cache-Control", "max-age=60, must-revalidate")
+	policy, err = cache.responsePolicy(log.DefaultLogger, res, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.StaleWhileRevalidate != 0 || policy.StaleIfError != 0 {
+		t.Fatalf("expected no stale durations for a must-revalidate response, got %+v", policy)
+	}
+}
+
+func TestCacheEvictsToMakeRoom(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache := NewMemoryHTTPCache(ctx, 300)
+
+	cacheURL := func(rawURL string) {
+		url, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := &http.Response{
+			Request: &http.Request{
+				Method: "GET",
+				URL:    url,
+				Header: http.Header{},
+			},
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewReader(bytes.Repeat([]byte("a"), 100))),
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=1000"},
+			},
+		}
+
+		body, err := cache.Cache(ctx, url.String(), response, CacheOptions{MaxTTL: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(body)
+	}
+
+	for i := range 5 {
+		cacheURL(fmt.Sprintf("http://localhost:8080/%d", i))
+	}
+
+	stats := cache.Stats()
+	if stats.Size > stats.MaxSize {
+		t.Fatalf("cache size %d exceeds max size %d", stats.Size, stats.MaxSize)
+	}
+	if stats.Evictions == 0 || stats.Entries+int(stats.Evictions) != 5 {
+		t.Fatalf("expected evictions, got %+v", stats)
+	}
+
+	// The most recent response is still cached, the oldest one was evicted.
+	for i, expected := range map[int]bool{0: false, 4: true} {
+		url, _ := url.Parse(fmt.Sprintf("http://localhost:8080/%d", i))
+		cached, err := cache.Get(ctx, &http.Request{Method: "GET", URL: url, Header: http.Header{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (cached != nil) != expected {
+			t.Errorf("expected cached=%t for %s", expected, url)
+		}
+	}
+}
+
+func TestCacheWithoutEvictionPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Shared stores bound their own size, the cache doesn't track or evict their responses.
+	cache := NewHTTPCache(ctx, 300, nil, kvstore.NewMemoryKVStore[string, *CachedResponse](ctx), kvstore.NewMemoryKVStore[string, []string](ctx))
+	for i := range 5 {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:8080/%d", i), nil)
+		res := &http.Response{
+			Request:    req,
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewReader(bytes.Repeat([]byte("a"), 100))),
+			Header:     http.Header{"Cache-Control": []string{"max-age=1000"}},
+		}
+		body, err := cache.Cache(ctx, req.URL.String(), res, CacheOptions{MaxTTL: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(body)
+	}
+
+	for i := range 5 {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:8080/%d", i), nil)
+		if cached, err := cache.Get(ctx, req); err != nil || cached == nil {
+			t.Fatalf("expected %s to be cached, got %v", req.URL, err)
+		}
+	}
+	if stats := cache.Stats(); stats.Size != 0 || stats.Entries != 0 || stats.Evictions != 0 {
+		t.Fatalf("expected no responses to be tracked, got %+v", stats)
+	}
+
+	// The maximum size still bounds a single response.
+	req, _ := http.NewRequest("GET", "http://localhost:8080/large", nil)
+	res := &http.Response{
+		Request:    req,
+		StatusCode: 200,
+		Body:       io.NopCloser(bytes.NewReader(bytes.Repeat([]byte("a"), 400))),
+		Header:     http.Header{"Cache-Control": []string{"max-age=1000"}},
+	}
+	body, err := cache.Cache(ctx, req.URL.String(), res, CacheOptions{MaxTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(body)
+	if cached, _ := cache.Get(ctx, req); cached != nil {
+		t.Fatal("expected the response larger than the maximum size not to be cached")
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache := NewMemoryHTTPCache(ctx, 1000)
+
+	newRequest := func(rawURL string) *http.Request {
+		url, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Request{Method: "GET", URL: url, Header: http.Header{}}
+	}
+
+	urls := []string{"http://localhost:8080/a", "http://localhost:8080/a/b", "http://localhost:8080/c"}
+	for _, rawURL := range urls {
+		req := newRequest(rawURL)
+		response := &http.Response{
+			Request:    req,
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewReader([]byte("test"))),
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=1000"},
+			},
+		}
+		body, err := cache.Cache(ctx, rawURL, response, CacheOptions{MaxTTL: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(body)
+	}
+
+	purged, err := cache.Purge(ctx, "http://localhost:8080/a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Fatalf("expected 1 purged response, got %d", purged)
+	}
+
+	for rawURL, expected := range map[string]bool{urls[0]: false, urls[1]: true, urls[2]: true} {
+		cached, err := cache.Get(ctx, newRequest(rawURL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (cached != nil) != expected {
+			t.Errorf("expected cached=%t for %s", expected, rawURL)
+		}
+	}
+
+	purged, err = cache.Purge(ctx, "http://localhost:8080/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 || cache.Stats().Entries != 0 {
+		t.Fatalf("expected 2 purged responses, got %d", purged)
+	}
+}
+
+func TestCacheStoresOnlyVaryRequestHeaders(t *testing.T) {
+	cache := NewMemoryHTTPCache(context.Background(), 10000)
+
+	req, _ := http.NewRequest("GET", "https://api.example.com/orders", nil)
+	req.Header.Set("Authorization", "Bearer vendor-secret")
+	req.Header.Set("Accept-Language", "nl")
+	res := &http.Response{
+		Request:    req,
+		StatusCode: 200,
+		Body:       io.NopCloser(bytes.NewReader([]byte("orders"))),
+		Header:     http.Header{"Cache-Control": {"max-age=1000"}, "Vary": {"Accept-Language"}},
+	}
+	body, err := cache.Cache(context.Background(), req.URL.String(), res, CacheOptions{MaxTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(body)
+
+	cached, err := cache.Get(context.Background(), req)
+	if err != nil || cached == nil {
+		t.Fatalf("expected a cached response, got %v", err)
+	}
+	if cached.RequestHeaders.Get("Authorization") != "" {
+		t.Fatal("expected the injected Authorization header not to be stored")
+	}
+	if cached.RequestHeaders.Get("Accept-Language") != "nl" || !cached.IsValidForRequest(req) {
+		t.Fatalf("expected the Vary request headers to be stored, got %v", cached.RequestHeaders)
+	}
+}
+
+// A response body that records whether it was closed.
+type closeTrackingBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *closeTrackingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestCacheClosesBodyOnError(t *testing.T) {
+	cache := NewMemoryHTTPCache(context.Background(), 1000)
+	req, _ := http.NewRequest("GET", "http://localhost:8080/test", nil)
+
+	tests := []struct {
+		name          string
+		contentLength string
+		body          io.Reader
+	}{
+		{"invalid Content-Length", "invalid", bytes.NewReader([]byte("test"))},
+		{"body fails to read", "", &errorReader{io.ErrUnexpectedEOF}},
+	}
+	for _, test := range tests {
+		header := http.Header{"Cache-Control": {"max-age=1000"}}
+		if test.contentLength != "" {
+			header.Set("Content-Length", test.contentLength)
+		}
+		body := &closeTrackingBody{Reader: test.body}
+		res := &http.Response{Request: req, StatusCode: 200, Header: header, Body: body}
+
+		if _, err := cache.Cache(context.Background(), req.URL.String(), res, CacheOptions{MaxTTL: time.Hour}); err == nil {
+			t.Fatalf("%s: expected an error", test.name)
+		}
+		if !body.closed {
+			t.Fatalf("%s: expected the response body to be closed", test.name)
+		}
+	}
+}
+
+// A store of cached responses that takes a while to store them.
+type slowResponseStore struct {
+	kvstore.KVStore[string, *CachedResponse]
+	delay time.Duration
+}
+
+func (s *slowResponseStore) Store(ctx context.Context, key string, value *CachedResponse, ttl time.Duration) error {
+	time.Sleep(s.delay)
+	return s.KVStore.Store(ctx, key, value, ttl)
+}
+
+func TestCacheGetWhileStoring(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	responses := &slowResponseStore{KVStore: kvstore.NewMemoryKVStore[string, *CachedResponse](ctx), delay: 50 * time.Millisecond}
+	cache := NewHTTPCache(ctx, 10000, eviction.NewLRU[string](), responses, kvstore.NewMemoryKVStore[string, []string](ctx))
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/test", nil)
+	res := &http.Response{
+		Request:    req,
+		StatusCode: 200,
+		Header:     http.Header{"Cache-Control": {"max-age=1000"}},
+		Body:       io.NopCloser(bytes.NewReader([]byte("test"))),
+	}
+	stored := make(chan error)
+	go func() {
+		_, err := cache.Cache(ctx, req.URL.String(), res, CacheOptions{MaxTTL: time.Hour})
+		stored <- err
+	}()
+
+	// Requests that miss the response while it's being stored don't release its space.
+	for storing := true; storing; {
+		select {
+		case err := <-stored:
+			if err != nil {
+				t.Fatal(err)
+			}
+			storing = false
+		default:
+			if _, err := cache.Get(ctx, req); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	cached, err := cache.Get(ctx, req)
+	if err != nil || cached == nil {
+		t.Fatalf("expected a cached response, got %v", err)
+	}
+	if stats := cache.Stats(); stats.Size != cached.Size() || stats.Entries != 1 {
+		t.Fatalf("expected the cached response's %d bytes to be tracked, got %d bytes in %d entries", cached.Size(), stats.Size, stats.Entries)
+	}
+}
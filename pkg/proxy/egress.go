@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Header set on responses rejected because the egress policy doesn't allow their upstream server.
+const EgressHeader = "X-Chaperone-Egress"
+
+// Decides which upstream servers requests may go to.
+type EgressPolicy struct {
+	// Host patterns like `api.example.com`, or `*.example.com` for its subdomains.
+	// Denied hosts take precedence over allowed hosts.
+	AllowHosts []string
+	DenyHosts  []string
+	// Deny hosts that match none of the patterns, otherwise they're allowed.
+	DefaultDeny bool
+	// Address ranges that are never connected to, checked after the host is resolved.
+	BlockedRanges []*net.IPNet
+}
+
+// Returned when a request is rejected because the egress policy doesn't allow its upstream server.
+type EgressError struct {
+	Host string
+	// The address the host resolved to, if it's in a blocked range.
+	Address string
+}
+
+func (e *EgressError) Error() string {
+	if e.Address != "" {
+		return fmt.Sprintf("egress to %s is denied, address %s is blocked", e.Host, e.Address)
+	}
+	return fmt.Sprintf("egress to %s is denied", e.Host)
+}
+
+// Return true if the host matches the pattern: the host itself, or any of its subdomains for a pattern like `*.example.com`.
+func matchHostPattern(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+domain)
+	}
+	return host == pattern
+}
+
+// Return an EgressError if the policy doesn't allow requests to the host. Allows every host if the policy is nil.
+func (p *EgressPolicy) CheckHost(host string) error {
+	if p == nil {
+		return nil
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, pattern := range p.DenyHosts {
+		if matchHostPattern(pattern, host) {
+			return &EgressError{Host: host}
+		}
+	}
+	for _, pattern := range p.AllowHosts {
+		if matchHostPattern(pattern, host) {
+			return nil
+		}
+	}
+	if p.DefaultDeny {
+		return &EgressError{Host: host}
+	}
+	return nil
+}
+
+// Return an EgressError if the address is in a blocked range. Allows every address if the policy is nil.
+func (p *EgressPolicy) checkAddress(host string, ip net.IP) error {
+	if p == nil {
+		return nil
+	}
+	for _, blocked := range p.BlockedRanges {
+		if blocked.Contains(ip) {
+			return &EgressError{Host: host, Address: ip.String()}
+		}
+	}
+	return nil
+}
+
+// Get a dial function for the upstream transport that refuses to connect to the blocked ranges of the current policy.
+// Addresses are checked right before connecting, after the host is resolved, so that a host can't resolve to a blocked
+// address once it's been checked.
+func EgressDialContext(dialer *net.Dialer, policy func() *EgressPolicy) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		egressDialer := *dialer
+		egressDialer.Control = func(network, address string, c syscall.RawConn) error {
+			ip, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return policy().checkAddress(host, net.ParseIP(ip))
+		}
+		return egressDialer.DialContext(ctx, network, addr)
+	}
+}
+
+// Get a clone of the default transport that enforces the current egress policy when it connects, see EgressDialContext.
+func NewEgressTransport(policy func() *EgressPolicy) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = EgressDialContext(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}, policy)
+	return transport
+}
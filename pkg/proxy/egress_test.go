@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEgressPolicyCheckHost(t *testing.T) {
+	policy := &EgressPolicy{
+		AllowHosts:  []string{"api.example.com", "*.example.org"},
+		DenyHosts:   []string{"internal.example.org"},
+		DefaultDeny: true,
+	}
+	allowed := []string{"api.example.com", "API.example.com.", "cdn.example.org", "a.b.example.org"}
+	denied := []string{"example.com", "example.org", "internal.example.org", "evil-example.org", "localhost", "169.254.169.254"}
+	for _, host := range allowed {
+		if err := policy.CheckHost(host); err != nil {
+			t.Fatalf("expected %s to be allowed, got %v", host, err)
+		}
+	}
+	for _, host := range denied {
+		var egressErr *EgressError
+		if err := policy.CheckHost(host); !errors.As(err, &egressErr) {
+			t.Fatalf("expected %s to be denied, got %v", host, err)
+		}
+	}
+
+	// Without default deny only the denied hosts are.
+	policy.DefaultDeny = false
+	if policy.CheckHost("localhost") != nil || policy.CheckHost("internal.example.org") == nil {
+		t.Fail()
+	}
+
+	var nilPolicy *EgressPolicy
+	if nilPolicy.CheckHost("localhost") != nil {
+		t.Fail()
+	}
+}
+
+func TestNiceClientEgressBlockedRanges(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, loopback6, _ := net.ParseCIDR("::1/128")
+	policy := &EgressPolicy{BlockedRanges: []*net.IPNet{loopback, loopback6}}
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+	cache := NewMemoryHTTPCache(context.Background(), 10000)
+	client := NewNiceClient(context.Background(), NewEgressTransport(func() *EgressPolicy { return policy }), throttle, cache)
+
+	// A hostname resolving to a blocked address is refused when connecting, without retrying.
+	serverURL := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	req, _ := http.NewRequest("GET", serverURL+"/secret", nil)
+	_, err := client.RoundTripWithOptions(req, &RequestOptions{MaxCacheTTL: time.Hour})
+	var egressErr *EgressError
+	if !errors.As(err, &egressErr) || egressErr.Host != "localhost" || !strings.HasPrefix(egressErr.Address, "127.") && egressErr.Address != "::1" {
+		t.Fatalf("expected an EgressError for the blocked address, got %v", err)
+	}
+	if requests.Load() != 0 {
+		t.Fatal("expected the blocked address not to be connected to")
+	}
+
+	// The current policy applies to new connections.
+	policy = nil
+	req, _ = http.NewRequest("GET", server.URL+"/secret", nil)
+	res, err := client.RoundTripWithOptions(req, &RequestOptions{MaxCacheTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if requests.Load() != 1 {
+		t.Fatal("expected the request to be sent once the address is no longer blocked")
+	}
+}
+
+func TestNiceClientEgressRedirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://metadata.internal/latest/meta-data", http.StatusFound)
+	}))
+	defer server.Close()
+
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+	cache := NewMemoryHTTPCache(context.Background(), 10000)
+	client := NewNiceClient(context.Background(), http.DefaultTransport, throttle, cache)
+
+	// Redirects to hosts that aren't allowed are denied.
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := client.RoundTripWithOptions(req, &RequestOptions{
+		MaxCacheTTL: time.Hour,
+		Egress:      &EgressPolicy{AllowHosts: []string{"127.0.0.1"}, DefaultDeny: true},
+	})
+	var egressErr *EgressError
+	if !errors.As(err, &egressErr) || egressErr.Host != "metadata.internal" {
+		t.Fatalf("expected an EgressError for the redirect, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Headers set on upstream requests whose url starts with a prefix, like the credentials of an upstream server.
+type HeaderRule struct {
+	URL    string
+	Header http.Header
+}
+
+// Sets headers on upstream requests by url prefix, so that clients don't need to hold the credentials of upstream servers.
+type HeaderInjector struct {
+	// Ordered by url, longest first.
+	rules []HeaderRule
+}
+
+func NewHeaderInjector(rules []HeaderRule) *HeaderInjector {
+	rules = slices.Clone(rules)
+	slices.SortStableFunc(rules, func(a, b HeaderRule) int {
+		return len(b.URL) - len(a.URL)
+	})
+	return &HeaderInjector{rules: rules}
+}
+
+// Set the headers of the most specific rule that matches the request's url, replacing any the client sent.
+// Headers carrying a value of any other rule are removed first, so that credentials don't follow redirects to urls they
+// weren't meant for. Does nothing if the injector is nil.
+func (h *HeaderInjector) Inject(req *http.Request) {
+	if h == nil {
+		return
+	}
+
+	requestURL := req.URL.String()
+	var match *HeaderRule
+	for i, rule := range h.rules {
+		if match == nil && strings.HasPrefix(requestURL, rule.URL) {
+			match = &h.rules[i]
+			continue
+		}
+		for name, values := range rule.Header {
+			if slices.Equal(req.Header.Values(name), values) {
+				req.Header.Del(name)
+			}
+		}
+	}
+
+	if match != nil {
+		for name, values := range match.Header {
+			req.Header[name] = slices.Clone(values)
+		}
+	}
+}
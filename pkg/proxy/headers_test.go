@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHeaderInjector(t *testing.T) {
+	injector := NewHeaderInjector([]HeaderRule{
+		{URL: "https://api.example.com", Header: http.Header{"Authorization": {"Bearer vendor"}}},
+		{URL: "https://api.example.com/v2", Header: http.Header{"X-Api-Key": {"v2-key"}}},
+		{URL: "https://b.example.com", Header: http.Header{"Authorization": {"Bearer b"}}},
+	})
+
+	// The client's own credentials are replaced.
+	req, _ := http.NewRequest("GET", "https://api.example.com/orders", nil)
+	req.Header.Set("Authorization", "Bearer client")
+	injector.Inject(req)
+	if req.Header.Get("Authorization") != "Bearer vendor" {
+		t.Fatalf("expected the injected Authorization header, got %s", req.Header.Get("Authorization"))
+	}
+
+	// The most specific rule applies.
+	req, _ = http.NewRequest("GET", "https://api.example.com/v2/orders", nil)
+	req.Header.Set("X-Api-Key", "client-key")
+	injector.Inject(req)
+	if req.Header.Get("X-Api-Key") != "v2-key" || req.Header.Get("Authorization") != "" {
+		t.Fatalf("expected only the headers of the v2 rule, got %v", req.Header)
+	}
+
+	// Injected credentials don't follow a redirect to another host, other headers are kept.
+	req.URL.Host = "cdn.example.com"
+	req.Header.Set("Authorization", "Bearer client")
+	injector.Inject(req)
+	if req.Header.Get("X-Api-Key") != "" || req.Header.Get("Authorization") != "Bearer client" {
+		t.Fatalf("expected the injected headers to be removed, got %v", req.Header)
+	}
+
+	// Credentials of one rule don't follow a redirect to the url of another rule.
+	req, _ = http.NewRequest("GET", "https://api.example.com/v2/orders", nil)
+	injector.Inject(req)
+	req.URL.Host = "b.example.com"
+	injector.Inject(req)
+	if req.Header.Get("X-Api-Key") != "" || req.Header.Get("Authorization") != "Bearer b" {
+		t.Fatalf("expected only the headers of the b.example.com rule, got %v", req.Header)
+	}
+
+	// A nil injector does nothing.
+	var nilInjector *HeaderInjector
+	nilInjector.Inject(req)
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A number of requests per window, e.g. 10000 requests per day.
+// As a quota, windows are fixed rather than sliding, daily quotas reset at midnight UTC.
+type Quota struct {
+	Requests int           `json:"requests"`
+	Window   time.Duration `json:"window"`
+}
+
+var rateUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+}
+
+// Parse a rate like `1000/minute`, `10000/day` or `5/10s`.
+// The unit is one of second, minute, hour and day, or a duration.
+func ParseRate(rate string) (Quota, error) {
+	requestsPart, unitPart, ok := strings.Cut(strings.TrimSpace(rate), "/")
+	if !ok {
+		return Quota{}, fmt.Errorf("invalid rate '%s', expected a format like 1000/minute", rate)
+	}
+
+	requests, err := strconv.Atoi(strings.TrimSpace(requestsPart))
+	if err != nil || requests <= 0 {
+		return Quota{}, fmt.Errorf("invalid rate '%s', the number of requests must be a positive integer", rate)
+	}
+
+	unitPart = strings.TrimSpace(unitPart)
+	window, ok := rateUnits[strings.TrimSuffix(unitPart, "s")]
+	if !ok {
+		window, err = time.ParseDuration(unitPart)
+		if err != nil || window <= 0 {
+			return Quota{}, fmt.Errorf("invalid rate '%s', unknown unit '%s'", rate, unitPart)
+		}
+	}
+
+	return Quota{Requests: requests, Window: window}, nil
+}
+
+// Format the quota like `1000/minute`.
+func (q Quota) String() string {
+	for name, unit := range rateUnits {
+		if q.Window == unit {
+			return fmt.Sprintf("%d/%s", q.Requests, name)
+		}
+	}
+	return fmt.Sprintf("%d/%s", q.Requests, q.Window)
+}
+
+// A rate limit: a token bucket that refills one token per interval and holds at most burst tokens,
+// combined with quotas over longer windows.
+type Limit struct {
+	// Time between requests once the burst is spent. Zero if only the quotas apply.
+	Interval time.Duration `json:"interval"`
+	// Number of requests that can be made at once after being idle.
+	Burst  int     `json:"burst"`
+	Quotas []Quota `json:"quotas"`
+	// Maximum number of requests in flight at once. Zero if unlimited.
+	MaxConcurrent int `json:"max_concurrent"`
+	// Bounds of the rate if it adapts to the upstream server's responses, nil if it doesn't.
+	// The interval is then the current rate.
+	Adaptive *AdaptiveRate `json:"adaptive,omitempty"`
+	// Maximum number of requests waiting for their slot, further requests are rejected. Zero if unlimited.
+	MaxQueue int `json:"max_queue"`
+	// Maximum time a request may wait for its slot, requests that would wait longer are rejected. Zero if unlimited.
+	MaxWait time.Duration `json:"max_wait"`
+}
+
+// A limit allowing one request per interval, without bursts.
+func IntervalLimit(interval time.Duration) Limit {
+	return Limit{Interval: interval, Burst: 1}
+}
+
+// A limit allowing the rate's number of requests per window, evenly spread, with the provided burst.
+func NewRateLimit(rate Quota, burst int) Limit {
+	return Limit{Interval: rate.Window / time.Duration(rate.Requests), Burst: max(burst, 1)}
+}
+
+// Format the limit like `interval=60ms burst=50 quotas=10000/day max_concurrent=5`.
+func (l Limit) String() string {
+	parts := make([]string, 0, 6)
+	if l.Interval > 0 {
+		parts = append(parts, fmt.Sprintf("interval=%s burst=%d", l.Interval, l.Burst))
+	}
+	if l.Adaptive != nil {
+		parts = append(parts, fmt.Sprintf("adaptive=%s..%s", l.Adaptive.MinRate, l.Adaptive.MaxRate))
+	}
+	if len(l.Quotas) > 0 {
+		quotas := make([]string, 0, len(l.Quotas))
+		for _, quota := range l.Quotas {
+			quotas = append(quotas, quota.String())
+		}
+		parts = append(parts, "quotas="+strings.Join(quotas, ","))
+	}
+	if l.MaxConcurrent > 0 {
+		parts = append(parts, fmt.Sprintf("max_concurrent=%d", l.MaxConcurrent))
+	}
+	if l.MaxQueue > 0 {
+		parts = append(parts, fmt.Sprintf("max_queue=%d", l.MaxQueue))
+	}
+	if l.MaxWait > 0 {
+		parts = append(parts, fmt.Sprintf("max_wait=%s", l.MaxWait))
+	}
+	return strings.Join(parts, " ")
+}
+
+// State of a limit, deciding when requests may be sent.
+// The token bucket is implemented as a generic cell rate algorithm (GCRA): it tracks the theoretical arrival time of the
+// next request when requests arrive exactly once per interval. Requests may be up to burst-1 intervals early.
+type limiter struct {
+	limit Limit
+	// Theoretical arrival time.
+	tat time.Time
+	// Start of the current window and number of requests in it, per quota.
+	windowStarts []time.Time
+	windowCounts []int
+}
+
+func newLimiter(limit Limit) *limiter {
+	return &limiter{
+		limit:        limit,
+		windowStarts: make([]time.Time, len(limit.Quotas)),
+		windowCounts: make([]int, len(limit.Quotas)),
+	}
+}
+
+// Change the limit, keeping the state of the token bucket.
+// Quota windows are reset if the quotas changed.
+func (l *limiter) setLimit(limit Limit) {
+	quotasChanged := len(limit.Quotas) != len(l.limit.Quotas)
+	for i := range limit.Quotas {
+		quotasChanged = quotasChanged || limit.Quotas[i] != l.limit.Quotas[i]
+	}
+
+	l.limit = limit
+	if quotasChanged {
+		l.windowStarts = make([]time.Time, len(limit.Quotas))
+		l.windowCounts = make([]int, len(limit.Quotas))
+	}
+}
+
+// Get the earliest time at or after t at which a request may be sent.
+func (l *limiter) earliest(t time.Time) time.Time {
+	if l.limit.Interval > 0 {
+		tolerance := time.Duration(max(l.limit.Burst-1, 0)) * l.limit.Interval
+		if allowed := l.tat.Add(-tolerance); allowed.After(t) {
+			t = allowed
+		}
+	}
+
+	for i, quota := range l.limit.Quotas {
+		windowStart := t.Truncate(quota.Window)
+		if !windowStart.After(l.windowStarts[i]) && l.windowCounts[i] >= quota.Requests {
+			// The quota is spent, wait for the next window.
+			t = l.windowStarts[i].Add(quota.Window)
+		}
+	}
+
+	return t
+}
+
+// Record that a request is sent at slot, which must have been returned by earliest.
+func (l *limiter) reserve(slot time.Time) {
+	if l.limit.Interval > 0 {
+		if l.tat.Before(slot) {
+			l.tat = slot
+		}
+		l.tat = l.tat.Add(l.limit.Interval)
+	}
+
+	for i := range l.limit.Quotas {
+		windowStart := slot.Truncate(l.limit.Quotas[i].Window)
+		if windowStart.After(l.windowStarts[i]) {
+			l.windowStarts[i] = windowStart
+			l.windowCounts[i] = 0
+		}
+		l.windowCounts[i]++
+	}
+}
+
+// Give back a slot reserved with reserve, for a request that wasn't sent.
+// Requests that reserved a later slot keep it, the capacity goes to the next request.
+func (l *limiter) cancel(slot time.Time) {
+	if l.limit.Interval > 0 {
+		l.tat = l.tat.Add(-l.limit.Interval)
+	}
+
+	for i := range l.limit.Quotas {
+		if slot.Truncate(l.limit.Quotas[i].Window).Equal(l.windowStarts[i]) && l.windowCounts[i] > 0 {
+			l.windowCounts[i]--
+		}
+	}
+}
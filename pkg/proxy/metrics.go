@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/metrics"
+)
+
+// Metrics recorded by the NiceClient.
+// Cache, throttle and retry metrics are labelled by the rule in the RequestOptions, upstream metrics by host.
+type ClientMetrics struct {
+	CacheHits          *metrics.Counter
+	CacheMisses        *metrics.Counter
+	CacheHitBytes      *metrics.Counter
+	ThrottleWait       *metrics.Histogram
+	UpstreamResponses  *metrics.Counter
+	UpstreamErrors     *metrics.Counter
+	Retries            *metrics.Counter
+	Blocks             *metrics.Counter
+	InFlight           *metrics.Gauge
+	BreakerRejections  *metrics.Counter
+	ThrottleRejections *metrics.Counter
+	RobotsRejections   *metrics.Counter
+	EgressDenials      *metrics.Counter
+}
+
+// Create the NiceClient metrics and register them.
+func NewClientMetrics(registry *metrics.Registry) *ClientMetrics {
+	return &ClientMetrics{
+		CacheHits:          registry.NewCounter("chaperone_cache_hits_total", "Requests served from the cache, including stale and revalidated responses.", "rule"),
+		CacheMisses:        registry.NewCounter("chaperone_cache_misses_total", "GET requests that weren't served from the cache.", "rule"),
+		CacheHitBytes:      registry.NewCounter("chaperone_cache_hit_bytes_total", "Bytes of response bodies served from the cache.", "rule"),
+		ThrottleWait:       registry.NewHistogram("chaperone_throttle_wait_seconds", "Time spent waiting on the throttle before sending a request upstream.", metrics.DefaultDurationBuckets, "rule"),
+		UpstreamResponses:  registry.NewCounter("chaperone_upstream_responses_total", "Responses received from upstream servers.", "host", "code"),
+		UpstreamErrors:     registry.NewCounter("chaperone_upstream_errors_total", "Upstream requests that failed without a response.", "host"),
+		Retries:            registry.NewCounter("chaperone_upstream_retries_total", "Upstream requests that were retried.", "rule"),
+		Blocks:             registry.NewCounter("chaperone_throttle_blocks_total", "Times the throttle was blocked after a backoff status code.", "rule"),
+		InFlight:           registry.NewGauge("chaperone_requests_in_flight", "Requests being handled by the client."),
+		BreakerRejections:  registry.NewCounter("chaperone_circuit_breaker_rejections_total", "Requests rejected because their circuit breaker was open.", "breaker"),
+		ThrottleRejections: registry.NewCounter("chaperone_throttle_rejections_total", "Requests rejected instead of waiting on the throttle, by reason.", "rule", "reason"),
+		RobotsRejections:   registry.NewCounter("chaperone_robots_rejections_total", "Requests rejected because the upstream server's robots.txt disallows them.", "host"),
+		EgressDenials:      registry.NewCounter("chaperone_egress_denials_total", "Requests rejected because the egress policy doesn't allow their upstream server.", "host"),
+	}
+}
+
+// Record how the cache was used for a request, based on the response's cache status.
+// Safe to call on a nil ClientMetrics, as are the other methods.
+func (m *ClientMetrics) observeCacheStatus(rule string, status string, bodySize int64) {
+	if m == nil {
+		return
+	}
+
+	switch status {
+	case CacheStatusHit, CacheStatusStale, CacheStatusRevalidated:
+		m.CacheHits.Inc(rule)
+		if bodySize > 0 {
+			m.CacheHitBytes.Add(float64(bodySize), rule)
+		}
+	case CacheStatusMiss, CacheStatusCollapsed:
+		m.CacheMisses.Inc(rule)
+	}
+}
+
+func (m *ClientMetrics) observeThrottleWait(rule string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.ThrottleWait.Observe(duration.Seconds(), rule)
+}
+
+func (m *ClientMetrics) observeUpstream(host string, res *http.Response, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.UpstreamErrors.Inc(host)
+		return
+	}
+	m.UpstreamResponses.Inc(host, fmt.Sprint(res.StatusCode))
+}
+
+func (m *ClientMetrics) observeRetry(rule string) {
+	if m == nil {
+		return
+	}
+	m.Retries.Inc(rule)
+}
+
+func (m *ClientMetrics) observeBlock(rule string) {
+	if m == nil {
+		return
+	}
+	m.Blocks.Inc(rule)
+}
+
+func (m *ClientMetrics) addInFlight(delta float64) {
+	if m == nil {
+		return
+	}
+	m.InFlight.Add(delta)
+}
+
+func (m *ClientMetrics) observeBreakerRejection(breaker string) {
+	if m == nil {
+		return
+	}
+	m.BreakerRejections.Inc(breaker)
+}
+
+func (m *ClientMetrics) observeThrottleRejection(rule string, err error) {
+	if m == nil {
+		return
+	}
+	reason := "max_wait"
+	if errors.Is(err, ErrQueueFull) {
+		reason = "queue_full"
+	}
+	m.ThrottleRejections.Inc(rule, reason)
+}
+
+func (m *ClientMetrics) observeRobotsRejection(host string) {
+	if m == nil {
+		return
+	}
+	m.RobotsRejections.Inc(host)
+}
+
+// Record a request rejected because the egress policy doesn't allow its upstream server.
+func (m *ClientMetrics) observeEgressDenial(host string) {
+	if m == nil {
+		return
+	}
+	m.EgressDenials.Inc(host)
+}
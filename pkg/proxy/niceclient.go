@@ -9,6 +9,8 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/KillianMeersman/chaperone/pkg/log"
@@ -38,30 +40,241 @@ func ParseRetryAfterHeader(res *http.Response, defaultWait time.Duration) time.D
 	return defaultWait
 }
 
+// Return true if the request carries its own cache validators.
+func isConditionalRequest(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
 // Request option struct for the NiceClient.RoundTripWithOptions method.
 type RequestOptions struct {
+	// User agent whose robots.txt rules apply to the request.
 	UserAgent       string
 	MinCacheTTL     time.Duration
 	MaxCacheTTL     time.Duration
 	DefaultCacheTTL time.Duration
+	// Minimum duration stale responses are served while they are revalidated in the background.
+	StaleWhileRevalidate time.Duration
+	// Minimum duration stale responses are served when the upstream server fails.
+	StaleIfError time.Duration
+	// Headers set on the request and on the requests of redirects it follows, by url.
+	Headers *HeaderInjector
+	// Upstream servers the request and the redirects it follows may go to. Every server is allowed if nil.
+	Egress *EgressPolicy
+	// Reject the request if the upstream server's robots.txt disallows it, and respect its crawl delay.
+	RespectRobots bool
+	// Maximum time the request may wait on the throttle, over all attempts. Zero if unlimited.
+	MaxWait time.Duration
+	// Priority of the request while it waits on the throttle.
+	Priority Priority
+	// Client that sent the request and its weight, clients share throttles in proportion to their weight.
+	Client       string
+	ClientWeight float64
+	// Wait on the throttle of the client's budget before every upstream request, see ClientThrottleRequest.
+	ClientThrottle bool
+	// Overrides the client's retry policy if set.
+	RetryPolicy *RetryPolicy
+	// Circuit breaker for the request, requests with the same key share a breaker. The host is used if empty.
+	CircuitBreakerKey string
+	// Overrides the settings of the client's circuit breakers if set.
+	CircuitBreaker *BreakerSettings
+	// Names of the config rules that matched the request, used to label metrics.
+	CacheRule     string
+	RateLimitRule string
+
+	// Set on background revalidations, which must not serve stale responses themselves.
+	revalidating bool
+}
+
+// Get the caching parameters for the request.
+func (o *RequestOptions) cacheOptions() CacheOptions {
+	return CacheOptions{
+		MinTTL:               o.MinCacheTTL,
+		MaxTTL:               o.MaxCacheTTL,
+		DefaultTTL:           o.DefaultCacheTTL,
+		StaleWhileRevalidate: o.StaleWhileRevalidate,
+		StaleIfError:         o.StaleIfError,
+	}
 }
 
 // A http client (RoundTripper) that performs retry logic, rate-limiting, robot-exclusion and caching.
 type NiceClient struct {
+	ctx          context.Context
 	throttle     HTTPThrottle
 	cache        *HTTPCache
 	roundtripper http.RoundTripper
+	// Cache keys of the responses that are being revalidated in the background.
+	revalidations *sync.Map
+	// Crawl delay last applied to the throttle, by method and host, see applyCrawlDelay.
+	crawlDelays *sync.Map
+	flights     *flightGroup
+	// Metrics are only recorded if set.
+	Metrics *ClientMetrics
+	// Policy for retrying failed requests, unless overridden by the request options.
+	RetryPolicy RetryPolicy
+	// Requests fail fast when their upstream server is failing. Disabled if nil.
+	Breakers *CircuitBreakers
 }
 
 // Creates a new NiceClient with the provided options.
+// Background revalidations are stopped when the context is cancelled.
 func NewNiceClient(ctx context.Context, roundTripper http.RoundTripper, throttle HTTPThrottle, cache *HTTPCache) *NiceClient {
 	return &NiceClient{
+		ctx,
 		throttle,
 		cache,
 		roundTripper,
+		&sync.Map{},
+		&sync.Map{},
+		newFlightGroup(MaxSharedBodySize),
+		nil,
+		DefaultRetryPolicy(),
+		nil,
 	}
 }
 
+// Revalidate the stale cached response in the background, going through the throttle like any other request.
+// Does nothing if the response is already being revalidated.
+func (c *NiceClient) revalidateInBackground(req *http.Request, cached *CachedResponse, options *RequestOptions) {
+	key := cached.CacheKey(req)
+	if _, loaded := c.revalidations.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+
+	logger, _ := log.FromContext(req.Context())
+	backgroundReq := req.Clone(log.NewContext(c.ctx, logger))
+	backgroundOptions := *options
+	backgroundOptions.revalidating = true
+
+	go func() {
+		defer c.revalidations.Delete(key)
+
+		res, err := c.RoundTripWithOptions(backgroundReq, &backgroundOptions)
+		if err != nil {
+			logger.With("error", err.Error()).Warning("background revalidation failed")
+			return
+		}
+		defer res.Body.Close()
+
+		// Drain the body so that it's cached.
+		_, err = io.Copy(io.Discard, res.Body)
+		if err != nil {
+			logger.With("error", err.Error()).Warning("background revalidation failed")
+		}
+	}()
+}
+
+// Return a response for the stale cached response if it may be served because the upstream server failed.
+func (c *NiceClient) staleOnError(req *http.Request, staleResponse *CachedResponse, logger *log.Logger) (*http.Response, bool) {
+	if staleResponse == nil || !staleResponse.CanServeOnError() {
+		return nil, false
+	}
+
+	logger.Warning("upstream server failed, serving stale cached response")
+	return staleResponse.Response(req, CacheStatusStale), true
+}
+
+// Get a request for the url of the most specific throttle that applies to the request.
+// Upstream quotas usually cover more than a single url, so the host is used if no throttle applies.
+func (c *NiceClient) throttleRequest(req *http.Request) *http.Request {
+	requestURL := fmt.Sprintf("%s://%s%s", req.URL.Scheme, req.URL.Host, req.URL.Path)
+	throttleURL := &url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host}
+	longest := -1
+	for _, setting := range c.throttle.Throttles() {
+		if setting.Method != req.Method || len(setting.URL) <= longest {
+			continue
+		}
+		if requestURL != setting.URL && !strings.HasPrefix(requestURL, strings.TrimSuffix(setting.URL, "/")+"/") {
+			continue
+		}
+		if parsed, err := url.Parse(setting.URL); err == nil {
+			throttleURL = parsed
+			longest = len(setting.URL)
+		}
+	}
+	return &http.Request{Method: req.Method, URL: throttleURL}
+}
+
+// Block the throttle of the request if the quota advertised by the response's rate limit headers runs low,
+// so that it isn't exceeded.
+func (c *NiceClient) respectUpstreamQuota(req *http.Request, res *http.Response, options *RequestOptions, logger *log.Logger) {
+	delay := UpstreamQuotaDelay(res, time.Now())
+	if delay <= 0 {
+		return
+	}
+	delay = min(delay, time.Duration(MaxWaitTimeMs)*time.Millisecond)
+
+	throttleReq := c.throttleRequest(req)
+	logger.With("delay", delay.String(), "throttle", throttleReq.URL.String()).Info("upstream quota is running low, slowing down")
+	c.throttle.Block(throttleReq, delay)
+	c.Metrics.observeBlock(options.RateLimitRule)
+}
+
+// Get the key of the request's circuit breaker.
+func breakerKey(req *http.Request, options *RequestOptions) string {
+	if options.CircuitBreakerKey != "" {
+		return options.CircuitBreakerKey
+	}
+	return req.URL.Host
+}
+
+// Return a CircuitOpenError if the request's circuit breaker is open.
+func (c *NiceClient) checkBreaker(req *http.Request, options *RequestOptions) error {
+	if c.Breakers == nil {
+		return nil
+	}
+	return c.Breakers.Check(breakerKey(req, options), options.CircuitBreaker)
+}
+
+// Ask the request's circuit breaker whether it may be sent.
+// Returns a function to record whether the request failed, which returns true if that opened the breaker,
+// and a function to call instead if the request wasn't sent.
+func (c *NiceClient) allowBreaker(req *http.Request, options *RequestOptions) (func(failed bool) bool, func(), error) {
+	if c.Breakers == nil {
+		return func(bool) bool { return false }, func() {}, nil
+	}
+	return c.Breakers.Allow(breakerKey(req, options), options.CircuitBreaker)
+}
+
+// Block the throttle while the request's circuit breaker is open, so that other clients sharing the throttle back off too
+// and requests queued on the throttle aren't sent to the failing server.
+func (c *NiceClient) breakerOpened(req *http.Request, options *RequestOptions, logger *log.Logger) {
+	openDuration := c.Breakers.Settings(options.CircuitBreaker).OpenDuration
+	throttleReq := c.throttleRequest(req)
+	logger.With("breaker", breakerKey(req, options), "throttle", throttleReq.URL.String()).Warning("circuit breaker opened, blocking throttle")
+	c.throttle.Block(throttleReq, openDuration)
+	c.Metrics.observeBlock(options.RateLimitRule)
+}
+
+// Handle a request that gave up waiting on the throttle: serve the stale response if allowed, otherwise return the error.
+// A request that ran out of its maximum wait gets a ThrottleError, unless the request's own context is done.
+func (c *NiceClient) waitFailed(ctx context.Context, req *http.Request, options *RequestOptions, staleResponse *CachedResponse, err error, logger *log.Logger) (*http.Response, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = &ThrottleError{Reason: ErrWaitTooLong}
+	}
+	c.Metrics.observeThrottleRejection(options.RateLimitRule, err)
+
+	logger.With("error", err.Error()).Warning("rejected request instead of waiting on the throttle")
+	if staleRes, ok := c.staleOnError(req, staleResponse, logger); ok {
+		return staleRes, nil
+	}
+	return nil, err
+}
+
+// Serve the stale response for a request rejected by its circuit breaker if allowed, otherwise return the error.
+func (c *NiceClient) circuitOpen(req *http.Request, staleResponse *CachedResponse, err error, logger *log.Logger) (*http.Response, error) {
+	var openErr *CircuitOpenError
+	if errors.As(err, &openErr) {
+		c.Metrics.observeBreakerRejection(openErr.Breaker)
+	}
+	if staleRes, ok := c.staleOnError(req, staleResponse, logger.With("error", err.Error())); ok {
+		return staleRes, nil
+	}
+	return nil, err
+}
+
 // Implementation of the RoundTripper interface.
 func (c *NiceClient) RoundTrip(req *http.Request) (*http.Response, error) {
 	return c.RoundTripWithOptions(req, &RequestOptions{
@@ -74,16 +287,42 @@ func (c *NiceClient) RoundTrip(req *http.Request) (*http.Response, error) {
 
 // Perform a round-trip with the provided options.
 func (c *NiceClient) RoundTripWithOptions(req *http.Request, options *RequestOptions) (*http.Response, error) {
-	attempt := 1
+	c.Metrics.addInFlight(1)
+	defer c.Metrics.addInFlight(-1)
+
+	res, err := c.roundTrip(req, options)
+	if err == nil && !options.revalidating {
+		c.Metrics.observeCacheStatus(options.CacheRule, res.Header.Get(CacheStatusHeader), res.ContentLength)
+	}
+
+	return res, err
+}
 
+// Perform a round-trip, serving the response from the cache if possible.
+func (c *NiceClient) roundTrip(req *http.Request, options *RequestOptions) (*http.Response, error) {
+	if err := options.Egress.CheckHost(req.URL.Hostname()); err != nil {
+		c.Metrics.observeEgressDenial(req.URL.Host)
+		return nil, err
+	}
 	if req.Header.Get("User-Agent") == "" {
 		req.Header.Set("User-Agent", "ChaperoneBot/0.1")
 	}
+	options.Headers.Inject(req)
 
 	ctx := req.Context()
 	logger, _ := log.FromContext(req.Context())
-	originalURL := req.URL.String()
-	logger = logger.With("method", req.Method, "url", originalURL, "attempt", fmt.Sprintf("%d", attempt))
+	logger = logger.With("method", req.Method, "url", req.URL.String(), "attempt", "1")
+
+	if options.RespectRobots {
+		if err := c.respectRobots(req, options, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	// Stale cached response that may be served or revalidated, if any.
+	var staleResponse *CachedResponse
+	// Whether validators of the stale response were added to the request.
+	revalidating := false
 
 	// Special handling for GET requests
 	if req.Method == http.MethodGet {
@@ -92,46 +331,192 @@ func (c *NiceClient) RoundTripWithOptions(req *http.Request, options *RequestOpt
 		if err != nil {
 			return nil, err
 		}
+		// Release the body file of a cached response that ends up not being served.
+		defer cachedResponse.Close()
 		if cachedResponse != nil {
-			return &http.Response{
-				Status:     "",
-				StatusCode: cachedResponse.StatusCode,
-				Body:       cachedResponse.BodyReadCloser(),
-			}, nil
+			if cachedResponse.IsFresh() {
+				return cachedResponse.Response(req, CacheStatusHit), nil
+			}
+
+			if !options.revalidating && cachedResponse.CanServeWhileRevalidating() {
+				logger.Debug("serving stale cached response while revalidating")
+				c.revalidateInBackground(req, cachedResponse, options)
+				return cachedResponse.Response(req, CacheStatusStale), nil
+			}
+
+			staleResponse = cachedResponse
+
+			// Revalidate stale responses with a conditional request, unless the caller made the request conditional itself.
+			// In that case, the caller is revalidating its own cache and should get the upstream response.
+			if cachedResponse.CanRevalidate() && !isConditionalRequest(req) {
+				logger.Debug("revalidating stale cached response")
+				revalidating = true
+				staleResponse.AddConditionalHeaders(req)
+			}
+		}
+	}
+
+	// Collapse concurrent identical GET requests into a single upstream request.
+	// Requests the caller made conditional are specific to the caller's own cache and are never collapsed.
+	if req.Method == http.MethodGet && (revalidating || !isConditionalRequest(req)) {
+		cacheKey, err := c.cache.CacheKey(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		// Responses are only shared between requests of the same client with the same credentials, as they may be private.
+		flightKey := strings.Join([]string{cacheKey, options.Client, req.Header.Get("Authorization"), strings.Join(req.Header.Values("Cookie"), "; ")}, "\x00")
+		res, shared, err := c.flights.Do(ctx, flightKey, req, func() (*http.Response, error) {
+			return c.roundTripUpstream(req, options, staleResponse, revalidating, logger)
+		})
+		if shared && err == nil {
+			logger.Debug("collapsed request into in-flight request")
+			res.Header.Set(CacheStatusHeader, CacheStatusCollapsed)
 		}
+		return res, err
+	}
+
+	return c.roundTripUpstream(req, options, staleResponse, revalidating, logger)
+}
+
+// Send the request upstream, retrying according to the retry policy, and cache the response.
+// The stale cached response, if any, is served when the upstream server fails and revalidated if revalidating is set.
+func (c *NiceClient) roundTripUpstream(req *http.Request, options *RequestOptions, staleResponse *CachedResponse, revalidating bool, logger *log.Logger) (*http.Response, error) {
+	attempt := 1
+	ctx := req.Context()
+	originalURL := req.URL.String()
+	policy := c.RetryPolicy
+	if options.RetryPolicy != nil {
+		policy = *options.RetryPolicy
+	}
+	retryStart := time.Now()
+
+	// Bound the time spent waiting on the throttle, over all attempts.
+	waitCtx := WithClient(WithPriority(ctx, options.Priority), options.Client, options.ClientWeight)
+	if options.MaxWait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(waitCtx, options.MaxWait)
+		defer cancel()
 	}
 
 	// ====== Request retry loop. ======
+	var body []byte
 	if req.Body != nil {
 		// Copy the request body into a buffer so we can retry the request multiple times.
 		// This is necessary due to RoundTrip() always closing the request Body.
-		bodyBuffer := bytes.NewBuffer(make([]byte, 0))
-		written, err := io.Copy(bodyBuffer, req.Body)
+		var err error
+		body, err = io.ReadAll(req.Body)
 		if err != nil {
 			return nil, err
 		}
-		logger.With("buffer_size", fmt.Sprint(written)).Debug("buffered request body for retries")
+		logger.With("buffer_size", fmt.Sprint(len(body))).Debug("buffered request body for retries")
 		req.Body.Close()
-		// The NopCloser won't do anything when RoundTrip() closes it.
-		req.Body = io.NopCloser(bodyBuffer)
+	}
+
+	// Wait for the backoff before retrying, returns false if the context was cancelled.
+	retry := func(backoff time.Duration) bool {
+		logger.With("backoff", backoff.String()).Debug("retrying request")
+		timer := time.NewTimer(backoff)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+		}
+
+		attempt++
+		logger = logger.With("attempt", fmt.Sprintf("%d", attempt))
+		c.Metrics.observeRetry(options.RateLimitRule)
+		return true
 	}
 
 	for {
+		if body != nil {
+			// The NopCloser won't do anything when RoundTrip() closes it.
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		// Fail fast if the upstream server is failing, rather than waiting on the throttle.
+		if err := c.checkBreaker(req, options); err != nil {
+			return c.circuitOpen(req, staleResponse, err, logger)
+		}
+
 		logger.Debug("waiting to make request")
-		c.throttle.Wait(req)
+		waitStart := time.Now()
+		var err error
+		// Spend the client's own budget first, rather than holding on to a slot of a throttle shared with other clients.
+		if options.ClientThrottle {
+			err = c.throttle.Wait(waitCtx, ClientThrottleRequest(options.Client))
+		}
+		// Take the concurrency slot before the rate slot, so that requests queued on the concurrency limit
+		// don't go out in a burst once slots free up, each with a rate slot it took long before.
+		release := func() {}
+		if err == nil {
+			logger.Debug("waiting for concurrency slot")
+			release, err = c.throttle.Acquire(waitCtx, req)
+		}
+		if err == nil {
+			if err = c.throttle.Wait(waitCtx, req); err != nil {
+				release()
+			}
+		}
+		c.Metrics.observeThrottleWait(options.RateLimitRule, time.Since(waitStart))
+		if err != nil {
+			return c.waitFailed(ctx, req, options, staleResponse, err, logger)
+		}
+
+		// The breaker may have opened while waiting, otherwise this may be a probe.
+		recordOutcome, cancelOutcome, err := c.allowBreaker(req, options)
+		if err != nil {
+			release()
+			return c.circuitOpen(req, staleResponse, err, logger)
+		}
 
 		logger.Debug("making request")
+		requestStart := time.Now()
 		res, err := c.roundtripper.RoundTrip(req)
+		latency := time.Since(requestStart)
+		var egressErr *EgressError
+		if errors.As(err, &egressErr) {
+			// The policy refused to connect, the upstream server isn't at fault and retrying won't help.
+			cancelOutcome()
+			release()
+			c.Metrics.observeEgressDenial(req.URL.Host)
+			return nil, egressErr
+		}
+		c.Metrics.observeUpstream(req.URL.Host, res, err)
+		if recordOutcome(err != nil || res.StatusCode >= 500) {
+			c.breakerOpened(req, options, logger)
+		}
 		if err != nil {
+			release()
+			// Serve the stale response instead of retrying, if allowed.
+			if staleRes, ok := c.staleOnError(req, staleResponse, logger.With("error", err.Error())); ok {
+				return staleRes, nil
+			}
+			if policy.retryable(req, 0, err) {
+				if backoff, ok := policy.backoff(attempt, retryStart); ok {
+					logger.With("error", err.Error()).Warning("request failed")
+					if retry(backoff) {
+						continue
+					}
+					return nil, ctx.Err()
+				}
+				logger.With("error", err.Error()).Warning("retries exhausted")
+			}
 			return nil, err
 		}
 
+		// The request stays in flight until its body is read or closed.
+		res.Body = &releasingBody{ReadCloser: res.Body, release: release}
+
 		logger = logger.With("status_code", fmt.Sprint(res.StatusCode))
 
 		logger.Debug("got response", "status_code", fmt.Sprint(res.StatusCode))
+		c.respectUpstreamQuota(req, res, options, logger)
+		c.throttle.Adapt(req, latency, res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable)
 
-		switch res.StatusCode {
-		case 429, 503:
+		if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
 			// Backoff status codes, meaning we're rate-limited or the service is down.
 			logger.Warning("got backoff status code")
 
@@ -144,51 +529,120 @@ func (c *NiceClient) RoundTripWithOptions(req *http.Request, options *RequestOpt
 			// Add random jitter to prevent thundering herd problem.
 			jitter := rand.Int63n(2000)
 			c.throttle.Block(res.Request, time.Duration(waitTimeMs+jitter)*time.Millisecond)
+			c.Metrics.observeBlock(options.RateLimitRule)
+		}
+
+		exhausted := false
+		if policy.retryable(req, res.StatusCode, nil) {
+			// Serve the stale response instead of waiting for the service to come back, if allowed.
+			if res.StatusCode >= 500 {
+				if staleRes, ok := c.staleOnError(req, staleResponse, logger); ok {
+					res.Body.Close()
+					return staleRes, nil
+				}
+			}
+
+			if backoff, ok := policy.backoff(attempt, retryStart); ok {
+				logger.Warning("got retryable status code")
+				res.Body.Close()
+				if retry(backoff) {
+					continue
+				}
+				return nil, ctx.Err()
+			}
+			logger.Warning("retries exhausted, returning the last response")
+			exhausted = true
+		}
+
+		switch res.StatusCode {
 		case 301, 302, 307, 308:
 			// Handle redirects.
 			// We parse the url passed in the Location header and navigate there,
 			// falling through to the default logic so that this redirect is transparent
 			// to the caller.
 			location, err := url.Parse(res.Header.Get("Location"))
+			res.Body.Close()
 			if err != nil {
 				return nil, err
 			}
-			newReq := &http.Request{
-				Method: req.Method,
-				URL:    location,
-				Header: req.Header,
-				Body:   req.Body,
+			header := req.Header
+			if revalidating {
+				// The validators belong to the original url, don't send them to the new location.
+				header = header.Clone()
+				header.Del("If-None-Match")
+				header.Del("If-Modified-Since")
 			}
+			// Keep the request's context, so that the client's deadline, identity and logger apply to the redirect too.
+			newReq := req.Clone(ctx)
+			newReq.URL = location
+			newReq.Host = ""
+			newReq.RequestURI = ""
+			newReq.Header = header
 			logger.With("to", location.String()).Info("Got redirect")
-			res, err = c.RoundTripWithOptions(newReq, options)
+			res, err = c.roundTrip(newReq, options)
 			if err != nil {
 				return nil, err
 			}
 
 			fallthrough
 		default:
+			// The stale cached response is still valid, refresh it and serve it without downloading the body again.
+			if revalidating && res.StatusCode == http.StatusNotModified {
+				res.Body.Close()
+				cachedResponse, err := c.cache.Revalidate(ctx, staleResponse, res, options.cacheOptions())
+				if err != nil {
+					return nil, err
+				}
+				return cachedResponse.Response(req, CacheStatusRevalidated), nil
+			}
+
+			// Serve the stale response if the upstream server failed and it's allowed.
+			if res.StatusCode >= 500 {
+				if staleRes, ok := c.staleOnError(req, staleResponse, logger); ok {
+					res.Body.Close()
+					return staleRes, nil
+				}
+			}
+
 			// Default case, attempt caching and return the response.
 
 			// Cache GET requests when possible.
-			// Other HTTP methods should never be cached.
-			if req.Method == http.MethodGet {
-				res.Body, err = c.cache.Cache(ctx, originalURL, res, options.MinCacheTTL, options.MaxCacheTTL, options.DefaultCacheTTL)
+			// Other HTTP methods should never be cached, nor should failures that couldn't be retried away.
+			if req.Method == http.MethodGet && !exhausted {
+				body, err := c.cache.Cache(ctx, originalURL, res, options.cacheOptions())
+				if err != nil {
+					return nil, err
+				}
+				res.Body = body
+				if res.Header != nil {
+					res.Header.Set(CacheStatusHeader, CacheStatusMiss)
+				}
 			}
 
-			// Success! Return response and any error.
-			return res, err
+			// Success! Return the response.
+			return res, nil
 		}
+	}
+}
 
-		// Break loop if the context is cancelled
-		select {
-		case <-ctx.Done():
-			return nil, errors.New("context cancelled request retry loop")
-		default:
-		}
+// A response body that releases the request's concurrency slots once it's read or closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
 
-		attempt++
-		logger = logger.With("attempt", fmt.Sprintf("%d", attempt))
+func (b *releasingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.release()
 	}
+	return n, err
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
 }
 
 // Perform a GET request.
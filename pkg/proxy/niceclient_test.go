@@ -2,12 +2,21 @@ package proxy
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/datastructures/eviction"
+	"github.com/KillianMeersman/chaperone/pkg/metrics"
 )
 
 type mockRountTripper struct {
@@ -55,3 +64,720 @@ func TestNiceClient(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// Round tripper that serves a response with an ETag and answers matching conditional requests with 304.
+type mockRevalidatingRoundTripper struct {
+	ETag     string
+	Response []byte
+	// Cache-Control header of the responses, max-age=1 for full responses and max-age=60 for 304 responses if empty.
+	CacheControl      string
+	FullResponses     int
+	NotModifiedCount  int
+	LastRequestHeader http.Header
+}
+
+func (m *mockRevalidatingRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	m.LastRequestHeader = r.Header.Clone()
+
+	if r.Header.Get("If-None-Match") == m.ETag {
+		m.NotModifiedCount++
+		return &http.Response{
+			Request:    r,
+			StatusCode: http.StatusNotModified,
+			Header: http.Header{
+				"Etag":          []string{m.ETag},
+				"Cache-Control": []string{cmp.Or(m.CacheControl, "max-age=60")},
+			},
+			Body: io.NopCloser(bytes.NewReader(nil)),
+		}, nil
+	}
+
+	m.FullResponses++
+	return &http.Response{
+		Request:    r,
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Etag":          []string{m.ETag},
+			"Cache-Control": []string{cmp.Or(m.CacheControl, "max-age=1")},
+		},
+		Body: io.NopCloser(bytes.NewReader(m.Response)),
+	}, nil
+}
+
+func TestNiceClientRevalidatesStaleResponses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	throttle := NewMemoryHTTPThrottle(0)
+	cache := NewMemoryHTTPCache(ctx, 1000)
+
+	roundTripper := &mockRevalidatingRoundTripper{
+		ETag:     `"v1"`,
+		Response: []byte("test"),
+	}
+	client := NewNiceClient(ctx, roundTripper, throttle, cache)
+
+	get := func() *http.Response {
+		req, _ := http.NewRequest("GET", "http://example.com", nil)
+		res, err := client.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, roundTripper.Response) {
+			t.Fatalf("unexpected body %q", body)
+		}
+		return res
+	}
+
+	res := get()
+	if res.Header.Get(CacheStatusHeader) != CacheStatusMiss {
+		t.Fatalf("expected cache miss, got %s", res.Header.Get(CacheStatusHeader))
+	}
+
+	// Wait for the response to become stale, it should be revalidated rather than fetched again.
+	time.Sleep(1100 * time.Millisecond)
+	res = get()
+	if res.Header.Get(CacheStatusHeader) != CacheStatusRevalidated {
+		t.Fatalf("expected revalidated response, got %s", res.Header.Get(CacheStatusHeader))
+	}
+	if roundTripper.LastRequestHeader.Get("If-None-Match") != `"v1"` {
+		t.Fatal("expected conditional request")
+	}
+
+	// The 304 refreshed the response's freshness.
+	res = get()
+	if res.Header.Get(CacheStatusHeader) != CacheStatusHit {
+		t.Fatalf("expected cache hit, got %s", res.Header.Get(CacheStatusHeader))
+	}
+
+	if roundTripper.FullResponses != 1 || roundTripper.NotModifiedCount != 1 {
+		t.Fatalf("expected 1 full response and 1 revalidation, got %d and %d", roundTripper.FullResponses, roundTripper.NotModifiedCount)
+	}
+}
+
+func TestNiceClientRevalidatesNoCacheResponses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+	roundTripper := &mockRevalidatingRoundTripper{
+		ETag:         `"v1"`,
+		Response:     []byte("test"),
+		CacheControl: "no-cache",
+	}
+	client := NewNiceClient(ctx, roundTripper, throttle, NewMemoryHTTPCache(ctx, 1000))
+
+	// Responses that must be revalidated on every request are stored, and served once the upstream server confirms them.
+	for _, expected := range []string{CacheStatusMiss, CacheStatusRevalidated, CacheStatusRevalidated} {
+		req, _ := http.NewRequest("GET", "http://example.com", nil)
+		res, err := client.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if string(body) != "test" || res.Header.Get(CacheStatusHeader) != expected {
+			t.Fatalf("expected %s response with the body, got %s %q", expected, res.Header.Get(CacheStatusHeader), body)
+		}
+	}
+	if roundTripper.FullResponses != 1 || roundTripper.NotModifiedCount != 2 {
+		t.Fatalf("expected 1 full response and 2 revalidations, got %d and %d", roundTripper.FullResponses, roundTripper.NotModifiedCount)
+	}
+}
+
+// Round tripper that serves a cacheable response once, then fails with the configured status code.
+type mockFailingRoundTripper struct {
+	Response   []byte
+	StatusCode int
+	requests   int
+}
+
+func (m *mockFailingRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	m.requests++
+	if m.requests == 1 {
+		return &http.Response{
+			Request:    r,
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=1, stale-if-error=60"},
+			},
+			Body: io.NopCloser(bytes.NewReader(m.Response)),
+		}, nil
+	}
+
+	return &http.Response{
+		Request:    r,
+		StatusCode: m.StatusCode,
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader(nil)),
+	}, nil
+}
+
+func TestNiceClientServesStaleOnError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roundTripper := &mockFailingRoundTripper{
+		Response:   []byte("test"),
+		StatusCode: http.StatusBadGateway,
+	}
+	client := NewNiceClient(ctx, roundTripper, NewMemoryHTTPThrottle(0), NewMemoryHTTPCache(ctx, 1000))
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	res, err := client.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(res.Body)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	req, _ = http.NewRequest("GET", "http://example.com", nil)
+	res, err = client.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get(CacheStatusHeader) != CacheStatusStale {
+		t.Fatalf("expected stale response, got %d %s", res.StatusCode, res.Header.Get(CacheStatusHeader))
+	}
+	body, _ := io.ReadAll(res.Body)
+	if !bytes.Equal(body, roundTripper.Response) {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+// Round tripper that responds slowly and counts the requests it received.
+type mockSlowRoundTripper struct {
+	Response []byte
+	Delay    time.Duration
+	requests atomic.Int32
+}
+
+func (m *mockSlowRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	m.requests.Add(1)
+	time.Sleep(m.Delay)
+
+	return &http.Response{
+		Request:    r,
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Cache-Control": []string{"max-age=60"},
+		},
+		Body: io.NopCloser(bytes.NewReader(m.Response)),
+	}, nil
+}
+
+func TestNiceClientCollapsesConcurrentRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roundTripper := &mockSlowRoundTripper{
+		Response: []byte("test"),
+		Delay:    200 * time.Millisecond,
+	}
+	client := NewNiceClient(ctx, roundTripper, NewMemoryHTTPThrottle(0), NewMemoryHTTPCache(ctx, 1000))
+
+	wg := &sync.WaitGroup{}
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, _ := http.NewRequest("GET", "http://example.com", nil)
+			res, err := client.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := io.ReadAll(res.Body)
+			if !bytes.Equal(body, roundTripper.Response) {
+				t.Errorf("unexpected body %q", body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if requests := roundTripper.requests.Load(); requests != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", requests)
+	}
+}
+
+func TestNiceClientCollapsesOnlySameClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roundTripper := &mockSlowRoundTripper{
+		Response: []byte("test"),
+		Delay:    200 * time.Millisecond,
+	}
+	client := NewNiceClient(ctx, roundTripper, NewMemoryHTTPThrottle(0), NewMemoryHTTPCache(ctx, 1000))
+
+	wg := &sync.WaitGroup{}
+	for i := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, _ := http.NewRequest("GET", "http://example.com", nil)
+			options := &RequestOptions{MaxCacheTTL: time.Hour, Client: "client"}
+			switch i {
+			case 1:
+				req.Header.Set("Authorization", "Bearer other")
+			case 2:
+				options.Client = "other"
+			}
+			res, err := client.RoundTripWithOptions(req, options)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.ReadAll(res.Body)
+		}()
+	}
+	wg.Wait()
+
+	if requests := roundTripper.requests.Load(); requests != 3 {
+		t.Fatalf("expected requests of other clients or credentials not to be collapsed, got %d upstream requests", requests)
+	}
+}
+
+func TestNiceClientCollapseLargeBody(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The body isn't cached and exceeds the size of shared bodies, so it's not buffered to share it.
+	roundTripper := &mockSlowRoundTripper{
+		Response: bytes.Repeat([]byte("test"), MaxSharedBodySize/4+1),
+		Delay:    100 * time.Millisecond,
+	}
+	client := NewNiceClient(ctx, roundTripper, NewMemoryHTTPThrottle(0), NewMemoryHTTPCache(ctx, 100))
+
+	wg := &sync.WaitGroup{}
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, _ := http.NewRequest("GET", "http://example.com", nil)
+			res, err := client.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := io.ReadAll(res.Body)
+			if !bytes.Equal(body, roundTripper.Response) {
+				t.Errorf("unexpected body of %d bytes", len(body))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if requests := roundTripper.requests.Load(); requests != 3 {
+		t.Fatalf("expected every request to be sent upstream, got %d upstream requests", requests)
+	}
+}
+
+func TestNiceClientCollapseSharesBodyFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The body exceeds the size of shared bodies, but the cache writes it to disk, so the file is shared.
+	roundTripper := &mockSlowRoundTripper{
+		Response: bytes.Repeat([]byte("test"), MaxSharedBodySize/4+1),
+		Delay:    100 * time.Millisecond,
+	}
+	cache, err := NewDiskHTTPCache(context.Background(), t.TempDir(), 10*MaxSharedBodySize, eviction.NewLRU[string]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewNiceClient(ctx, roundTripper, NewMemoryHTTPThrottle(0), cache)
+
+	wg := &sync.WaitGroup{}
+	collapsed := atomic.Int32{}
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, _ := http.NewRequest("GET", "http://example.com", nil)
+			res, err := client.RoundTripWithOptions(req, &RequestOptions{MaxCacheTTL: time.Hour})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if !bytes.Equal(body, roundTripper.Response) {
+				t.Errorf("unexpected body of %d bytes", len(body))
+			}
+			if res.Header.Get(CacheStatusHeader) == CacheStatusCollapsed {
+				if res.ContentLength != int64(len(roundTripper.Response)) {
+					t.Errorf("unexpected content length %d", res.ContentLength)
+				}
+				collapsed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if requests := roundTripper.requests.Load(); requests != 1 || collapsed.Load() != 2 {
+		t.Fatalf("expected 1 upstream request and 2 collapsed requests, got %d and %d", requests, collapsed.Load())
+	}
+}
+
+// Round tripper that responds after a delay, unless the request's context is done first.
+type mockContextRoundTripper struct {
+	Delay time.Duration
+}
+
+func (m *mockContextRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	select {
+	case <-time.After(m.Delay):
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+	return &http.Response{
+		Request:    r,
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewReader([]byte("test"))),
+	}, nil
+}
+
+func TestNiceClientCollapsedLeaderAborts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := NewNiceClient(ctx, &mockContextRoundTripper{Delay: 200 * time.Millisecond}, NewMemoryHTTPThrottle(0), NewMemoryHTTPCache(ctx, 1000))
+	client.RetryPolicy = RetryPolicy{}
+
+	leaderCtx, cancelLeader := context.WithCancel(ctx)
+	go func() {
+		req, _ := http.NewRequestWithContext(leaderCtx, "GET", "http://example.com", nil)
+		client.RoundTrip(req)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	time.AfterFunc(50*time.Millisecond, cancelLeader)
+
+	// The follower performs the request itself instead of failing with the leader's error.
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	res, err := client.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "test" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestNiceClientRecordsMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roundTripper := &mockSlowRoundTripper{
+		Response: []byte("test"),
+	}
+	client := NewNiceClient(ctx, roundTripper, NewMemoryHTTPThrottle(0), NewMemoryHTTPCache(ctx, 1000))
+	registry := metrics.NewRegistry()
+	client.Metrics = NewClientMetrics(registry)
+
+	options := &RequestOptions{MaxCacheTTL: time.Hour, CacheRule: "example", RateLimitRule: "default"}
+	for range 2 {
+		req, _ := http.NewRequest("GET", "http://example.com", nil)
+		res, err := client.RoundTripWithOptions(req, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(res.Body)
+	}
+
+	buffer := &bytes.Buffer{}
+	registry.Write(buffer)
+	output := buffer.String()
+
+	for _, expected := range []string{
+		`chaperone_cache_hits_total{rule="example"} 1`,
+		`chaperone_cache_misses_total{rule="example"} 1`,
+		`chaperone_cache_hit_bytes_total{rule="example"} 4`,
+		`chaperone_upstream_responses_total{host="example.com",code="200"} 1`,
+		`chaperone_throttle_wait_seconds_count{rule="default"} 1`,
+		`chaperone_requests_in_flight 0`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("expected %q in metrics:\n%s", expected, output)
+		}
+	}
+}
+
+// Round tripper that advertises the remaining upstream quota in its rate limit headers.
+type mockQuotaRoundTripper struct {
+	Remaining atomic.Int32
+}
+
+func (m *mockQuotaRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	remaining := m.Remaining.Add(-1)
+	return &http.Response{
+		Request:    r,
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"X-Ratelimit-Limit":     []string{"10"},
+			"X-Ratelimit-Remaining": []string{fmt.Sprint(remaining)},
+			"X-Ratelimit-Reset":     []string{"0.5"},
+		},
+		Body: io.NopCloser(bytes.NewReader(nil)),
+	}, nil
+}
+
+func TestNiceClientRespectsUpstreamQuota(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+	cache := NewMemoryHTTPCache(context.Background(), 1000)
+
+	roundTripper := &mockQuotaRoundTripper{}
+	roundTripper.Remaining.Store(2)
+	client := NewNiceClient(context.Background(), roundTripper, throttle, cache)
+
+	// Requests to other urls on the host share the upstream quota.
+	start := time.Now()
+	for _, path := range []string{"/a", "/b", "/c"} {
+		req, _ := http.NewRequest("POST", "http://example.com"+path, nil)
+		res, err := client.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	// With 1 of 10 requests left, the second request waits for the reset. With none left, so does the third.
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("requests weren't spread over the upstream quota, took %s", elapsed)
+	}
+}
+
+// Round tripper that fails with the status code, recording the bodies of the requests.
+type mockRetryRoundTripper struct {
+	StatusCode int
+	Bodies     []string
+}
+
+func (m *mockRetryRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	body := []byte{}
+	if r.Body != nil {
+		body, _ = io.ReadAll(r.Body)
+	}
+	m.Bodies = append(m.Bodies, string(body))
+	return &http.Response{
+		Request:    r,
+		StatusCode: m.StatusCode,
+		Body:       io.NopCloser(strings.NewReader("failed")),
+	}, nil
+}
+
+func TestNiceClientRetryPolicy(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+	cache := NewMemoryHTTPCache(context.Background(), 1000)
+
+	roundTripper := &mockRetryRoundTripper{StatusCode: http.StatusBadGateway}
+	client := NewNiceClient(context.Background(), roundTripper, throttle, cache)
+	client.RetryPolicy = RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 10 * time.Millisecond,
+		StatusCodes:    []int{http.StatusBadGateway},
+	}
+
+	// Idempotent requests are retried with their body until the attempts run out, the last response is returned.
+	req, _ := http.NewRequest("PUT", "http://example.com", strings.NewReader("body"))
+	res, err := client.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusBadGateway || string(body) != "failed" {
+		t.Fatalf("expected the last response, got %d %q", res.StatusCode, body)
+	}
+	if len(roundTripper.Bodies) != 3 || roundTripper.Bodies[2] != "body" {
+		t.Fatalf("expected 3 attempts with the request body, got %q", roundTripper.Bodies)
+	}
+
+	// Other requests are only sent once.
+	roundTripper.Bodies = nil
+	req, _ = http.NewRequest("POST", "http://example.com", strings.NewReader("body"))
+	if _, err := client.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if len(roundTripper.Bodies) != 1 {
+		t.Fatalf("expected 1 attempt, got %d", len(roundTripper.Bodies))
+	}
+
+	// Requests whose context ends while backing off return the context's error.
+	client.RetryPolicy.InitialBackoff = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, "GET", "http://example.com", nil)
+	if _, err := client.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context's error, got %v", err)
+	}
+}
+
+// Round tripper that records when requests arrive and holds them until the gate is closed.
+type mockGatedRoundTripper struct {
+	gate     chan struct{}
+	lock     sync.Mutex
+	arrivals []time.Time
+}
+
+func (m *mockGatedRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	m.lock.Lock()
+	m.arrivals = append(m.arrivals, time.Now())
+	m.lock.Unlock()
+	<-m.gate
+	return &http.Response{Request: r, StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("OK"))}, nil
+}
+
+func (m *mockGatedRoundTripper) count() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.arrivals)
+}
+
+func TestNiceClientMaxConcurrentKeepsSpacing(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+	throttleURL, _ := url.Parse("http://example.com")
+	throttle.SetThrottle(&http.Request{Method: "GET", URL: throttleURL}, Limit{Interval: 100 * time.Millisecond, Burst: 1, MaxConcurrent: 2})
+	roundTripper := &mockGatedRoundTripper{gate: make(chan struct{})}
+	client := NewNiceClient(context.Background(), roundTripper, throttle, NewMemoryHTTPCache(context.Background(), 1000))
+
+	wg := sync.WaitGroup{}
+	for _, path := range []string{"/a", "/b", "/c", "/d"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+			res, err := client.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}()
+	}
+
+	// Two requests are in flight, the others queue on the concurrency limit long enough for the rate to allow them.
+	for roundTripper.count() < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+	close(roundTripper.gate)
+	wg.Wait()
+
+	// The queued requests are still spaced by the rate once the in-flight requests finish together.
+	if len(roundTripper.arrivals) != 4 {
+		t.Fatalf("expected 4 upstream requests, got %d", len(roundTripper.arrivals))
+	}
+	if spacing := roundTripper.arrivals[3].Sub(roundTripper.arrivals[2]); spacing < 90*time.Millisecond {
+		t.Fatalf("expected the queued requests to be spaced by the rate, got %s", spacing)
+	}
+}
+
+// Round tripper that redirects /old to /new and records the requests it receives.
+type mockRedirectRoundTripper struct {
+	requests []*http.Request
+}
+
+func (m *mockRedirectRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	m.requests = append(m.requests, r)
+	res := &http.Response{Request: r, StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("new"))}
+	if r.URL.Path == "/old" {
+		res.StatusCode = http.StatusFound
+		res.Header.Set("Location", "http://example.com/new")
+	}
+	return res, nil
+}
+
+type testContextKey struct{}
+
+func TestNiceClientRedirectKeepsContext(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+	roundTripper := &mockRedirectRoundTripper{}
+	client := NewNiceClient(context.Background(), roundTripper, throttle, NewMemoryHTTPCache(context.Background(), 1000))
+
+	ctx := context.WithValue(context.Background(), testContextKey{}, "value")
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://example.com/old", nil)
+	res, err := client.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "new" || len(roundTripper.requests) != 2 {
+		t.Fatalf("expected the redirect to be followed, got %q after %d requests", body, len(roundTripper.requests))
+	}
+	redirected := roundTripper.requests[1]
+	if redirected.URL.String() != "http://example.com/new" || redirected.Context().Value(testContextKey{}) != "value" {
+		t.Fatalf("expected the redirect to %s to keep the request's context", redirected.URL)
+	}
+}
+
+func TestNiceClientCircuitBreaker(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+	cache := NewMemoryHTTPCache(context.Background(), 1000)
+
+	roundTripper := &mockRetryRoundTripper{StatusCode: http.StatusInternalServerError}
+	client := NewNiceClient(context.Background(), roundTripper, throttle, cache)
+	client.Breakers = NewCircuitBreakers(BreakerSettings{ConsecutiveFailures: 2, OpenDuration: time.Minute})
+
+	for range 2 {
+		req, _ := http.NewRequest("GET", "http://example.com", nil)
+		if _, err := client.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once open, requests fail fast without being sent.
+	req, _ := http.NewRequest("GET", "http://example.com/other", nil)
+	start := time.Now()
+	_, err := client.RoundTrip(req)
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || openErr.Breaker != "example.com" {
+		t.Fatalf("expected the circuit breaker to be open, got %v", err)
+	}
+	if time.Since(start) > 100*time.Millisecond || len(roundTripper.Bodies) != 2 {
+		t.Fatal("expected the request to fail fast")
+	}
+}
+
+func TestNiceClientClientThrottle(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+	throttle.SetThrottle(ClientThrottleRequest("crawler"), IntervalLimit(200*time.Millisecond))
+	client := NewNiceClient(context.Background(), &mockRountTripper{Response: []byte("test")}, throttle, NewMemoryHTTPCache(context.Background(), 1000))
+
+	start := time.Now()
+	for _, path := range []string{"/a", "/b", "/c"} {
+		req, _ := http.NewRequest("POST", "http://example.com"+path, nil)
+		if _, err := client.RoundTripWithOptions(req, &RequestOptions{Client: "crawler", ClientThrottle: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("expected requests to wait on the client's budget, took %s", elapsed)
+	}
+
+	// Other clients don't spend the budget.
+	start = time.Now()
+	req, _ := http.NewRequest("POST", "http://example.com/d", nil)
+	if _, err := client.RoundTripWithOptions(req, &RequestOptions{Client: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("expected other clients not to wait, took %s", elapsed)
+	}
+}
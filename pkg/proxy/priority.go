@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Request header with the priority of a request in the throttle queue: high, normal or low.
+const PriorityHeader = "X-Chaperone-Priority"
+
+// Request header identifying the client that sent a request, which shares throttles fairly with the other clients.
+const ClientHeader = "X-Chaperone-Client"
+
+// Priority of a request waiting on a throttle. Waiting requests with a higher priority take the next slot.
+// The zero value is the normal priority.
+type Priority int
+
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+)
+
+const numPriorities = 3
+
+// Minimum fraction of a throttle's slots every priority gets while it has requests waiting,
+// so that requests with a low priority are never starved by requests with a higher one.
+var PriorityMinShare = 0.1
+
+var priorityNames = map[Priority]string{
+	PriorityLow:    "low",
+	PriorityNormal: "normal",
+	PriorityHigh:   "high",
+}
+
+// Parse a priority: high, normal or low.
+func ParsePriority(value string) (Priority, error) {
+	for priority, name := range priorityNames {
+		if strings.EqualFold(strings.TrimSpace(value), name) {
+			return priority, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("invalid priority '%s', expected high, normal or low", value)
+}
+
+func (p Priority) String() string {
+	return priorityNames[p]
+}
+
+type priorityContextKey struct{}
+
+// Get a context for waiting on the throttle with the provided priority.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, priority)
+}
+
+// Get the priority of a wait on the throttle, normal if the context has none.
+func priorityFromContext(ctx context.Context) Priority {
+	priority, ok := ctx.Value(priorityContextKey{}).(Priority)
+	if !ok {
+		return PriorityNormal
+	}
+	return min(max(priority, PriorityLow), PriorityHigh)
+}
+
+type clientContextKey struct{}
+
+// The client of a request waiting on the throttle.
+type waitClient struct {
+	name   string
+	weight float64
+}
+
+// Get a context for waiting on the throttle on behalf of the client, which gets a share of every throttle in proportion
+// to its weight.
+func WithClient(ctx context.Context, client string, weight float64) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, waitClient{name: client, weight: weight})
+}
+
+// Method of the throttles of clients' budgets, see ClientThrottleRequest.
+const ClientThrottleMethod = "CLIENT"
+
+// Get the request for the throttle of a client's budget of upstream requests, like `CLIENT client://crawler`.
+// Requests wait on their client's throttle as well as their own if RequestOptions.ClientThrottle is set.
+func ClientThrottleRequest(client string) *http.Request {
+	return &http.Request{Method: ClientThrottleMethod, URL: &url.URL{Scheme: "client", Host: client}}
+}
+
+// Get the client of a wait on the throttle and its weight, an anonymous client with weight 1 if the context has none.
+func clientFromContext(ctx context.Context) (string, float64) {
+	client, ok := ctx.Value(clientContextKey{}).(waitClient)
+	if !ok || client.weight <= 0 {
+		return client.name, 1
+	}
+	return client.name, client.weight
+}
+
+// Credit a lane gets whenever a slot goes to a higher lane while it has requests waiting.
+// A lane with a full credit takes the next slot, so it gets one slot in every 1/PriorityMinShare.
+func priorityCredit() float64 {
+	if PriorityMinShare <= 0 {
+		return 0
+	}
+	if PriorityMinShare >= 1 {
+		return 1
+	}
+	return PriorityMinShare / (1 - PriorityMinShare)
+}
+
+// A request waiting for a slot of the MemoryHTTPThrottle.
+type waiter struct {
+	priority Priority
+	// Arrival order of the request, see waiter.canTake.
+	seq uint64
+	// Client that sent the request and its weight, see lane.
+	client    string
+	weight    float64
+	throttles []*hostThrottle
+	limiters  []*limiter
+	// Closed once the request may be sent.
+	ready chan struct{}
+	// Slot reserved for the request, zero if it was released without one.
+	slot time.Time
+}
+
+// A request queued in a lane, with its virtual start and finish time.
+type queuedWaiter struct {
+	*waiter
+	start  float64
+	finish float64
+}
+
+// Requests with the same priority waiting on a throttle, ordered by weighted fair queueing between their clients:
+// a request finishes 1/weight after the previous request of its client, or after the virtual time if the client has
+// none queued, and requests take slots in the order they finish. Every client waiting on the throttle gets a share of
+// its slots in proportion to its weight, however many requests it queued.
+type lane struct {
+	queue []queuedWaiter
+	// Virtual time: the start of the request that took the last slot.
+	vtime float64
+	// Finish of the last request queued by every client.
+	finish map[string]float64
+	// Slots the lane is owed, see priorityCredit.
+	credit float64
+}
+
+// Get the virtual start and finish time of a new request.
+func (l *lane) tags(w *waiter) (float64, float64) {
+	start := max(l.vtime, l.finish[w.client])
+	return start, start + 1/w.weight
+}
+
+// Requests waiting on a throttle, in a lane per priority.
+type lanes [numPriorities]lane
+
+func (l *lanes) len() int {
+	n := 0
+	for _, lane := range l {
+		n += len(lane.queue)
+	}
+	return n
+}
+
+func (l *lanes) push(w *waiter) {
+	if l.len() == 0 {
+		// Start the virtual time over once the throttle has no requests waiting.
+		*l = lanes{}
+	}
+
+	lane := &l[w.priority+1]
+	start, finish := lane.tags(w)
+	if lane.finish == nil {
+		lane.finish = make(map[string]float64)
+	}
+	lane.finish[w.client] = finish
+
+	i, _ := slices.BinarySearchFunc(lane.queue, finish, func(queued queuedWaiter, finish float64) int {
+		if queued.finish > finish {
+			return 1
+		}
+		return -1
+	})
+	lane.queue = slices.Insert(lane.queue, i, queuedWaiter{waiter: w, start: start, finish: finish})
+}
+
+func (l *lanes) remove(w *waiter) {
+	lane := &l[w.priority+1]
+	lane.queue = slices.DeleteFunc(lane.queue, func(queued queuedWaiter) bool {
+		return queued.waiter == w
+	})
+	if len(lane.queue) == 0 {
+		lane.credit = 0
+	}
+}
+
+// Get the number of requests that are ahead of a new request.
+func (l *lanes) ahead(w *waiter) int {
+	n := 0
+	for priority := int(w.priority + 2); priority < numPriorities; priority++ {
+		n += len(l[priority].queue)
+	}
+
+	lane := &l[w.priority+1]
+	_, finish := lane.tags(w)
+	for _, queued := range lane.queue {
+		if queued.finish <= finish {
+			n++
+		}
+	}
+	return n
+}
+
+// Get the request that takes the next slot: the first request of the highest lane that is owed a slot,
+// otherwise of the highest lane. Nil if no requests are waiting.
+// Lanes are credited per throttle, so requests waiting on several throttles may head only some, see waiter.canTake.
+func (l *lanes) head() *waiter {
+	for priority := numPriorities - 1; priority >= 0; priority-- {
+		if len(l[priority].queue) > 0 && l[priority].credit >= 1 {
+			return l[priority].queue[0].waiter
+		}
+	}
+	for priority := numPriorities - 1; priority >= 0; priority-- {
+		if len(l[priority].queue) > 0 {
+			return l[priority].queue[0].waiter
+		}
+	}
+	return nil
+}
+
+// Remove a request that took a slot, advancing the virtual time of its lane and crediting the lower lanes that have
+// requests waiting.
+func (l *lanes) take(w *waiter) {
+	priority := int(w.priority + 1)
+	for _, queued := range l[priority].queue {
+		if queued.waiter == w {
+			l[priority].vtime = queued.start
+		}
+	}
+
+	l[priority].credit = max(l[priority].credit-1, 0)
+	for lower := range priority {
+		if len(l[lower].queue) > 0 {
+			l[lower].credit += priorityCredit()
+		}
+	}
+	l.remove(w)
+}
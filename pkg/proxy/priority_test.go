@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParsePriority(t *testing.T) {
+	for value, expected := range map[string]Priority{"high": PriorityHigh, "Normal": PriorityNormal, " low ": PriorityLow} {
+		priority, err := ParsePriority(value)
+		if err != nil || priority != expected {
+			t.Fatalf("expected %s for '%s', got %s (%v)", expected, value, priority, err)
+		}
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Fatal("expected an error for an unknown priority")
+	}
+
+	if priorityFromContext(context.Background()) != PriorityNormal {
+		t.Fatal("expected the normal priority by default")
+	}
+	if priorityFromContext(WithPriority(context.Background(), PriorityHigh)) != PriorityHigh {
+		t.Fatal("expected the priority of the context")
+	}
+}
+
+func TestLanesMinShare(t *testing.T) {
+	l := &lanes{}
+	for range 100 {
+		l.push(&waiter{priority: PriorityHigh, weight: 1})
+		l.push(&waiter{priority: PriorityLow, weight: 1})
+	}
+
+	// Out of every 10 slots, the low lane gets at least one.
+	low := 0
+	for range 100 {
+		w := l.head()
+		if w.priority == PriorityLow {
+			low++
+		}
+		l.take(w)
+	}
+	if low < 10 || low > 11 {
+		t.Fatalf("expected the low lane to get 10%% of the slots, got %d", low)
+	}
+}
+
+func TestLanesFairQueueing(t *testing.T) {
+	l := &lanes{}
+
+	// A noisy client queues all its requests first, a client with twice the weight queues its requests after.
+	for range 10 {
+		l.push(&waiter{client: "noisy", weight: 1})
+	}
+	for range 10 {
+		l.push(&waiter{client: "heavy", weight: 2})
+	}
+
+	slots := map[string]int{}
+	for range 6 {
+		w := l.head()
+		slots[w.client]++
+		l.take(w)
+	}
+	if slots["noisy"] != 2 || slots["heavy"] != 4 {
+		t.Fatalf("expected the slots to be shared by weight, got %v", slots)
+	}
+
+	// A client that arrives later isn't queued behind the requests of the others.
+	newcomer := &waiter{client: "newcomer", weight: 1}
+	if ahead := l.ahead(newcomer); ahead > 3 {
+		t.Fatalf("expected the new client to be near the head of the queue, %d requests are ahead", ahead)
+	}
+	l.push(newcomer)
+	taken := false
+	for range 3 {
+		w := l.head()
+		taken = taken || w == newcomer
+		l.take(w)
+	}
+	if !taken {
+		t.Fatal("expected the new client to get one of the next slots")
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fraction of an upstream quota below which requests are spread over the time until it resets.
+var UpstreamQuotaSlowdownRatio = 0.1
+
+// Reset values above this are unix timestamps rather than a number of seconds.
+const unixResetThreshold = 1e9
+
+// The quota an upstream server advertises in its rate limit headers.
+type UpstreamQuota struct {
+	// Number of requests per window, zero if unknown.
+	Limit     int
+	Remaining int
+	// Time until the quota resets.
+	Reset time.Duration
+}
+
+// Get how long requests should be held back so that the quota lasts until it resets.
+// Requests are held back until the reset once the quota is spent. Once it runs low, they are spread over the time until the reset.
+func (q UpstreamQuota) Delay() time.Duration {
+	switch {
+	case q.Reset <= 0:
+		return 0
+	case q.Remaining <= 0:
+		return q.Reset
+	case q.Limit > 0 && float64(q.Remaining) > float64(q.Limit)*UpstreamQuotaSlowdownRatio:
+		return 0
+	}
+	return q.Reset / time.Duration(q.Remaining)
+}
+
+// Parse a number of seconds, which may be fractional.
+func parseSeconds(value string) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(strings.Trim(strings.TrimSpace(value), `"`), 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// Parse the parameters of a structured header item like `"default";r=50;t=30` or `limit=100`.
+func parseHeaderParams(item string) map[string]string {
+	params := make(map[string]string)
+	for _, param := range strings.Split(item, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok {
+			params[strings.ToLower(key)] = strings.Trim(value, `"`)
+		}
+	}
+	return params
+}
+
+// Parse the quotas of the IETF RateLimit header, in either its dictionary form `limit=100, remaining=50, reset=5`
+// or its list form `"default";r=50;t=30`. Limits of the list form are taken from the RateLimit-Policy header.
+func parseRateLimitHeader(header http.Header) []UpstreamQuota {
+	policies := make(map[string]int)
+	for _, item := range strings.Split(strings.Join(header.Values("RateLimit-Policy"), ","), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(item), ";")
+		if limit, err := strconv.Atoi(parseHeaderParams(item)["q"]); err == nil {
+			policies[strings.Trim(name, `"`)] = limit
+		}
+	}
+
+	quotas := make([]UpstreamQuota, 0)
+	dictionary := make(map[string]string)
+	for _, item := range strings.Split(strings.Join(header.Values("RateLimit"), ","), ",") {
+		params := parseHeaderParams(item)
+		remaining, ok := params["r"]
+		if !ok {
+			for key, value := range params {
+				dictionary[key] = value
+			}
+			continue
+		}
+
+		quota := UpstreamQuota{}
+		name, _, _ := strings.Cut(strings.TrimSpace(item), ";")
+		quota.Limit = policies[strings.Trim(name, `"`)]
+		quota.Remaining, _ = strconv.Atoi(remaining)
+		quota.Reset, _ = parseSeconds(params["t"])
+		quotas = append(quotas, quota)
+	}
+
+	if remaining, ok := dictionary["remaining"]; ok {
+		quota := UpstreamQuota{}
+		quota.Limit, _ = strconv.Atoi(dictionary["limit"])
+		quota.Remaining, _ = strconv.Atoi(remaining)
+		quota.Reset, _ = parseSeconds(dictionary["reset"])
+		quotas = append(quotas, quota)
+	}
+	return quotas
+}
+
+// Parse a quota from separate limit, remaining and reset headers with the provided prefix, like X-RateLimit-Remaining.
+// Reset values may be a number of seconds or a unix timestamp.
+func parseRateLimitFields(header http.Header, prefix string, now time.Time) (UpstreamQuota, bool) {
+	remaining, err := strconv.Atoi(strings.TrimSpace(header.Get(prefix + "-Remaining")))
+	if err != nil {
+		return UpstreamQuota{}, false
+	}
+
+	quota := UpstreamQuota{Remaining: remaining}
+	quota.Limit, _ = strconv.Atoi(strings.TrimSpace(header.Get(prefix + "-Limit")))
+	if reset, ok := parseSeconds(header.Get(prefix + "-Reset")); ok {
+		if reset.Seconds() > unixResetThreshold {
+			reset = time.Unix(0, int64(reset)).Sub(now)
+		}
+		quota.Reset = reset
+	}
+	return quota, true
+}
+
+// Parse the upstream quotas advertised by a response, from the IETF RateLimit headers
+// and the RateLimit-Remaining and X-RateLimit-Remaining families of headers.
+func ParseRateLimitHeaders(res *http.Response, now time.Time) []UpstreamQuota {
+	quotas := parseRateLimitHeader(res.Header)
+	for _, prefix := range []string{"RateLimit", "X-RateLimit"} {
+		if quota, ok := parseRateLimitFields(res.Header, prefix, now); ok {
+			quotas = append(quotas, quota)
+		}
+	}
+	return quotas
+}
+
+// Get how long requests should be held back to respect the quotas advertised by a response, zero if they don't need to be.
+func UpstreamQuotaDelay(res *http.Response, now time.Time) time.Duration {
+	delay := time.Duration(0)
+	for _, quota := range ParseRateLimitHeaders(res, now) {
+		delay = max(delay, quota.Delay())
+	}
+	return delay
+}
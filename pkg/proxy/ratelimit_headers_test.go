@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUpstreamQuotaDelay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	for _, test := range []struct {
+		header   http.Header
+		expected time.Duration
+	}{
+		// Plenty of requests left.
+		{http.Header{"X-Ratelimit-Limit": {"100"}, "X-Ratelimit-Remaining": {"50"}, "X-Ratelimit-Reset": {"30"}}, 0},
+		// Spent quota, reset as a unix timestamp.
+		{http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"1700000060"}}, time.Minute},
+		// Low quota, spread over the time until the reset.
+		{http.Header{"Ratelimit-Limit": {"100"}, "Ratelimit-Remaining": {"5"}, "Ratelimit-Reset": {"10"}}, 2 * time.Second},
+		{http.Header{"Ratelimit": {"limit=100, remaining=0, reset=5"}}, 5 * time.Second},
+		{http.Header{"Ratelimit": {`"default";r=4;t=20`}, "Ratelimit-Policy": {`"default";q=100;w=60`}}, 5 * time.Second},
+		{http.Header{"Ratelimit": {`"default";r=40;t=20`}, "Ratelimit-Policy": {`"default";q=100;w=60`}}, 0},
+		// The most restrictive quota applies.
+		{http.Header{"Ratelimit": {`"minute";r=50;t=20, "day";r=0;t=3600`}}, time.Hour},
+		{http.Header{}, 0},
+	} {
+		delay := UpstreamQuotaDelay(&http.Response{Header: test.header}, now)
+		if delay != test.expected {
+			t.Fatalf("expected delay %s for %v, got %s", test.expected, test.header, delay)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// Classes of errors a retry policy can retry.
+const (
+	// The connection failed, was refused or reset, or the host couldn't be resolved.
+	RetryErrorConnection = "connection"
+	// The request timed out.
+	RetryErrorTimeout = "timeout"
+)
+
+// Methods that can safely be sent more than once, see RFC 9110.
+var idempotentMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete,
+}
+
+// Decides which failed requests are retried, how often and how long to wait in between.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first. Zero for unlimited.
+	MaxAttempts int
+	// Maximum time spent retrying a request. Zero for unlimited.
+	MaxRetryTime time.Duration
+	// Maximum backoff before the first retry, doubled on every further retry up to MaxBackoff.
+	// The backoff is picked at random up to the maximum, so that clients don't retry in lockstep.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Status codes that are retried.
+	StatusCodes []int
+	// Classes of errors that are retried, see RetryErrorConnection and RetryErrorTimeout.
+	Errors []string
+}
+
+// The policy used when none is configured: retry rate-limited and unavailable responses, as well as gateway and connection errors.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		MaxRetryTime:   5 * time.Minute,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		StatusCodes:    []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		Errors:         []string{RetryErrorConnection, RetryErrorTimeout},
+	}
+}
+
+// Get the class of an error returned by a round tripper, empty if it isn't retryable.
+func classifyError(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return RetryErrorTimeout
+	}
+
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &opErr), errors.As(err, &dnsErr),
+		errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return RetryErrorConnection
+	}
+	return ""
+}
+
+// Return true if the request never reached the upstream server, so sending it again can't repeat its effects.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return (errors.As(err, &opErr) && opErr.Op == "dial") || errors.As(err, &dnsErr)
+}
+
+// Return true if the request can safely be sent more than once.
+// Requests with an Idempotency-Key header are deduplicated by the upstream server.
+func isIdempotent(req *http.Request) bool {
+	return slices.Contains(idempotentMethods, req.Method) || req.Header.Get("Idempotency-Key") != ""
+}
+
+// Return true if the policy retries the outcome of a request, either a response with the status code or an error.
+// Requests that aren't idempotent are only retried if the upstream server didn't process them:
+// when it refused them with a 429 or 503 status, or when the connection couldn't be made.
+func (p RetryPolicy) retryable(req *http.Request, statusCode int, err error) bool {
+	if err != nil {
+		if !slices.Contains(p.Errors, classifyError(err)) {
+			return false
+		}
+		return isIdempotent(req) || isDialError(err)
+	}
+
+	if !slices.Contains(p.StatusCodes, statusCode) {
+		return false
+	}
+	return isIdempotent(req) || statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// Get the backoff before the next attempt, after the attempt that started at start.
+// Returns false if the attempts or the retry time are exhausted.
+func (p RetryPolicy) backoff(attempt int, start time.Time) (time.Duration, bool) {
+	if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+		return 0, false
+	}
+
+	maxBackoff := p.InitialBackoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || maxBackoff < p.MaxBackoff); i++ {
+		maxBackoff *= 2
+	}
+	if p.MaxBackoff > 0 {
+		maxBackoff = min(maxBackoff, p.MaxBackoff)
+	}
+
+	backoff := time.Duration(0)
+	if maxBackoff > 0 {
+		backoff = time.Duration(rand.Int63n(int64(maxBackoff)) + 1)
+	}
+	if p.MaxRetryTime > 0 && time.Since(start)+backoff > p.MaxRetryTime {
+		return 0, false
+	}
+	return backoff, true
+}
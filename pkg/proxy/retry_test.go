@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	get, _ := http.NewRequest("GET", "http://example.com", nil)
+	post, _ := http.NewRequest("POST", "http://example.com", nil)
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	for _, test := range []struct {
+		req        *http.Request
+		statusCode int
+		err        error
+		expected   bool
+	}{
+		{get, http.StatusBadGateway, nil, true},
+		{get, http.StatusInternalServerError, nil, false},
+		{get, 0, readErr, true},
+		// The upstream server may have processed a POST request, unless it refused it or was never reached.
+		{post, http.StatusBadGateway, nil, false},
+		{post, http.StatusTooManyRequests, nil, true},
+		{post, 0, readErr, false},
+		{post, 0, dialErr, true},
+		{get, 0, errors.New("malformed request"), false},
+	} {
+		if retryable := policy.retryable(test.req, test.statusCode, test.err); retryable != test.expected {
+			t.Fatalf("expected retryable to be %v for %s %d %v", test.expected, test.req.Method, test.statusCode, test.err)
+		}
+	}
+
+	// An Idempotency-Key makes any request safe to retry.
+	post.Header.Set("Idempotency-Key", "abc")
+	if !policy.retryable(post, http.StatusBadGateway, nil) {
+		t.Fatal("expected a request with an idempotency key to be retried")
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     250 * time.Millisecond,
+	}
+	start := time.Now()
+
+	for attempt, maxBackoff := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 250 * time.Millisecond} {
+		backoff, ok := policy.backoff(attempt, start)
+		if !ok || backoff <= 0 || backoff > maxBackoff {
+			t.Fatalf("unexpected backoff %s for attempt %d", backoff, attempt)
+		}
+	}
+	if _, ok := policy.backoff(4, start); ok {
+		t.Fatal("expected the attempts to be exhausted")
+	}
+
+	policy.MaxRetryTime = time.Second
+	if _, ok := policy.backoff(1, start.Add(-time.Second)); ok {
+		t.Fatal("expected the retry time to be exhausted")
+	}
+}
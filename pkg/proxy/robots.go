@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/log"
+)
+
+// Request header to stop a request from respecting the upstream server's robots.txt, with `false` or `0`.
+const RespectRobotsHeader = "X-Respect-Robots"
+
+// Header set on responses rejected because the upstream server's robots.txt disallows them.
+const RobotsHeader = "X-Chaperone-Robots"
+
+// Maximum time a robots.txt file is cached, unless it can't be fetched again, see RFC 9309.
+const RobotsCacheTTL = 24 * time.Hour
+
+// Only the first 500 KiB of a robots.txt file are parsed, see RFC 9309.
+const robotsMaxSize = 500 << 10
+
+// Returned when a request is rejected because the upstream server's robots.txt disallows it.
+type RobotsError struct {
+	URL       string
+	UserAgent string
+	// Status code the robots.txt file was served with if it couldn't be fetched, which disallows every url. Zero otherwise.
+	StatusCode int
+}
+
+func (e *RobotsError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("robots.txt for %s is unavailable (status %d), all urls are disallowed", e.URL, e.StatusCode)
+	}
+	return fmt.Sprintf("robots.txt disallows %s for user agent %s", e.URL, e.UserAgent)
+}
+
+// An allow or disallow rule of a robots.txt file.
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// A group of rules of a robots.txt file and the user agents they apply to.
+type robotsGroup struct {
+	userAgents []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// The rules of a robots.txt file that apply to a user agent.
+type Robots struct {
+	rules []robotsRule
+	// Time to wait between requests, zero if the file doesn't set one.
+	CrawlDelay time.Duration
+	// Set if the file was fetched from the upstream server, rather than served from the cache.
+	fetched bool
+}
+
+// Get the lowercase product token of a user agent, like `chaperonebot` for `ChaperoneBot/0.1`.
+func productToken(userAgent string) string {
+	token, _, _ := strings.Cut(strings.TrimSpace(userAgent), "/")
+	return strings.ToLower(strings.TrimSpace(token))
+}
+
+// Parse the rules of a robots.txt file that apply to the user agent, see RFC 9309.
+// The groups for the user agent's product token apply, or the `*` groups if there are none. Crawl-delay is supported too.
+func ParseRobots(body io.Reader, userAgent string) *Robots {
+	groups := make([]*robotsGroup, 0)
+	var group *robotsGroup
+	// Whether the current group has rules, so that the next user-agent line starts a new group.
+	hasRules := false
+
+	scanner := bufio.NewScanner(io.LimitReader(body, robotsMaxSize))
+	scanner.Buffer(make([]byte, 0, 4096), robotsMaxSize)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if key == "user-agent" {
+			if group == nil || hasRules {
+				group = &robotsGroup{}
+				groups = append(groups, group)
+				hasRules = false
+			}
+			group.userAgents = append(group.userAgents, productToken(value))
+			continue
+		}
+		// Rules before the first user-agent line belong to no group.
+		if group == nil {
+			continue
+		}
+
+		switch key {
+		case "allow", "disallow":
+			hasRules = true
+			// An empty disallow rule allows everything.
+			if value != "" {
+				group.rules = append(group.rules, robotsRule{allow: key == "allow", pattern: value})
+			}
+		case "crawl-delay":
+			hasRules = true
+			if delay, ok := parseSeconds(value); ok {
+				group.crawlDelay = delay
+			}
+		}
+	}
+
+	robots := &Robots{}
+	for _, token := range []string{productToken(userAgent), "*"} {
+		matched := false
+		for _, group := range groups {
+			if slices.Contains(group.userAgents, token) {
+				matched = true
+				robots.rules = append(robots.rules, group.rules...)
+				robots.CrawlDelay = max(robots.CrawlDelay, group.crawlDelay)
+			}
+		}
+		if matched {
+			break
+		}
+	}
+	return robots
+}
+
+// Return true if the path matches the pattern of a robots.txt rule: a path prefix in which `*` matches any sequence of
+// characters, ending the pattern with `$` makes it match the end of the path.
+func matchRobotsPattern(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	parts := strings.Split(strings.TrimSuffix(pattern, "$"), "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+
+	rest := path[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			return strings.HasSuffix(rest, part)
+		}
+		j := strings.Index(rest, part)
+		if j < 0 {
+			return false
+		}
+		rest = rest[j+len(part):]
+	}
+	return !anchored || rest == ""
+}
+
+// Return true if the rules allow the url's path and query.
+// The most specific matching rule applies, an allow rule wins over a disallow rule that is just as specific.
+// The robots.txt file itself is always allowed.
+func (r *Robots) Allowed(u *url.URL) bool {
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if path == "/robots.txt" {
+		return true
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+
+	allowed := true
+	longest := -1
+	for _, rule := range r.rules {
+		if len(rule.pattern) < longest || (len(rule.pattern) == longest && !rule.allow) {
+			continue
+		}
+		if matchRobotsPattern(rule.pattern, path) {
+			allowed = rule.allow
+			longest = len(rule.pattern)
+		}
+	}
+	return allowed
+}
+
+// Slow the limit down to one request per crawl delay, without bursts.
+// Returns false if the limit is slow enough already.
+func crawlDelayLimit(limit Limit, delay time.Duration) (Limit, bool) {
+	maxRate := Quota{Requests: 1, Window: delay}
+	if limit.Adaptive != nil {
+		if limit.Adaptive.MaxRate.PerSecond() <= maxRate.PerSecond() {
+			return limit, false
+		}
+		adaptive := *limit.Adaptive
+		adaptive.MaxRate = maxRate
+		if adaptive.MinRate.PerSecond() > maxRate.PerSecond() {
+			adaptive.MinRate = maxRate
+		}
+		limit.Adaptive = &adaptive
+		return limit, true
+	}
+
+	if limit.Interval >= delay && limit.Burst <= 1 {
+		return limit, false
+	}
+	limit.Interval = max(limit.Interval, delay)
+	limit.Burst = 1
+	return limit, true
+}
+
+// Get the robots.txt rules of the request's upstream server for the user agent of the options.
+// The file is fetched through the client, so that it's throttled and cached like any other response.
+// Every url is allowed if the file doesn't exist, a RobotsError is returned if the server fails to serve it.
+func (c *NiceClient) robots(req *http.Request, options *RequestOptions) (*Robots, error) {
+	robotsURL := &url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host, Path: "/robots.txt"}
+	robotsReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, robotsURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	robotsOptions := *options
+	robotsOptions.RespectRobots = false
+	robotsOptions.MinCacheTTL = 0
+	robotsOptions.MaxCacheTTL = RobotsCacheTTL
+	robotsOptions.DefaultCacheTTL = RobotsCacheTTL
+	robotsOptions.StaleWhileRevalidate = 0
+	robotsOptions.StaleIfError = RobotsCacheTTL
+	res, err := c.RoundTripWithOptions(robotsReq, &robotsOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 500:
+		// Don't keep the failure around, so that the file is fetched again by the next request.
+		if _, err := c.cache.Purge(req.Context(), robotsURL.String(), false); err != nil {
+			return nil, err
+		}
+		return nil, &RobotsError{URL: req.URL.String(), UserAgent: options.UserAgent, StatusCode: res.StatusCode}
+	case res.StatusCode >= 400:
+		return &Robots{}, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, robotsMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	robots := ParseRobots(bytes.NewReader(body), options.UserAgent)
+	switch res.Header.Get(CacheStatusHeader) {
+	case CacheStatusHit, CacheStatusStale, CacheStatusCollapsed:
+	default:
+		robots.fetched = true
+	}
+	return robots, nil
+}
+
+// Return a RobotsError if the upstream server's robots.txt disallows the request,
+// and throttle requests to the host to the file's crawl delay.
+func (c *NiceClient) respectRobots(req *http.Request, options *RequestOptions, logger *log.Logger) error {
+	robots, err := c.robots(req, options)
+	if err != nil {
+		var robotsErr *RobotsError
+		if errors.As(err, &robotsErr) {
+			c.Metrics.observeRobotsRejection(req.URL.Host)
+		}
+		return err
+	}
+	if robots.CrawlDelay > 0 {
+		c.applyCrawlDelay(req, robots, logger)
+	}
+
+	if !robots.Allowed(req.URL) {
+		c.Metrics.observeRobotsRejection(req.URL.Host)
+		return &RobotsError{URL: req.URL.String(), UserAgent: options.UserAgent}
+	}
+	return nil
+}
+
+// Throttle requests to the host with the request's method to one per crawl delay of the robots.txt file.
+// A throttle set for the host is slowed down if needed, keeping its other limits.
+// The throttle is only checked when the crawl delay changes or the file is fetched again, not on every request.
+func (c *NiceClient) applyCrawlDelay(req *http.Request, robots *Robots, logger *log.Logger) {
+	hostURL := &url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host}
+	delay := robots.CrawlDelay
+	key := req.Method + " " + hostURL.String()
+	if applied, ok := c.crawlDelays.Load(key); ok && applied == delay && !robots.fetched {
+		return
+	}
+	c.crawlDelays.Store(key, delay)
+
+	limit := IntervalLimit(delay)
+	changed := true
+	for _, setting := range c.throttle.Throttles() {
+		if setting.Method == req.Method && setting.URL == hostURL.String() {
+			limit, changed = crawlDelayLimit(setting.Limit, delay)
+		}
+	}
+	if !changed {
+		return
+	}
+
+	logger.With("throttle", hostURL.String(), "crawl_delay", delay.String()).Info("throttling host to the crawl delay of its robots.txt")
+	c.throttle.SetThrottle(&http.Request{Method: req.Method, URL: hostURL}, limit)
+}
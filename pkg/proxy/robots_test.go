@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRobots = `
+# Rules before the first group are ignored.
+Disallow: /
+
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Crawl-delay: 5
+
+User-agent: OtherBot
+User-agent: ChaperoneBot
+Disallow: /search
+Disallow: /*.pdf$
+Allow: /search/about
+Crawl-delay: 0.5
+
+User-agent: chaperonebot/2.0
+Disallow: /tmp/ # comment
+`
+
+func TestParseRobots(t *testing.T) {
+	robots := ParseRobots(strings.NewReader(testRobots), "ChaperoneBot/0.1")
+	if robots.CrawlDelay != 500*time.Millisecond {
+		t.Fatalf("expected a crawl delay of 500ms, got %s", robots.CrawlDelay)
+	}
+
+	for path, expected := range map[string]bool{
+		"/":                   true,
+		"/private":            true,
+		"/search":             false,
+		"/search?q=chaperone": false,
+		"/search/about":       true,
+		"/tmp/file":           false,
+		"/docs/manual.pdf":    false,
+		"/docs/manual.pdf?v1": true,
+		"/robots.txt":         true,
+	} {
+		u, _ := url.Parse("https://example.com" + path)
+		if allowed := robots.Allowed(u); allowed != expected {
+			t.Errorf("expected allowed=%t for %s, got %t", expected, path, allowed)
+		}
+	}
+
+	// Agents without their own group get the `*` group.
+	robots = ParseRobots(strings.NewReader(testRobots), "Chaperone")
+	if robots.CrawlDelay != 5*time.Second {
+		t.Fatalf("expected a crawl delay of 5s, got %s", robots.CrawlDelay)
+	}
+	for path, expected := range map[string]bool{
+		"/search":          true,
+		"/private/page":    false,
+		"/private/public/": true,
+	} {
+		u, _ := url.Parse("https://example.com" + path)
+		if allowed := robots.Allowed(u); allowed != expected {
+			t.Errorf("expected allowed=%t for %s, got %t", expected, path, allowed)
+		}
+	}
+}
+
+func TestMatchRobotsPattern(t *testing.T) {
+	for _, test := range []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		{"/fish", "/fish.html", true},
+		{"/fish", "/Fish", false},
+		{"/fish*", "/fishheads", true},
+		{"/*.php", "/folder/index.php?a=1", true},
+		{"/*.php$", "/index.php", true},
+		{"/*.php$", "/index.php?a=1", false},
+		{"/fish$", "/fish", true},
+		{"/fish$", "/fishes", false},
+		{"/a*b*c", "/axxbyyc", true},
+		{"/a*b*c", "/axxcyyb", false},
+		{"/*$", "/anything", true},
+	} {
+		if matched := matchRobotsPattern(test.pattern, test.path); matched != test.expected {
+			t.Errorf("expected %s to match %s: %t, got %t", test.pattern, test.path, test.expected, matched)
+		}
+	}
+}
+
+func TestCrawlDelayLimit(t *testing.T) {
+	limit, changed := crawlDelayLimit(Limit{Interval: 100 * time.Millisecond, Burst: 10, MaxConcurrent: 2}, time.Second)
+	if !changed || limit.Interval != time.Second || limit.Burst != 1 || limit.MaxConcurrent != 2 {
+		t.Fatalf("expected the limit to slow down to the crawl delay, got %s", limit)
+	}
+
+	if _, changed = crawlDelayLimit(IntervalLimit(2*time.Second), time.Second); changed {
+		t.Fatal("expected a slower limit to be kept")
+	}
+
+	adaptive := &AdaptiveRate{MinRate: Quota{Requests: 1, Window: time.Second}, MaxRate: Quota{Requests: 10, Window: time.Second}}
+	limit, changed = crawlDelayLimit(Limit{Adaptive: adaptive}, 2*time.Second)
+	if !changed || limit.Adaptive.MaxRate.PerSecond() != 0.5 || limit.Adaptive.MinRate.PerSecond() != 0.5 {
+		t.Fatalf("expected the adaptive rate to be bounded by the crawl delay, got %s", limit)
+	}
+	if adaptive.MaxRate.Requests != 10 {
+		t.Fatal("expected the original adaptive rate to be left alone")
+	}
+}
+
+// Round tripper that serves a robots.txt file and counts the requests for it.
+type mockRobotsRoundTripper struct {
+	Robots        string
+	RobotsStatus  int
+	RobotsFetches atomic.Int32
+}
+
+func (m *mockRobotsRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	body := "ok"
+	status := http.StatusOK
+	if r.URL.Path == "/robots.txt" {
+		m.RobotsFetches.Add(1)
+		body = m.Robots
+		status = m.RobotsStatus
+	}
+	return &http.Response{
+		Request:    r,
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(bytes.NewReader([]byte(body))),
+	}, nil
+}
+
+func TestNiceClientRespectsRobots(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+	cache := NewMemoryHTTPCache(context.Background(), 10000)
+
+	roundTripper := &mockRobotsRoundTripper{Robots: "User-agent: *\nDisallow: /private\nCrawl-delay: 0.1\n", RobotsStatus: http.StatusOK}
+	client := NewNiceClient(context.Background(), roundTripper, throttle, cache)
+	options := &RequestOptions{UserAgent: "Chaperone", MaxCacheTTL: time.Hour, RespectRobots: true}
+
+	req, _ := http.NewRequest("GET", "http://example.com/public", nil)
+	res, err := client.RoundTripWithOptions(req, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	req, _ = http.NewRequest("GET", "http://example.com/private/page", nil)
+	_, err = client.RoundTripWithOptions(req, options)
+	var robotsErr *RobotsError
+	if !errors.As(err, &robotsErr) {
+		t.Fatalf("expected a RobotsError, got %v", err)
+	}
+
+	if fetches := roundTripper.RobotsFetches.Load(); fetches != 1 {
+		t.Fatalf("expected robots.txt to be fetched once and cached, got %d fetches", fetches)
+	}
+
+	settings := throttle.Throttles()
+	if len(settings) != 1 || settings[0].URL != "http://example.com" || settings[0].Limit.Interval != 100*time.Millisecond {
+		t.Fatalf("expected the crawl delay to throttle the host, got %v", settings)
+	}
+
+	// Requests that don't respect robots.txt are sent anyway.
+	req, _ = http.NewRequest("GET", "http://example.com/private/page", nil)
+	if _, err = client.RoundTripWithOptions(req, &RequestOptions{MaxCacheTTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNiceClientRobotsUnavailable(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+	cache := NewMemoryHTTPCache(context.Background(), 10000)
+
+	roundTripper := &mockRobotsRoundTripper{RobotsStatus: http.StatusInternalServerError}
+	client := NewNiceClient(context.Background(), roundTripper, throttle, cache)
+	client.RetryPolicy = RetryPolicy{}
+	options := &RequestOptions{UserAgent: "Chaperone", MaxCacheTTL: time.Hour, RespectRobots: true}
+
+	req, _ := http.NewRequest("GET", "http://example.com/page", nil)
+	_, err := client.RoundTripWithOptions(req, options)
+	var robotsErr *RobotsError
+	if !errors.As(err, &robotsErr) || robotsErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected a RobotsError for the unavailable robots.txt, got %v", err)
+	}
+
+	// A missing robots.txt allows everything.
+	roundTripper.RobotsStatus = http.StatusNotFound
+	req, _ = http.NewRequest("GET", "http://example.com/page", nil)
+	if _, err = client.RoundTripWithOptions(req, options); err != nil {
+		t.Fatal(err)
+	}
+	if fetches := roundTripper.RobotsFetches.Load(); fetches != 2 {
+		t.Fatalf("expected the failed robots.txt to be fetched again, got %d fetches", fetches)
+	}
+}
+
+// Throttle that counts how often its settings are listed.
+type countingThrottle struct {
+	HTTPThrottle
+	listed atomic.Int32
+}
+
+func (t *countingThrottle) Throttles() []ThrottleSetting {
+	t.listed.Add(1)
+	return t.HTTPThrottle.Throttles()
+}
+
+func TestNiceClientAppliesCrawlDelayOnce(t *testing.T) {
+	memoryThrottle := NewMemoryHTTPThrottle(0)
+	defer memoryThrottle.Stop()
+	throttle := &countingThrottle{HTTPThrottle: memoryThrottle}
+	cache := NewMemoryHTTPCache(context.Background(), 10000)
+
+	roundTripper := &mockRobotsRoundTripper{Robots: "User-agent: *\nCrawl-delay: 0.05\n", RobotsStatus: http.StatusOK}
+	client := NewNiceClient(context.Background(), roundTripper, throttle, cache)
+	options := &RequestOptions{UserAgent: "Chaperone", MaxCacheTTL: time.Hour, RespectRobots: true}
+
+	get := func() {
+		req, _ := http.NewRequest("GET", "http://example.com/page", nil)
+		res, err := client.RoundTripWithOptions(req, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	// The throttle is only checked when robots.txt is fetched.
+	for range 3 {
+		get()
+	}
+	if listed := throttle.listed.Load(); listed != 1 {
+		t.Fatalf("expected the throttle to be checked once, got %d", listed)
+	}
+
+	// A throttle changed in the meantime is slowed down again once robots.txt is fetched again.
+	memoryThrottle.SetThrottle(&http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "example.com"}}, IntervalLimit(0))
+	if _, err := cache.Purge(context.Background(), "http://example.com/robots.txt", false); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	settings := memoryThrottle.Throttles()
+	if listed := throttle.listed.Load(); listed != 2 || len(settings) != 1 || settings[0].Limit.Interval != 50*time.Millisecond {
+		t.Fatalf("expected the crawl delay to be applied again, got %d checks and %v", listed, settings)
+	}
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Maximum size of a response body that is buffered in memory to share it with collapsed requests.
+// Bodies the cache writes to disk are shared through their file instead, whatever their size.
+const MaxSharedBodySize = 1 << 20
+
+// An in-flight upstream request that other requests can wait on.
+type flight struct {
+	// Closed once the leader's response is shared, or turned out not to be shareable.
+	done chan struct{}
+	res  *http.Response
+	body []byte
+	// Path of the file holding the body, set instead of body if the cache wrote it to disk.
+	bodyFile string
+	err      error
+	// The leader's response can't be shared, followers perform their own request instead.
+	unshared bool
+	// Number of requests waiting on the flight, guarded by the group's lock.
+	followers int
+}
+
+// Collapses concurrent identical requests into a single upstream request.
+// The first request for a key (the leader) performs the request, concurrent requests for the same key
+// (the followers) wait for it and receive a copy of its response.
+type flightGroup struct {
+	flights map[string]*flight
+	lock    *sync.Mutex
+	// Maximum size of a response body that is buffered in memory to share it with followers.
+	maxBodySize int64
+}
+
+func newFlightGroup(maxBodySize int64) *flightGroup {
+	return &flightGroup{
+		flights:     make(map[string]*flight),
+		lock:        &sync.Mutex{},
+		maxBodySize: maxBodySize,
+	}
+}
+
+// Copy the response with the provided body, for the provided request.
+func copyResponse(res *http.Response, body io.ReadCloser, size int64, req *http.Request) *http.Response {
+	copied := *res
+	copied.Header = res.Header.Clone()
+	if copied.Header == nil {
+		copied.Header = http.Header{}
+	}
+	copied.Body = body
+	copied.ContentLength = size
+	copied.Request = req
+	return &copied
+}
+
+// Copy the flight's response for the provided request, reading the body from its file if it has one.
+func (f *flight) response(req *http.Request) (*http.Response, error) {
+	if f.bodyFile == "" {
+		return copyResponse(f.res, io.NopCloser(bytes.NewReader(f.body)), int64(len(f.body)), req), nil
+	}
+
+	file, err := os.Open(f.bodyFile)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return copyResponse(f.res, file, info.Size(), req), nil
+}
+
+// Perform the request with fn, unless a request for the same key is in flight, in which case its response is copied.
+// Followers can only join while the leader waits for the response headers. If any did, the leader's body is buffered as
+// it is read, up to the maximum body size, and shared once it's read entirely. Bodies the cache writes to disk are
+// shared through their file instead. Larger bodies, bodies the leader doesn't read entirely and requests the leader gave
+// up on aren't shared, the followers then perform the request themselves.
+// Returns true if the response was shared from another request.
+func (g *flightGroup) Do(ctx context.Context, key string, req *http.Request, fn func() (*http.Response, error)) (*http.Response, bool, error) {
+	for {
+		g.lock.Lock()
+		f, ok := g.flights[key]
+		if !ok {
+			break
+		}
+		f.followers++
+		g.lock.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+
+		if f.unshared {
+			// Become the leader of a new flight, or join one another follower started.
+			continue
+		}
+		if f.err != nil {
+			return nil, true, f.err
+		}
+		res, err := f.response(req)
+		if err != nil {
+			// The body file was evicted from the cache since.
+			continue
+		}
+		return res, true, nil
+	}
+
+	f := &flight{
+		done: make(chan struct{}),
+	}
+	g.flights[key] = f
+	g.lock.Unlock()
+
+	res, err := fn()
+
+	// The response is only shared with the followers that joined so far, later requests can't get the start of the body.
+	g.lock.Lock()
+	delete(g.flights, key)
+	followers := f.followers
+	g.lock.Unlock()
+
+	if err != nil {
+		f.err = err
+		// Errors of the leader's own context or wait limits don't apply to the followers.
+		var throttleErr *ThrottleError
+		f.unshared = ctx.Err() != nil || errors.As(err, &throttleErr)
+		close(f.done)
+		return nil, false, err
+	}
+	if followers == 0 {
+		close(f.done)
+		return res, false, nil
+	}
+
+	// The leader may change its response's headers while the body is read.
+	shared := *res
+	shared.Header = res.Header.Clone()
+	shared.Body = nil
+	f.res = &shared
+	body := &sharingBody{ReadCloser: res.Body, flight: f, maxSize: g.maxBodySize}
+	body.spooled, _ = res.Body.(spooledBody)
+	res.Body = body
+	return res, false, nil
+}
+
+// A response body that the cache writes to a file as it's read, see spoolingBody.
+type spooledBody interface {
+	// Get the path of the file holding the body once it's read entirely, empty if there is none.
+	spooledFile() string
+}
+
+// The leader's response body, buffered as it is read so that it can be shared with the followers once it's read entirely.
+type sharingBody struct {
+	io.ReadCloser
+	flight  *flight
+	buffer  bytes.Buffer
+	maxSize int64
+	// Set if the cache writes the body to a file, which is shared if the body doesn't fit the buffer.
+	spooled spooledBody
+	// The body didn't fit the buffer.
+	overflowed bool
+	finished   bool
+}
+
+// Share the body with the followers, or let them perform their own request if it's incomplete or couldn't be kept.
+func (b *sharingBody) finish(complete bool) {
+	if b.finished {
+		return
+	}
+	b.finished = true
+	path := ""
+	if complete && b.spooled != nil {
+		path = b.spooled.spooledFile()
+	}
+	if path != "" {
+		b.flight.bodyFile = path
+		b.buffer = bytes.Buffer{}
+	} else if complete && !b.overflowed {
+		b.flight.body = b.buffer.Bytes()
+	} else {
+		b.flight.unshared = true
+		b.buffer = bytes.Buffer{}
+	}
+	close(b.flight.done)
+}
+
+func (b *sharingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.finished {
+		return n, err
+	}
+
+	if b.overflowed || int64(b.buffer.Len()+n) > b.maxSize {
+		// Too large to hold in memory.
+		if b.spooled == nil {
+			b.finish(false)
+			return n, err
+		}
+		b.overflowed = true
+		b.buffer = bytes.Buffer{}
+	} else {
+		b.buffer.Write(p[:n])
+	}
+	if errors.Is(err, io.EOF) {
+		b.finish(true)
+	} else if err != nil {
+		b.finish(false)
+	}
+	return n, err
+}
+
+func (b *sharingBody) Close() error {
+	// Closing before the end of the body leaves it incomplete.
+	b.finish(false)
+	return b.ReadCloser.Close()
+}
@@ -1,28 +1,99 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 )
 
+// Request header with the maximum time a client is willing to wait on the throttle, like "5s" or a number of seconds.
+const MaxWaitHeader = "X-Chaperone-Max-Wait"
+
+var (
+	// The request can't be sent before its deadline or the maximum wait of its throttle.
+	ErrWaitTooLong = errors.New("request can't be sent within its maximum wait")
+	// Too many requests are waiting on the throttle.
+	ErrQueueFull = errors.New("too many requests are waiting on the throttle")
+)
+
+// Returned by HTTPThrottle.Wait when a request is rejected rather than queued.
+type ThrottleError struct {
+	// ErrWaitTooLong or ErrQueueFull.
+	Reason error
+	// Time until the request could have been sent, zero if unknown.
+	RetryAfter time.Duration
+}
+
+func (e *ThrottleError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s, it can be sent in %s", e.Reason, e.RetryAfter.Round(time.Millisecond))
+	}
+	return e.Reason.Error()
+}
+
+func (e *ThrottleError) Unwrap() error {
+	return e.Reason
+}
+
 // HTTPThrottle interface performs throttling (rate-limiting).
 type HTTPThrottle interface {
-	// Wait for the throttle to pass.
-	Wait(req *http.Request)
+	// Wait for the throttle to pass, or until the context is done.
+	// Returns a ThrottleError right away if the request can't be sent before the context's deadline or the maximum wait of
+	// its throttles, or if too many requests are waiting on them. Returns the context's error if it's done while waiting.
+	Wait(ctx context.Context, req *http.Request) error
+	// Wait until the request is within the concurrency limits for its url and method, or until the context is done.
+	// Returns a function that releases the request's concurrency slots, which must be called once the request is done.
+	Acquire(ctx context.Context, req *http.Request) (release func(), err error)
+	// Adjust the adaptive throttles for the request to its outcome: its latency and whether the upstream server asked to back off.
+	Adapt(req *http.Request, latency time.Duration, backoff bool)
 	// Block any clients using the throttle for the provided url for a certain duration.
 	Block(req *http.Request, duration time.Duration)
-	// Set the waiting duration for the provided request url and method.
-	SetThrottle(req *http.Request, duration time.Duration)
+	// Set the limit for the provided request url and method.
+	SetThrottle(req *http.Request, limit Limit)
+	// Remove the throttle for the provided request url and method, releasing any clients waiting on it.
+	RemoveThrottle(req *http.Request)
+	// Get the throttles that are set, ordered by url and method.
+	Throttles() []ThrottleSetting
 	// Stop and clean up the throttle.
 	Stop()
 }
 
+// A throttle for a request url and method.
+type ThrottleSetting struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Limit  Limit  `json:"limit"`
+}
+
 type hostThrottle struct {
-	ticker   *time.Ticker
-	blockers *sync.WaitGroup
+	setting ThrottleSetting
+	// Nil if the url is only blocked, without a limit.
+	limiter *limiter
+	// Nil if the limit isn't adaptive.
+	aimd         *aimd
+	blockedUntil time.Time
+	// Number of requests in flight.
+	inFlight int
+	// Requests waiting for their slot.
+	lanes lanes
+	// Closed when the throttle is removed.
+	removed chan struct{}
+}
+
+func newHostThrottle(req *http.Request) *hostThrottle {
+	return &hostThrottle{
+		setting: ThrottleSetting{
+			Method: req.Method,
+			URL:    fmt.Sprintf("%s://%s%s", req.URL.Scheme, req.URL.Host, req.URL.Path),
+		},
+		removed: make(chan struct{}),
+	}
 }
 
 // The MemoryHTTPThrottle stores throttles per path segment, so that it's possible
@@ -30,14 +101,23 @@ type hostThrottle struct {
 // e.g. example.com has a throttle of 1s, example.com/test has a throttle of 2:
 // A request to example.com/test would have to wait on BOTH.
 type MemoryHTTPThrottle struct {
-	throttles       *sync.Map
+	throttles map[string]*hostThrottle
+	lock      *sync.Mutex
+	// Closed and replaced when concurrency slots may have become available, to wake up waiting requests.
+	released chan struct{}
+	// Fires when the next slot of a waiting request is due, nil if no requests are waiting.
+	dispatchTimer   *time.Timer
 	defaultDuration time.Duration
+	// Number of requests that waited on the throttle, orders them by arrival.
+	waiters uint64
 }
 
 // Create an in-memory throttle that handles per path/http-method throttling.
 func NewMemoryHTTPThrottle(defaultDuration time.Duration) *MemoryHTTPThrottle {
 	return &MemoryHTTPThrottle{
-		throttles:       &sync.Map{},
+		throttles:       make(map[string]*hostThrottle),
+		lock:            &sync.Mutex{},
+		released:        make(chan struct{}),
 		defaultDuration: defaultDuration,
 	}
 }
@@ -48,64 +128,453 @@ func getRequestKey(req *http.Request, path string) string {
 	return fmt.Sprintf("%s %s://%s%s", req.Method, req.URL.Scheme, req.URL.Host, path)
 }
 
-func (t *MemoryHTTPThrottle) Wait(req *http.Request) {
+// Get the earliest slot allowed by all limiters.
+// Quotas can push the slot into a later window, past the slot allowed by another limiter, so repeat until they agree.
+func earliestSlot(limiters []*limiter, slot time.Time) time.Time {
+	for {
+		next := slot
+		for _, l := range limiters {
+			next = l.earliest(next)
+		}
+		if next.Equal(slot) {
+			return slot
+		}
+		slot = next
+	}
+}
+
+// Wait until the slot, until one of the throttles is removed or until the context is done.
+// Returns the context's error if it's done before the slot.
+func waitForSlot(ctx context.Context, slot time.Time, removed []chan struct{}) error {
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	}
+	for _, ch := range removed {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)})
+	}
+
+	// A deadline at the slot itself may fire first, the slot is met regardless.
+	if chosen, _, _ := reflect.Select(cases); chosen == 1 && time.Now().Before(slot) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Get the deadline for a request's slot: the context's deadline or the maximum wait of its throttles, whichever comes first.
+func waitDeadline(ctx context.Context, now time.Time, throttles []*hostThrottle) (time.Time, bool) {
+	deadline, ok := ctx.Deadline()
+	for _, throttle := range throttles {
+		if maxWait := throttle.setting.Limit.MaxWait; maxWait > 0 && (!ok || now.Add(maxWait).Before(deadline)) {
+			deadline, ok = now.Add(maxWait), true
+		}
+	}
+	return deadline, ok
+}
+
+// Get the earliest slot the request's throttles allow, ignoring the requests waiting ahead of it.
+func (w *waiter) earliest(now time.Time) time.Time {
+	slot := now
+	for _, throttle := range w.throttles {
+		if throttle.blockedUntil.After(slot) {
+			slot = throttle.blockedUntil
+		}
+	}
+	return earliestSlot(w.limiters, slot)
+}
+
+// Estimate the slot of a request before it's queued, assuming every request ahead of it takes one interval of each throttle.
+func (w *waiter) estimate(now time.Time) time.Time {
+	slot := w.earliest(now)
+	estimate := slot
+	for _, throttle := range w.throttles {
+		ahead := time.Duration(throttle.lanes.ahead(w))
+		if throttleEstimate := slot.Add(ahead * throttle.setting.Limit.Interval); throttleEstimate.After(estimate) {
+			estimate = throttleEstimate
+		}
+	}
+	return estimate
+}
+
+// Return true if the request may take the next slot of the throttles it waits on: it's at the head of every throttle,
+// or at the head of some and arrived before the requests at the head of the others. Throttles order their requests by
+// their own priorities and clients, so requests at the head of different throttles may each wait on the other's throttle.
+// The request that arrived first takes its slot then, so that they don't wait on each other forever.
+func (w *waiter) canTake() bool {
+	isHead := false
+	for _, throttle := range w.throttles {
+		head := throttle.lanes.head()
+		if head == w {
+			isHead = true
+		} else if head.seq < w.seq {
+			return false
+		}
+	}
+	return isHead
+}
+
+// Let a waiting request be sent, reserving the slot unless it's zero. The lock must be held.
+func (t *MemoryHTTPThrottle) release(w *waiter, slot time.Time) {
+	if !slot.IsZero() {
+		for _, l := range w.limiters {
+			l.reserve(slot)
+		}
+	}
+	for _, throttle := range w.throttles {
+		throttle.lanes.take(w)
+	}
+	w.slot = slot
+	close(w.ready)
+}
+
+// Give the slots that are due to the requests that may take them, see waiter.canTake, and schedule the next dispatch
+// for when the next slot is due. A request only takes a slot once it's due, so that requests with a higher priority
+// arriving in the meantime take it instead. The lock must be held.
+func (t *MemoryHTTPThrottle) dispatch(now time.Time) {
+	next := time.Time{}
+	for progressed := true; progressed; {
+		progressed = false
+		next = time.Time{}
+		for _, throttle := range t.throttles {
+			w := throttle.lanes.head()
+			if w == nil || !w.canTake() {
+				continue
+			}
+
+			slot := w.earliest(now)
+			if slot.After(now) {
+				if next.IsZero() || slot.Before(next) {
+					next = slot
+				}
+				continue
+			}
+			t.release(w, slot)
+			progressed = true
+		}
+	}
+
+	if t.dispatchTimer != nil {
+		t.dispatchTimer.Stop()
+		t.dispatchTimer = nil
+	}
+	if !next.IsZero() {
+		t.dispatchTimer = time.AfterFunc(time.Until(next), func() {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			t.dispatch(time.Now())
+		})
+	}
+}
+
+func (t *MemoryHTTPThrottle) Wait(ctx context.Context, req *http.Request) error {
 	pathParts := strings.Split(req.URL.Path, "/")
+	now := time.Now()
+	w := &waiter{priority: priorityFromContext(ctx), ready: make(chan struct{})}
+	w.client, w.weight = clientFromContext(ctx)
 
-	// Check if there's a throttle for every part of the path and wait on it if there is.
-	isThrottled := false
-	for i, _ := range pathParts {
+	t.lock.Lock()
+	t.waiters++
+	w.seq = t.waiters
+
+	// Collect the throttles for every part of the path, a request must satisfy all of them.
+	removed := make([]chan struct{}, 0)
+	for i := range pathParts {
 		key := getRequestKey(req, strings.Join(pathParts[:i+1], "/"))
-		throttle, ok := t.throttles.Load(key)
-		if ok {
-			isThrottled = true
-			throttle := throttle.(hostThrottle)
-			throttle.blockers.Wait()
-			<-throttle.ticker.C
+		throttle, ok := t.throttles[key]
+		if !ok {
+			continue
+		}
+
+		if throttle.limiter == nil && !throttle.blockedUntil.After(now) {
+			// The block passed, drop the throttle.
+			delete(t.throttles, key)
+			continue
+		}
+
+		if maxQueue := throttle.setting.Limit.MaxQueue; maxQueue > 0 && throttle.lanes.len() >= maxQueue {
+			t.lock.Unlock()
+			return &ThrottleError{Reason: ErrQueueFull}
+		}
+
+		w.throttles = append(w.throttles, throttle)
+		if throttle.limiter != nil {
+			w.limiters = append(w.limiters, throttle.limiter)
+		}
+		removed = append(removed, throttle.removed)
+	}
+
+	deadline, hasDeadline := waitDeadline(ctx, now, w.throttles)
+
+	if len(w.limiters) == 0 {
+		t.lock.Unlock()
+
+		// If the request had no explicit throttles, wait the default duration.
+		slot := w.earliest(now)
+		if slot.Before(now.Add(t.defaultDuration)) {
+			slot = now.Add(t.defaultDuration)
+		}
+		if hasDeadline && slot.After(deadline) {
+			return &ThrottleError{Reason: ErrWaitTooLong, RetryAfter: slot.Sub(now)}
 		}
+		return waitForSlot(ctx, slot, removed)
 	}
 
-	// If the request had no explicit throttles, wait the default duration.
-	if !isThrottled {
-		time.Sleep(t.defaultDuration)
+	// Reject the request rather than sending it late, without queueing it.
+	if estimate := w.estimate(now); hasDeadline && estimate.After(deadline) {
+		t.lock.Unlock()
+		return &ThrottleError{Reason: ErrWaitTooLong, RetryAfter: estimate.Sub(now)}
 	}
+
+	for _, throttle := range w.throttles {
+		throttle.lanes.push(w)
+	}
+	t.dispatch(now)
+	t.lock.Unlock()
+
+	// Requests with a higher priority may still push the slot past the deadline.
+	waitCtx := ctx
+	if hasDeadline {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-waitCtx.Done():
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	select {
+	case <-w.ready:
+		// The request won't be sent, give its slot to the next one.
+		if !w.slot.IsZero() {
+			for _, l := range w.limiters {
+				l.cancel(w.slot)
+			}
+		}
+	default:
+		for _, throttle := range w.throttles {
+			throttle.lanes.remove(w)
+		}
+	}
+	// The requests behind it may be able to take the next slot.
+	t.dispatch(time.Now())
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return &ThrottleError{Reason: ErrWaitTooLong}
+}
+
+// Wake up the requests waiting for a concurrency slot. The lock must be held.
+func (t *MemoryHTTPThrottle) notifyReleased() {
+	close(t.released)
+	t.released = make(chan struct{})
+}
+
+func (t *MemoryHTTPThrottle) Acquire(ctx context.Context, req *http.Request) (func(), error) {
+	pathParts := strings.Split(req.URL.Path, "/")
+
+	t.lock.Lock()
+	for {
+		// Collect the concurrency-limited throttles for every part of the path, a request must fit in all of them.
+		throttles := make([]*hostThrottle, 0)
+		full := false
+		for i := range pathParts {
+			key := getRequestKey(req, strings.Join(pathParts[:i+1], "/"))
+			throttle, ok := t.throttles[key]
+			if !ok || throttle.setting.Limit.MaxConcurrent <= 0 {
+				continue
+			}
+			throttles = append(throttles, throttle)
+			full = full || throttle.inFlight >= throttle.setting.Limit.MaxConcurrent
+		}
+
+		if !full {
+			for _, throttle := range throttles {
+				throttle.inFlight++
+			}
+			t.lock.Unlock()
+
+			once := &sync.Once{}
+			return func() {
+				once.Do(func() {
+					t.lock.Lock()
+					defer t.lock.Unlock()
+					for _, throttle := range throttles {
+						throttle.inFlight--
+					}
+					t.notifyReleased()
+				})
+			}, nil
+		}
+
+		released := t.released
+		t.lock.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-released:
+		}
+		t.lock.Lock()
+	}
+}
+
+func (t *MemoryHTTPThrottle) Adapt(req *http.Request, latency time.Duration, backoff bool) {
+	pathParts := strings.Split(req.URL.Path, "/")
+	now := time.Now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i := range pathParts {
+		key := getRequestKey(req, strings.Join(pathParts[:i+1], "/"))
+		throttle, ok := t.throttles[key]
+		if !ok || throttle.aimd == nil {
+			continue
+		}
+
+		interval, decreased := throttle.aimd.update(now, latency, backoff)
+		throttle.setting.Limit.Interval = interval
+		throttle.limiter.setLimit(throttle.setting.Limit)
+		logAdaptedRate(key, interval, decreased)
+	}
+	// The next slot may be due sooner.
+	t.dispatch(now)
 }
 
 func (t *MemoryHTTPThrottle) Block(req *http.Request, d time.Duration) {
 	key := getRequestKey(req, req.URL.Path)
-	throttleAny, _ := t.throttles.LoadOrStore(key, hostThrottle{
-		ticker:   time.NewTicker(d),
-		blockers: &sync.WaitGroup{},
-	})
 
-	throttle := throttleAny.(hostThrottle)
-	throttle.blockers.Add(1)
-	go func() {
-		time.Sleep(d)
-		throttle.blockers.Done()
-	}()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	throttle, ok := t.throttles[key]
+	if !ok {
+		throttle = newHostThrottle(req)
+		t.throttles[key] = throttle
+	}
+
+	if blockedUntil := time.Now().Add(d); blockedUntil.After(throttle.blockedUntil) {
+		throttle.blockedUntil = blockedUntil
+	}
 }
 
-func (t *MemoryHTTPThrottle) SetThrottle(req *http.Request, duration time.Duration) {
+func (t *MemoryHTTPThrottle) SetThrottle(req *http.Request, limit Limit) {
 	key := getRequestKey(req, req.URL.Path)
-	throttleAny, exists := t.throttles.LoadOrStore(key, hostThrottle{
-		ticker:   time.NewTicker(duration),
-		blockers: &sync.WaitGroup{},
-	})
-	throttle := throttleAny.(hostThrottle)
 
-	if exists {
-		throttle.ticker.Reset(duration)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	throttle, ok := t.throttles[key]
+	if !ok {
+		throttle = newHostThrottle(req)
+		t.throttles[key] = throttle
+	}
+
+	if limit.Adaptive == nil {
+		throttle.aimd = nil
+	} else {
+		// Keep the current rate of an adaptive throttle, within its new bounds.
+		if throttle.aimd == nil {
+			throttle.aimd = newAIMD(*limit.Adaptive, limit.Interval)
+		} else {
+			throttle.aimd.setBounds(*limit.Adaptive)
+		}
+		limit.Interval = rateInterval(throttle.aimd.rate)
+	}
+
+	throttle.setting.Limit = limit
+	if throttle.limiter == nil {
+		throttle.limiter = newLimiter(limit)
+	} else {
+		throttle.limiter.setLimit(limit)
 	}
+	// The concurrency limit or the rate may have been raised.
+	t.notifyReleased()
+	t.dispatch(time.Now())
 }
 
-func (t *MemoryHTTPThrottle) Stop() {
-	t.throttles.Range(func(key, value any) bool {
-		throttle, ok := value.(hostThrottle)
-		if !ok {
-			panic("in-memory throttle contains invalid datatype")
+func (t *MemoryHTTPThrottle) RemoveThrottle(req *http.Request) {
+	key := getRequestKey(req, req.URL.Path)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	throttle, ok := t.throttles[key]
+	if !ok {
+		return
+	}
+
+	delete(t.throttles, key)
+	close(throttle.removed)
+	t.removeWaiters(throttle)
+	t.notifyReleased()
+	t.dispatch(time.Now())
+}
+
+// Stop the requests waiting on a removed throttle from waiting on it, releasing them if they wait on no other throttle.
+// The lock must be held.
+func (t *MemoryHTTPThrottle) removeWaiters(throttle *hostThrottle) {
+	for _, lane := range throttle.lanes {
+		for _, queued := range lane.queue {
+			w := queued.waiter
+			w.throttles = slices.DeleteFunc(w.throttles, func(other *hostThrottle) bool {
+				return other == throttle
+			})
+			w.limiters = slices.DeleteFunc(w.limiters, func(l *limiter) bool {
+				return l == throttle.limiter
+			})
+			if len(w.limiters) == 0 {
+				t.release(w, time.Time{})
+			}
 		}
+	}
+	throttle.lanes = lanes{}
+}
+
+func (t *MemoryHTTPThrottle) Throttles() []ThrottleSetting {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	settings := make([]ThrottleSetting, 0)
+	for _, throttle := range t.throttles {
+		if throttle.limiter != nil {
+			settings = append(settings, throttle.setting)
+		}
+	}
 
-		throttle.ticker.Stop()
-		return true
+	sortThrottleSettings(settings)
+	return settings
+}
+
+// Sort throttle settings by url and method.
+func sortThrottleSettings(settings []ThrottleSetting) {
+	slices.SortFunc(settings, func(a, b ThrottleSetting) int {
+		if a.URL == b.URL {
+			return strings.Compare(a.Method, b.Method)
+		}
+		return strings.Compare(a.URL, b.URL)
 	})
 }
+
+// Remove all throttles, releasing any clients waiting on them.
+func (t *MemoryHTTPThrottle) Stop() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for key, throttle := range t.throttles {
+		delete(t.throttles, key)
+		close(throttle.removed)
+		t.removeWaiters(throttle)
+	}
+	t.notifyReleased()
+	t.dispatch(time.Now())
+}
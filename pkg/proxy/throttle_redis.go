@@ -0,0 +1,822 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KillianMeersman/chaperone/pkg/log"
+	"github.com/redis/go-redis/v9"
+)
+
+// Queues a request on every throttle on its path and reserves its slot once it's due and the request may take it,
+// atomically. Requests poll the script until they get their slot, see MemoryHTTPThrottle.dispatch.
+// KEYS[1] is the hash of throttle limits, followed by the state key, the block key, the adaptive key, the queue key, the
+// seen key and the fair key of every path prefix.
+// ARGV[1] is the maximum wait in microseconds, zero if unlimited, ARGV[2] the request's token, ARGV[3] its priority,
+// ARGV[4] the credit of lower priorities, see priorityCredit, ARGV[5] the lease of a queued request in microseconds,
+// ARGV[6] the request's client, ARGV[7] the client's weight and ARGV[8] the microseconds the request waited so far,
+// followed by the throttle key of every path prefix.
+// Limits are token buckets implemented as GCRA, with fixed-window quotas, see limiter.
+// Adaptive limits use the interval of their current rate, within their bounds.
+// Queue keys are sorted sets of the tokens of waiting requests, scored by their priority and then their virtual finish
+// time, see lane. Fair keys are hashes of the finish time of the last request of every priority and client, the virtual
+// time and the credit of every priority are kept in the state keys. Seen keys are sorted sets of the same tokens, scored
+// by the last time they polled, so that requests of proxies that stopped polling leave the queue once their lease expires.
+// Returns the microseconds to wait for the slot, whether any throttle applied, 0 if the slot was reserved, 1 if the wait
+// is too long, 2 if the queue is full or 3 if the request is queued, and the (estimated) slot.
+var redisWaitScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local maxWait = tonumber(ARGV[1])
+local token = ARGV[2]
+local priority = tonumber(ARGV[3])
+local credit = tonumber(ARGV[4])
+local lease = tonumber(ARGV[5])
+local client = ARGV[6]
+local weight = tonumber(ARGV[7])
+local arrival = now - tonumber(ARGV[8])
+local n = #ARGV - 8
+
+-- Scores of a priority's queue start at laneStart(priority), higher priorities first.
+-- A request of a client with weight 1 advances the virtual time by fairUnit.
+local laneWidth = 10000000000000
+local fairUnit = 1000
+local function laneStart(p)
+	return string.format('%.0f', (1 - p) * laneWidth)
+end
+local function score(x)
+	return string.format('%.17g', x)
+end
+
+local slot = now
+local ruleMaxWait = 0
+local limits = {}
+for i = 1, n do
+	local blocked = tonumber(redis.call('GET', KEYS[1 + n + i]) or '0')
+	slot = math.max(slot, blocked)
+
+	local encoded = redis.call('HGET', KEYS[1], ARGV[8 + i])
+	if encoded then
+		local limit = cjson.decode(encoded)
+		local state = redis.call('HGETALL', KEYS[1 + i])
+		limit.state = {}
+		for j = 1, #state, 2 do
+			limit.state[state[j]] = tonumber(state[j + 1])
+		end
+		limit.key = KEYS[1 + i]
+		limit.queueKey = KEYS[1 + 3 * n + i]
+		limit.seenKey = KEYS[1 + 4 * n + i]
+		limit.fairKey = KEYS[1 + 5 * n + i]
+		if (limit.max_wait or 0) > 0 and (ruleMaxWait == 0 or limit.max_wait < ruleMaxWait) then
+			ruleMaxWait = limit.max_wait
+		end
+		for _, stale in ipairs(redis.call('ZRANGEBYSCORE', limit.seenKey, '-inf', string.format('%.0f', now - lease))) do
+			redis.call('ZREM', limit.queueKey, stale)
+			redis.call('ZREM', limit.seenKey, stale)
+		end
+		if limit.adaptive then
+			local interval = tonumber(redis.call('HGET', KEYS[1 + 2 * n + i], 'interval'))
+			if interval then
+				local minInterval = limit.adaptive.max_rate.window / limit.adaptive.max_rate.requests
+				local maxInterval = limit.adaptive.min_rate.window / limit.adaptive.min_rate.requests
+				limit.interval = math.min(math.max(interval, minInterval), maxInterval)
+			end
+		end
+		table.insert(limits, limit)
+	end
+end
+
+local function quotaID(quota)
+	return string.format('%.0f/%.0f', quota.requests, quota.window)
+end
+
+local function earliest(limit, t)
+	if limit.interval > 0 then
+		local tolerance = math.max(limit.burst - 1, 0) * limit.interval
+		t = math.max(t, (limit.state['tat'] or 0) - tolerance)
+	end
+	for _, quota in ipairs(limit.quotas) do
+		local id = quotaID(quota)
+		local windowStart = t - (t % quota.window)
+		local currentStart = limit.state['ws:' .. id] or 0
+		if windowStart <= currentStart and (limit.state['wc:' .. id] or 0) >= quota.requests then
+			t = currentStart + quota.window
+		end
+	end
+	return t
+end
+
+-- Quotas can push the slot into a later window, past the slot allowed by another limit, so repeat until they agree.
+while true do
+	local nextSlot = slot
+	for _, limit in ipairs(limits) do
+		nextSlot = earliest(limit, nextSlot)
+	end
+	if nextSlot == slot then
+		break
+	end
+	slot = nextSlot
+end
+
+if #limits == 0 then
+	return {slot - now, 0, 0, slot}
+end
+
+-- Queue the request on the throttles it isn't queued on yet, keeping its place otherwise.
+local queued = false
+for _, limit in ipairs(limits) do
+	local existing = redis.call('ZSCORE', limit.queueKey, token)
+	if existing then
+		limit.score = tonumber(existing)
+		queued = true
+	end
+end
+if not queued then
+	for _, limit in ipairs(limits) do
+		if (limit.max_queue or 0) > 0 and redis.call('ZCARD', limit.queueKey) >= limit.max_queue then
+			return {0, 1, 2, 0}
+		end
+	end
+end
+
+-- The request at the head of a queue is the first request of the highest priority that is owed a slot,
+-- otherwise the first request.
+local function head(limit)
+	for p = 1, -1, -1 do
+		if (limit.state['credit:' .. p] or 0) >= 1 then
+			local first = redis.call('ZRANGEBYSCORE', limit.queueKey, laneStart(p), '(' .. laneStart(p - 1), 'LIMIT', 0, 1)
+			if #first > 0 then
+				return first[1]
+			end
+		end
+	end
+	return redis.call('ZRANGE', limit.queueKey, 0, 0)[1]
+end
+
+-- Estimate the slot assuming every request ahead takes one interval of each throttle.
+-- The request may take its slot if it's at the head of every queue, or at the head of some and arrived before the
+-- requests at the head of the others, see waiter.canTake. Tokens start with their arrival time.
+local isHead = false
+local blocked = false
+local estimate = slot
+for _, limit in ipairs(limits) do
+	if not limit.score then
+		if redis.call('ZCARD', limit.queueKey) == 0 then
+			-- Start the virtual time over once the throttle has no requests waiting.
+			redis.call('DEL', limit.fairKey)
+			for p = -1, 1 do
+				redis.call('HDEL', limit.key, 'vtime:' .. p)
+				limit.state['vtime:' .. p] = 0
+			end
+		end
+		local field = priority .. ':' .. client
+		local start = math.max(limit.state['vtime:' .. priority] or 0, tonumber(redis.call('HGET', limit.fairKey, field) or '0'))
+		local finish = start + fairUnit / weight
+		redis.call('HSET', limit.fairKey, field, score(finish))
+		limit.score = tonumber(laneStart(priority)) + finish
+	end
+
+	redis.call('ZADD', limit.queueKey, score(limit.score), token)
+	redis.call('ZADD', limit.seenKey, string.format('%.0f', now), token)
+	for _, key in ipairs({limit.queueKey, limit.seenKey, limit.fairKey}) do
+		redis.call('PEXPIRE', key, math.ceil(lease / 1000) + 1000)
+	end
+	local first = head(limit)
+	if first == token then
+		isHead = true
+	else
+		if first < token then
+			blocked = true
+		end
+		local ahead = redis.call('ZCOUNT', limit.queueKey, '-inf', '(' .. score(limit.score))
+		estimate = math.max(estimate, slot + math.max(ahead, 1) * limit.interval)
+	end
+end
+
+local function leave()
+	for _, limit in ipairs(limits) do
+		redis.call('ZREM', limit.queueKey, token)
+		redis.call('ZREM', limit.seenKey, token)
+	end
+end
+
+-- Reject the request rather than sending it late.
+local deadline = nil
+if maxWait > 0 then
+	deadline = now + maxWait
+end
+if ruleMaxWait > 0 and (deadline == nil or arrival + ruleMaxWait < deadline) then
+	deadline = arrival + ruleMaxWait
+end
+if deadline and estimate > deadline then
+	leave()
+	return {estimate - now, 1, 1, estimate}
+end
+
+if not isHead or blocked or slot > now then
+	return {estimate - now, 1, 3, estimate}
+end
+
+leave()
+for _, limit in ipairs(limits) do
+	local ttl = 0
+	if limit.interval > 0 then
+		local tat = math.max(limit.state['tat'] or 0, slot) + limit.interval
+		redis.call('HSET', limit.key, 'tat', string.format('%.0f', tat))
+		ttl = tat - now
+	end
+	for _, quota in ipairs(limit.quotas) do
+		local id = quotaID(quota)
+		local windowStart = slot - (slot % quota.window)
+		local count = limit.state['wc:' .. id] or 0
+		if windowStart > (limit.state['ws:' .. id] or 0) then
+			count = 0
+			redis.call('HSET', limit.key, 'ws:' .. id, string.format('%.0f', windowStart))
+		end
+		redis.call('HSET', limit.key, 'wc:' .. id, count + 1)
+		ttl = math.max(ttl, windowStart + quota.window - now)
+	end
+
+	-- Advance the virtual time to the start of the request and credit the lower priorities that have requests waiting.
+	local start = limit.score - tonumber(laneStart(priority)) - fairUnit / weight
+	redis.call('HSET', limit.key, 'vtime:' .. priority, score(start))
+	redis.call('HSET', limit.key, 'credit:' .. priority, math.max((limit.state['credit:' .. priority] or 0) - 1, 0))
+	for p = priority - 1, -1, -1 do
+		local lowerCredit = 0
+		if redis.call('ZCOUNT', limit.queueKey, laneStart(p), '(' .. laneStart(p - 1)) > 0 then
+			lowerCredit = (limit.state['credit:' .. p] or 0) + credit
+		end
+		redis.call('HSET', limit.key, 'credit:' .. p, lowerCredit)
+	end
+	redis.call('PEXPIRE', limit.key, math.ceil(math.max(ttl, lease) / 1000) + 1000)
+end
+
+return {slot - now, 1, 0, slot}
+`)
+
+// Adjusts the rate of every adaptive throttle on the request's path to the outcome of a request, see aimd.
+// KEYS[1] is the hash of throttle limits, followed by the adaptive key of every path prefix.
+// ARGV[1] is the latency in microseconds and ARGV[2] 1 if the upstream server asked to back off, ARGV[3] to ARGV[8] are the
+// AIMD parameters, followed by the throttle key of every path prefix.
+// Returns the index of the path prefix, the new interval in microseconds and 1 if the rate decreased, for every adaptive throttle.
+var redisAdaptScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local latency = tonumber(ARGV[1])
+local backoff = ARGV[2] == '1'
+local increase = tonumber(ARGV[3])
+local decrease = tonumber(ARGV[4])
+local spikeFactor = tonumber(ARGV[5])
+local weight = tonumber(ARGV[6])
+local minSamples = tonumber(ARGV[7])
+local cooldown = tonumber(ARGV[8])
+local n = #ARGV - 8
+
+local result = {}
+for i = 1, n do
+	local encoded = redis.call('HGET', KEYS[1], ARGV[8 + i])
+	local limit = encoded and cjson.decode(encoded)
+	if limit and limit.adaptive then
+		local key = KEYS[1 + i]
+		local minRate = limit.adaptive.min_rate.requests / limit.adaptive.min_rate.window * 1000000
+		local maxRate = limit.adaptive.max_rate.requests / limit.adaptive.max_rate.window * 1000000
+
+		local state = {}
+		local fields = redis.call('HGETALL', key)
+		for j = 1, #fields, 2 do
+			state[fields[j]] = tonumber(fields[j + 1])
+		end
+
+		local rate = minRate
+		if state['interval'] then
+			rate = 1000000 / state['interval']
+		elseif limit.interval > 0 then
+			rate = 1000000 / limit.interval
+		end
+		local average = state['latency'] or 0
+		local samples = state['samples'] or 0
+		local lastDecrease = state['last_decrease'] or 0
+
+		local spike = samples >= minSamples and latency > average * spikeFactor
+		if samples == 0 then
+			average = latency
+		else
+			average = average + weight * (latency - average)
+		end
+
+		local decreased = 0
+		if backoff or spike then
+			if now - lastDecrease >= cooldown then
+				rate = rate * decrease
+				lastDecrease = now
+				decreased = 1
+			end
+		else
+			rate = rate + increase * maxRate
+		end
+		rate = math.min(math.max(rate, minRate), maxRate)
+
+		local interval = math.floor(1000000 / rate)
+		redis.call('HSET', key,
+			'interval', string.format('%.0f', interval),
+			'latency', string.format('%.0f', average),
+			'samples', samples + 1,
+			'last_decrease', string.format('%.0f', lastDecrease))
+		-- Forget the rate of throttles that are no longer used.
+		redis.call('PEXPIRE', key, 86400000)
+		table.insert(result, i)
+		table.insert(result, interval)
+		table.insert(result, decreased)
+	end
+end
+return result
+`)
+
+// Blocks the throttle until now + ARGV[1] microseconds, unless it's blocked for longer already.
+// KEYS[1] is the block key.
+var redisBlockScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local blockedUntil = now + tonumber(ARGV[1])
+
+local blocked = tonumber(redis.call('GET', KEYS[1]) or '0')
+if blocked < blockedUntil then
+	redis.call('SET', KEYS[1], string.format('%.0f', blockedUntil), 'PX', math.ceil(tonumber(ARGV[1]) / 1000) + 1000)
+end
+return 0
+`)
+
+// Takes a concurrency slot in every concurrency-limited throttle on the request's path, atomically.
+// KEYS[1] is the hash of throttle limits, followed by the in-flight key of every path prefix.
+// ARGV[1] is the request's token and ARGV[2] the lease in microseconds, followed by the throttle key of every path prefix.
+// In-flight keys are sorted sets of tokens scored by the expiry of their lease, so slots of crashed proxies are freed.
+// Returns -1 if a throttle is full, otherwise the number of slots taken.
+var redisAcquireScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local n = #ARGV - 2
+
+local limited = {}
+for i = 1, n do
+	local encoded = redis.call('HGET', KEYS[1], ARGV[2 + i])
+	if encoded then
+		local limit = cjson.decode(encoded)
+		local maxConcurrent = tonumber(limit.max_concurrent) or 0
+		if maxConcurrent > 0 then
+			local key = KEYS[1 + i]
+			redis.call('ZREMRANGEBYSCORE', key, '-inf', string.format('%.0f', now))
+			if redis.call('ZCARD', key) >= maxConcurrent then
+				return -1
+			end
+			table.insert(limited, key)
+		end
+	end
+end
+
+local expiry = now + tonumber(ARGV[2])
+for _, key in ipairs(limited) do
+	redis.call('ZADD', key, string.format('%.0f', expiry), ARGV[1])
+	redis.call('PEXPIRE', key, math.ceil(tonumber(ARGV[2]) / 1000) + 1000)
+end
+return #limited
+`)
+
+// Extends the lease of a token in the in-flight keys it holds a slot in.
+// KEYS are the in-flight keys, ARGV[1] is the token and ARGV[2] the lease in microseconds.
+var redisRefreshScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local expiry = now + tonumber(ARGV[2])
+for _, key in ipairs(KEYS) do
+	redis.call('ZADD', key, 'XX', string.format('%.0f', expiry), ARGV[1])
+	redis.call('PEXPIRE', key, math.ceil(tonumber(ARGV[2]) / 1000) + 1000)
+end
+return 0
+`)
+
+const (
+	// How long a concurrency slot is held without being refreshed.
+	redisLease = 30 * time.Second
+	// How long to wait before trying to take a concurrency slot again.
+	redisAcquireInterval = 50 * time.Millisecond
+	// Maximum time a queued request waits before checking its place in the queue again,
+	// so that it notices requests with a higher priority and requests ahead of it that left.
+	redisQueuePollInterval = time.Second
+	// Minimum time a queued request waits before checking its place again, when its slot is due but taken by another request.
+	redisQueueMinPollInterval = 10 * time.Millisecond
+	// How long a queued request keeps its place without checking it, so that requests of stopped proxies leave the queue.
+	redisQueueLease = 5 * time.Second
+)
+
+// A Limit as stored in Redis, with durations in microseconds.
+type redisLimit struct {
+	Interval      int64        `json:"interval"`
+	Burst         int          `json:"burst"`
+	Quotas        []redisQuota `json:"quotas"`
+	MaxConcurrent int          `json:"max_concurrent"`
+	MaxQueue      int          `json:"max_queue"`
+	MaxWait       int64        `json:"max_wait"`
+	// Omitted rather than null if the limit isn't adaptive, the scripts check whether it's set.
+	Adaptive *redisAdaptiveRate `json:"adaptive,omitempty"`
+}
+
+type redisAdaptiveRate struct {
+	MinRate redisQuota `json:"min_rate"`
+	MaxRate redisQuota `json:"max_rate"`
+}
+
+type redisQuota struct {
+	Requests int   `json:"requests"`
+	Window   int64 `json:"window"`
+}
+
+func encodeRedisLimit(limit Limit) (string, error) {
+	encoded := redisLimit{
+		Interval:      limit.Interval.Microseconds(),
+		Burst:         limit.Burst,
+		MaxConcurrent: limit.MaxConcurrent,
+		MaxQueue:      limit.MaxQueue,
+		MaxWait:       limit.MaxWait.Microseconds(),
+		// Never encode the quotas as null, the script iterates over them.
+		Quotas: make([]redisQuota, 0, len(limit.Quotas)),
+	}
+	for _, quota := range limit.Quotas {
+		encoded.Quotas = append(encoded.Quotas, redisQuota{quota.Requests, quota.Window.Microseconds()})
+	}
+	if limit.Adaptive != nil {
+		encoded.Adaptive = &redisAdaptiveRate{
+			MinRate: redisQuota{limit.Adaptive.MinRate.Requests, limit.Adaptive.MinRate.Window.Microseconds()},
+			MaxRate: redisQuota{limit.Adaptive.MaxRate.Requests, limit.Adaptive.MaxRate.Window.Microseconds()},
+		}
+	}
+
+	data, err := json.Marshal(encoded)
+	return string(data), err
+}
+
+func decodeRedisLimit(data string) (Limit, error) {
+	decoded := redisLimit{}
+	err := json.Unmarshal([]byte(data), &decoded)
+	if err != nil {
+		return Limit{}, err
+	}
+
+	limit := Limit{
+		Interval:      time.Duration(decoded.Interval) * time.Microsecond,
+		Burst:         decoded.Burst,
+		MaxConcurrent: decoded.MaxConcurrent,
+		MaxQueue:      decoded.MaxQueue,
+		MaxWait:       time.Duration(decoded.MaxWait) * time.Microsecond,
+	}
+	for _, quota := range decoded.Quotas {
+		limit.Quotas = append(limit.Quotas, Quota{quota.Requests, time.Duration(quota.Window) * time.Microsecond})
+	}
+	if decoded.Adaptive != nil {
+		limit.Adaptive = &AdaptiveRate{
+			MinRate: Quota{decoded.Adaptive.MinRate.Requests, time.Duration(decoded.Adaptive.MinRate.Window) * time.Microsecond},
+			MaxRate: Quota{decoded.Adaptive.MaxRate.Requests, time.Duration(decoded.Adaptive.MaxRate.Window) * time.Microsecond},
+		}
+	}
+	return limit, nil
+}
+
+// A HTTPThrottle that coordinates through Redis, so that several proxies share their throttles.
+// Like the MemoryHTTPThrottle, throttles are set per path segment and a request waits on all throttles for its path.
+// Requests reserve their slot atomically using the Redis server's clock, so throttles hold across proxies.
+type RedisHTTPThrottle struct {
+	ctx             context.Context
+	client          *redis.Client
+	prefix          string
+	defaultDuration time.Duration
+}
+
+// Create a throttle that stores its state in Redis, under keys with the provided prefix.
+// Requests without throttles wait for the default duration.
+func NewRedisHTTPThrottle(ctx context.Context, client *redis.Client, prefix string, defaultDuration time.Duration) *RedisHTTPThrottle {
+	return &RedisHTTPThrottle{
+		ctx:             ctx,
+		client:          client,
+		prefix:          prefix,
+		defaultDuration: defaultDuration,
+	}
+}
+
+func (t *RedisHTTPThrottle) throttlesKey() string {
+	return t.prefix + "throttles"
+}
+
+func (t *RedisHTTPThrottle) stateKey(key string) string {
+	return t.prefix + "state:" + key
+}
+
+func (t *RedisHTTPThrottle) blockKey(key string) string {
+	return t.prefix + "block:" + key
+}
+
+func (t *RedisHTTPThrottle) inFlightKey(key string) string {
+	return t.prefix + "inflight:" + key
+}
+
+func (t *RedisHTTPThrottle) adaptiveKey(key string) string {
+	return t.prefix + "adaptive:" + key
+}
+
+func (t *RedisHTTPThrottle) Adapt(req *http.Request, latency time.Duration, backoff bool) {
+	pathParts := strings.Split(req.URL.Path, "/")
+
+	throttleKeys := make([]string, 0, len(pathParts))
+	keys := []string{t.throttlesKey()}
+	for i := range pathParts {
+		key := getRequestKey(req, strings.Join(pathParts[:i+1], "/"))
+		throttleKeys = append(throttleKeys, key)
+		keys = append(keys, t.adaptiveKey(key))
+	}
+
+	args := []any{
+		latency.Microseconds(), backoff,
+		AdaptiveIncrease, AdaptiveDecrease, AdaptiveLatencySpike,
+		adaptiveLatencyWeight, adaptiveLatencySamples, adaptiveDecreaseCooldown.Microseconds(),
+	}
+	for _, key := range throttleKeys {
+		args = append(args, key)
+	}
+
+	result, err := redisAdaptScript.Run(t.ctx, t.client, keys, args...).Int64Slice()
+	if err != nil {
+		log.DefaultLogger.Error("could not adapt throttle rate", "url", req.URL.String(), "error", err.Error())
+		return
+	}
+	for i := 0; i+2 < len(result); i += 3 {
+		logAdaptedRate(throttleKeys[result[i]-1], time.Duration(result[i+1])*time.Microsecond, result[i+2] == 1)
+	}
+}
+
+func (t *RedisHTTPThrottle) Acquire(ctx context.Context, req *http.Request) (func(), error) {
+	pathParts := strings.Split(req.URL.Path, "/")
+	token := randomToken()
+
+	inFlightKeys := make([]string, 0, len(pathParts))
+	args := []any{token, redisLease.Microseconds()}
+	for i := range pathParts {
+		key := getRequestKey(req, strings.Join(pathParts[:i+1], "/"))
+		inFlightKeys = append(inFlightKeys, t.inFlightKey(key))
+		args = append(args, key)
+	}
+	keys := append([]string{t.throttlesKey()}, inFlightKeys...)
+
+	for {
+		acquired, err := redisAcquireScript.Run(t.ctx, t.client, keys, args...).Int64()
+		if err != nil {
+			// Don't hold up requests when Redis is unavailable, the rate limits still apply.
+			log.DefaultLogger.Error("could not acquire concurrency slot", "url", req.URL.String(), "error", err.Error())
+			return func() {}, nil
+		}
+		if acquired == 0 {
+			return func() {}, nil
+		}
+		if acquired > 0 {
+			break
+		}
+
+		if err := sleepContext(ctx, redisAcquireInterval); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the lease alive while the request is in flight.
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(redisLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := redisRefreshScript.Run(t.ctx, t.client, inFlightKeys, token, redisLease.Microseconds()).Err()
+				if err != nil {
+					log.DefaultLogger.Error("could not refresh concurrency slot", "url", req.URL.String(), "error", err.Error())
+				}
+			}
+		}
+	}()
+
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+			pipe := t.client.Pipeline()
+			for _, key := range inFlightKeys {
+				pipe.ZRem(t.ctx, key, token)
+			}
+			_, err := pipe.Exec(t.ctx)
+			if err != nil {
+				log.DefaultLogger.Error("could not release concurrency slot", "url", req.URL.String(), "error", err.Error())
+			}
+		})
+	}, nil
+}
+
+func (t *RedisHTTPThrottle) queueKey(key string) string {
+	return t.prefix + "queue:" + key
+}
+
+func (t *RedisHTTPThrottle) seenKey(key string) string {
+	return t.prefix + "seen:" + key
+}
+
+func (t *RedisHTTPThrottle) fairKey(key string) string {
+	return t.prefix + "fair:" + key
+}
+
+// Sleep for the duration, returning the context's error if it's done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (t *RedisHTTPThrottle) Wait(ctx context.Context, req *http.Request) error {
+	pathParts := strings.Split(req.URL.Path, "/")
+	token := queueToken()
+
+	throttleKeys := make([]any, 0, len(pathParts))
+	stateKeys := make([]string, 0, len(pathParts))
+	blockKeys := make([]string, 0, len(pathParts))
+	adaptiveKeys := make([]string, 0, len(pathParts))
+	queueKeys := make([]string, 0, len(pathParts))
+	seenKeys := make([]string, 0, len(pathParts))
+	fairKeys := make([]string, 0, len(pathParts))
+	for i := range pathParts {
+		key := getRequestKey(req, strings.Join(pathParts[:i+1], "/"))
+		throttleKeys = append(throttleKeys, key)
+		stateKeys = append(stateKeys, t.stateKey(key))
+		blockKeys = append(blockKeys, t.blockKey(key))
+		adaptiveKeys = append(adaptiveKeys, t.adaptiveKey(key))
+		queueKeys = append(queueKeys, t.queueKey(key))
+		seenKeys = append(seenKeys, t.seenKey(key))
+		fairKeys = append(fairKeys, t.fairKey(key))
+	}
+
+	keys := append([]string{t.throttlesKey()}, stateKeys...)
+	keys = append(keys, blockKeys...)
+	keys = append(keys, adaptiveKeys...)
+	keys = append(keys, queueKeys...)
+	keys = append(keys, seenKeys...)
+	keys = append(keys, fairKeys...)
+
+	priority := priorityFromContext(ctx)
+	client, weight := clientFromContext(ctx)
+	start := time.Now()
+	deadline, hasDeadline := ctx.Deadline()
+	for {
+		// The script takes the maximum wait relative to the Redis server's clock, zero means unlimited.
+		maxWait := time.Duration(0)
+		if hasDeadline {
+			maxWait = max(time.Until(deadline), time.Microsecond)
+		}
+
+		args := []any{
+			maxWait.Microseconds(), token, int(priority), priorityCredit(), redisQueueLease.Microseconds(),
+			client, weight, time.Since(start).Microseconds(),
+		}
+		result, err := redisWaitScript.Run(t.ctx, t.client, keys, append(args, throttleKeys...)...).Int64Slice()
+		if err != nil || len(result) != 4 {
+			// Fall back to the default duration, rather than sending requests unthrottled.
+			log.DefaultLogger.Error("could not reserve throttle slot", "url", req.URL.String(), "error", errorString(err))
+			t.leaveQueue(req, queueKeys, seenKeys, token)
+			return sleepContext(ctx, t.defaultDuration)
+		}
+
+		wait := time.Duration(result[0]) * time.Microsecond
+		switch result[2] {
+		case 1:
+			return &ThrottleError{Reason: ErrWaitTooLong, RetryAfter: wait}
+		case 2:
+			return &ThrottleError{Reason: ErrQueueFull}
+		case 3:
+			err := sleepContext(ctx, min(max(wait, redisQueueMinPollInterval), redisQueuePollInterval))
+			if err != nil {
+				t.leaveQueue(req, queueKeys, seenKeys, token)
+				return err
+			}
+			continue
+		}
+
+		// If the request had no explicit throttles, wait at least the default duration.
+		if result[1] == 0 {
+			wait = max(wait, t.defaultDuration)
+			if hasDeadline && time.Now().Add(wait).After(deadline) {
+				return &ThrottleError{Reason: ErrWaitTooLong, RetryAfter: wait}
+			}
+		}
+		return sleepContext(ctx, wait)
+	}
+}
+
+// Remove a request that stopped waiting from the queues, so that the requests behind it don't wait for its lease to expire.
+func (t *RedisHTTPThrottle) leaveQueue(req *http.Request, queueKeys []string, seenKeys []string, token string) {
+	pipe := t.client.Pipeline()
+	for _, key := range append(queueKeys, seenKeys...) {
+		pipe.ZRem(t.ctx, key, token)
+	}
+	_, err := pipe.Exec(t.ctx)
+	if err != nil {
+		log.DefaultLogger.Error("could not leave throttle queue", "url", req.URL.String(), "error", err.Error())
+	}
+}
+
+func (t *RedisHTTPThrottle) Block(req *http.Request, d time.Duration) {
+	key := getRequestKey(req, req.URL.Path)
+	err := redisBlockScript.Run(t.ctx, t.client, []string{t.blockKey(key)}, d.Microseconds()).Err()
+	if err != nil {
+		log.DefaultLogger.Error("could not block throttle", "key", key, "error", err.Error())
+	}
+}
+
+func (t *RedisHTTPThrottle) SetThrottle(req *http.Request, limit Limit) {
+	key := getRequestKey(req, req.URL.Path)
+	encoded, err := encodeRedisLimit(limit)
+	if err == nil {
+		err = t.client.HSet(t.ctx, t.throttlesKey(), key, encoded).Err()
+	}
+	if err != nil {
+		log.DefaultLogger.Error("could not set throttle", "key", key, "error", err.Error())
+	}
+}
+
+func (t *RedisHTTPThrottle) RemoveThrottle(req *http.Request) {
+	key := getRequestKey(req, req.URL.Path)
+	err := t.client.HDel(t.ctx, t.throttlesKey(), key).Err()
+	if err != nil {
+		log.DefaultLogger.Error("could not remove throttle", "key", key, "error", err.Error())
+	}
+}
+
+func (t *RedisHTTPThrottle) Throttles() []ThrottleSetting {
+	throttles, err := t.client.HGetAll(t.ctx, t.throttlesKey()).Result()
+	if err != nil {
+		log.DefaultLogger.Error("could not list throttles", "error", err.Error())
+		return []ThrottleSetting{}
+	}
+
+	settings := make([]ThrottleSetting, 0, len(throttles))
+	for key, encoded := range throttles {
+		// Keys are formatted as "METHOD url", see getRequestKey.
+		method, url, ok := strings.Cut(key, " ")
+		limit, err := decodeRedisLimit(encoded)
+		if !ok || err != nil {
+			continue
+		}
+		if limit.Adaptive != nil {
+			// Show the current rate of adaptive throttles.
+			interval, err := t.client.HGet(t.ctx, t.adaptiveKey(key), "interval").Int64()
+			if err == nil {
+				limit.Interval = min(max(time.Duration(interval)*time.Microsecond, rateInterval(limit.Adaptive.MaxRate.PerSecond())),
+					rateInterval(limit.Adaptive.MinRate.PerSecond()))
+			}
+		}
+		settings = append(settings, ThrottleSetting{
+			Method: method,
+			URL:    url,
+			Limit:  limit,
+		})
+	}
+
+	sortThrottleSettings(settings)
+	return settings
+}
+
+// The throttle holds no local resources, the Redis client is closed by its owner.
+func (t *RedisHTTPThrottle) Stop() {}
+
+// Generate a random token identifying a queued request, starting with its arrival time so that tokens sort by arrival.
+func queueToken() string {
+	return fmt.Sprintf("%016x", time.Now().UnixMicro()) + randomToken()
+}
+
+// Generate a random token identifying a concurrency slot.
+func randomToken() string {
+	data := make([]byte, 16)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisHTTPThrottleIsShared(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Skipf("redis is not running")
+		return
+	}
+
+	prefix := fmt.Sprintf("chaperone-test-%d:", time.Now().UnixNano())
+	throttleA := NewRedisHTTPThrottle(ctx, client, prefix, 0)
+	throttleB := NewRedisHTTPThrottle(ctx, client, prefix, 0)
+
+	url, err := url.Parse("http://example.com/api/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: "GET", URL: url}
+
+	throttleA.SetThrottle(&http.Request{Method: "GET", URL: url.JoinPath("..")}, IntervalLimit(200*time.Millisecond))
+	if settings := throttleB.Throttles(); len(settings) != 1 || settings[0].Limit.Interval != 200*time.Millisecond {
+		t.Fatalf("unexpected throttles %+v", settings)
+	}
+
+	// Four requests through two throttles are spaced as if they went through one.
+	start := time.Now()
+	wg := &sync.WaitGroup{}
+	for _, throttle := range []*RedisHTTPThrottle{throttleA, throttleB} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			throttle.Wait(context.Background(), req)
+			throttle.Wait(context.Background(), req)
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+		t.Fatalf("requests weren't throttled across proxies, took %s", elapsed)
+	}
+
+	// A block seen by one proxy pauses the other.
+	throttleA.Block(req, time.Second)
+	start = time.Now()
+	throttleB.Wait(context.Background(), req)
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("block wasn't shared across proxies, took %s", elapsed)
+	}
+
+	throttleB.RemoveThrottle(&http.Request{Method: "GET", URL: url.JoinPath("..")})
+	if len(throttleA.Throttles()) != 0 {
+		t.Fail()
+	}
+}
+
+func TestRedisHTTPThrottleMaxConcurrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Skipf("redis is not running")
+		return
+	}
+
+	prefix := fmt.Sprintf("chaperone-test-%d:", time.Now().UnixNano())
+	throttleA := NewRedisHTTPThrottle(ctx, client, prefix, 0)
+	throttleB := NewRedisHTTPThrottle(ctx, client, prefix, 0)
+
+	url, err := url.Parse("http://example.com/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: "GET", URL: url}
+	throttleA.SetThrottle(req, Limit{MaxConcurrent: 1})
+
+	// A slot taken by one proxy is taken for the other.
+	release, _ := throttleA.Acquire(context.Background(), req)
+	acquired := make(chan func())
+	go func() {
+		release, _ := throttleB.Acquire(context.Background(), req)
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("concurrency limit wasn't shared across proxies")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	release()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("request wasn't released")
+	}
+}
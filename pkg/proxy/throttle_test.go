@@ -0,0 +1,377 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRemoveThrottleReleasesWaiters(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+
+	url, err := url.Parse("http://example.com/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: "GET", URL: url}
+
+	throttle.SetThrottle(req, IntervalLimit(time.Hour))
+	if settings := throttle.Throttles(); len(settings) != 1 || settings[0].Limit.Interval != time.Hour {
+		t.Fatalf("unexpected throttles %+v", settings)
+	}
+
+	// The first request passes, the next one waits for the interval.
+	throttle.Wait(context.Background(), req)
+
+	done := make(chan struct{})
+	go func() {
+		throttle.Wait(context.Background(), req)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	throttle.RemoveThrottle(req)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waiter wasn't released")
+	}
+
+	if len(throttle.Throttles()) != 0 {
+		t.Fail()
+	}
+}
+
+func TestMemoryHTTPThrottleBurst(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+
+	url, err := url.Parse("http://example.com/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: "GET", URL: url}
+
+	rate, err := ParseRate("10/second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttle.SetThrottle(req, NewRateLimit(rate, 3))
+
+	// The burst passes at once, after which requests are spaced by the interval.
+	start := time.Now()
+	for range 3 {
+		throttle.Wait(context.Background(), req)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("burst was throttled, took %s", time.Since(start))
+	}
+
+	throttle.Wait(context.Background(), req)
+	throttle.Wait(context.Background(), req)
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Fatalf("requests after the burst weren't throttled, took %s", elapsed)
+	}
+}
+
+func TestMemoryHTTPThrottleQuota(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+
+	url, err := url.Parse("http://example.com/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: "GET", URL: url}
+
+	quota, err := ParseRate("2/200ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttle.SetThrottle(req, Limit{Quotas: []Quota{quota}})
+
+	// The third request waits for the next window.
+	start := time.Now()
+	for range 3 {
+		throttle.Wait(context.Background(), req)
+	}
+	windowEnd := start.Truncate(200 * time.Millisecond).Add(200 * time.Millisecond)
+	if time.Now().Before(windowEnd) {
+		t.Fatalf("quota wasn't enforced")
+	}
+}
+
+func TestMemoryHTTPThrottleMaxConcurrent(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+
+	url, err := url.Parse("http://example.com/api/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: "GET", URL: url}
+	throttle.SetThrottle(&http.Request{Method: "GET", URL: url.JoinPath("..")}, Limit{MaxConcurrent: 2})
+
+	releaseA, _ := throttle.Acquire(context.Background(), req)
+	releaseB, _ := throttle.Acquire(context.Background(), req)
+
+	// The third request queues until one of the others is done.
+	acquired := make(chan func())
+	go func() {
+		release, _ := throttle.Acquire(context.Background(), req)
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("concurrency limit wasn't enforced")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	releaseA()
+	// Releasing twice doesn't free another slot.
+	releaseA()
+	select {
+	case releaseC := <-acquired:
+		defer releaseC()
+	case <-time.After(time.Second):
+		t.Fatal("request wasn't released")
+	}
+
+	go func() {
+		release, _ := throttle.Acquire(context.Background(), req)
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("concurrency limit wasn't enforced after a double release")
+	case <-time.After(100 * time.Millisecond):
+	}
+	releaseB()
+	<-acquired
+}
+
+func TestMemoryHTTPThrottleMaxWait(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+
+	url, err := url.Parse("http://example.com/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: "GET", URL: url}
+	throttle.SetThrottle(req, Limit{Interval: 200 * time.Millisecond, Burst: 1, MaxWait: 300 * time.Millisecond})
+
+	if err := throttle.Wait(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// A request that can't meet its deadline is rejected right away.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var throttleErr *ThrottleError
+	if err := throttle.Wait(ctx, req); !errors.As(err, &throttleErr) || !errors.Is(err, ErrWaitTooLong) || throttleErr.RetryAfter <= 0 {
+		t.Fatalf("expected the request to be rejected, got %v", err)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("expected the request to be rejected without waiting")
+	}
+
+	// The rejected request didn't take up a slot, the next one waits for the interval. The one after exceeds the max wait.
+	waited := make(chan error)
+	go func() {
+		waited <- throttle.Wait(context.Background(), req)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := throttle.Wait(context.Background(), req); !errors.Is(err, ErrWaitTooLong) {
+		t.Fatalf("expected the request to exceed the throttle's max wait, got %v", err)
+	}
+	if err := <-waited; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryHTTPThrottleMaxQueue(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+
+	url, err := url.Parse("http://example.com/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: "GET", URL: url}
+	throttle.SetThrottle(req, Limit{Interval: 200 * time.Millisecond, Burst: 1, MaxQueue: 1})
+
+	if err := throttle.Wait(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	waited := make(chan error)
+	go func() {
+		waited <- throttle.Wait(context.Background(), req)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := throttle.Wait(context.Background(), req); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected the queue to be full, got %v", err)
+	}
+	if err := <-waited; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryHTTPThrottleCancelWait(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+
+	url, err := url.Parse("http://example.com/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: "GET", URL: url}
+	throttle.SetThrottle(req, IntervalLimit(200*time.Millisecond))
+
+	start := time.Now()
+	if err := throttle.Wait(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cancelled request stops waiting and gives its slot to the next request.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := throttle.Wait(ctx, req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the wait to be cancelled, got %v", err)
+	}
+
+	if err := throttle.Wait(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("the cancelled request kept its slot, took %s", elapsed)
+	}
+}
+
+func TestMemoryHTTPThrottlePriority(t *testing.T) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+
+	url, err := url.Parse("http://example.com/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: "GET", URL: url}
+	throttle.SetThrottle(req, IntervalLimit(100*time.Millisecond))
+
+	if err := throttle.Wait(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queue low priority requests, then a high priority request that takes the next slot.
+	order := make(chan Priority, 4)
+	for _, priority := range []Priority{PriorityLow, PriorityLow, PriorityLow, PriorityHigh} {
+		go func() {
+			throttle.Wait(WithPriority(context.Background(), priority), req)
+			order <- priority
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if first := <-order; first != PriorityHigh {
+		t.Fatalf("expected the high priority request to go first, got %s", first)
+	}
+	for range 3 {
+		<-order
+	}
+}
+
+// A request queued on the throttle, to the path with the priority and client.
+type nestedWait struct {
+	path     string
+	priority Priority
+	client   string
+}
+
+// Queue the requests on a host throttle and a throttle on its /api path, and check that they are all released in time.
+func testNestedThrottles(t *testing.T, waits []nestedWait) {
+	throttle := NewMemoryHTTPThrottle(0)
+	defer throttle.Stop()
+
+	for _, path := range []string{"", "/api"} {
+		throttle.SetThrottle(&http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "example.com", Path: path}}, IntervalLimit(100*time.Millisecond))
+	}
+	req := &http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/"}}
+	if err := throttle.Wait(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, len(waits))
+	for _, wait := range waits {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ctx = WithClient(WithPriority(ctx, wait.priority), wait.client, 1)
+			errs <- throttle.Wait(ctx, &http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "example.com", Path: wait.path}})
+		}()
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Every request takes one slot of the host throttle.
+	deadline := time.After(time.Duration(len(waits)+5) * 100 * time.Millisecond)
+	for range waits {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-deadline:
+			t.Fatal("requests waiting on nested throttles weren't released")
+		}
+	}
+}
+
+func TestMemoryHTTPThrottleNestedClients(t *testing.T) {
+	// The /api request of c2 heads the host throttle, as c1 queued other requests on it,
+	// while the /api request of c1 heads the /api throttle.
+	testNestedThrottles(t, []nestedWait{
+		{"/other", PriorityNormal, "c1"},
+		{"/other", PriorityNormal, "c1"},
+		{"/other", PriorityNormal, "c1"},
+		{"/api", PriorityNormal, "c1"},
+		{"/api", PriorityNormal, "c2"},
+	})
+}
+
+func TestMemoryHTTPThrottleNestedPriorities(t *testing.T) {
+	// The low priority /api request earns credit on the host throttle while high priority requests take its slots,
+	// until it heads the host throttle while a later high priority /api request heads the /api throttle.
+	waits := []nestedWait{{"/api", PriorityLow, ""}}
+	for range 12 {
+		waits = append(waits, nestedWait{"/other", PriorityHigh, ""})
+	}
+	waits = append(waits, nestedWait{"/api", PriorityHigh, ""})
+	testNestedThrottles(t, waits)
+}
+
+func TestParseRate(t *testing.T) {
+	for rate, expected := range map[string]Quota{
+		"1000/minute": {1000, time.Minute},
+		"10000/day":   {10000, 24 * time.Hour},
+		"5 / seconds": {5, time.Second},
+		"5/10s":       {5, 10 * time.Second},
+	} {
+		quota, err := ParseRate(rate)
+		if err != nil || quota != expected {
+			t.Errorf("expected %+v for %s, got %+v (%v)", expected, rate, quota, err)
+		}
+	}
+
+	for _, rate := range []string{"1000", "0/minute", "-1/minute", "10/fortnight"} {
+		if _, err := ParseRate(rate); err == nil {
+			t.Errorf("expected an error for %s", rate)
+		}
+	}
+}